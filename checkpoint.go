@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	checkpointTypeConfigMap = "configmap"
+	checkpointTypeFile      = "file"
+)
+
+const defaultCheckpointConfigMapName = "sentry-kubernetes-checkpoint"
+const defaultCheckpointFilePath = "sentry-kubernetes-checkpoint.json"
+const defaultCheckpointInterval = 10 * time.Second
+const minCheckpointInterval = time.Second
+
+// How long the last save of the checkpoints may take after the watcher stops
+const checkpointFlushTimeout = 5 * time.Second
+
+const serviceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// The maximum number of event keys we keep for the last seen timestamp, only
+// used if the resource versions cannot be compared
+const checkpointSeenKeysLimit = 100
+
+// The position of the events watcher in the stream of events
+type eventsCheckpoint struct {
+	// The resource version of the last processed event
+	ResourceVersion string `json:"resourceVersion"`
+	// The timestamp of the most recent processed event
+	Timestamp time.Time `json:"timestamp"`
+	// Keys of events that were processed with exactly the same timestamp
+	SeenKeys []string `json:"seenKeys,omitempty"`
+}
+
+type checkpointStore interface {
+	// Returns all stored checkpoints by key
+	Load(ctx context.Context) (map[string]*eventsCheckpoint, error)
+	// Stores the given checkpoints and removes the deleted keys, all other
+	// keys are kept as they are
+	Save(ctx context.Context, checkpoints map[string]*eventsCheckpoint, deleted []string) error
+}
+
+func encodeCheckpoints(checkpoints map[string]*eventsCheckpoint) (map[string]string, error) {
+	encoded := make(map[string]string, len(checkpoints))
+	for key, checkpoint := range checkpoints {
+		raw, err := json.Marshal(checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		encoded[key] = string(raw)
+	}
+	return encoded, nil
+}
+
+// / ConfigMap store
+type configMapCheckpointStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *configMapCheckpointStore) Load(ctx context.Context) (map[string]*eventsCheckpoint, error) {
+	checkpoints := map[string]*eventsCheckpoint{}
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key, raw := range configMap.Data {
+		checkpoint := &eventsCheckpoint{}
+		if err := json.Unmarshal([]byte(raw), checkpoint); err != nil {
+			return nil, fmt.Errorf("cannot decode checkpoint %q: %v", key, err)
+		}
+		checkpoints[key] = checkpoint
+	}
+	return checkpoints, nil
+}
+
+func (s *configMapCheckpointStore) Save(ctx context.Context, checkpoints map[string]*eventsCheckpoint, deleted []string) error {
+	encoded, err := encodeCheckpoints(checkpoints)
+	if err != nil {
+		return err
+	}
+
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+	// Several watchers can share the same ConfigMap, so retry on conflicts
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+				},
+				Data: encoded,
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Somebody was faster, re-run the update
+				return apierrors.NewConflict(v1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		for key, raw := range encoded {
+			configMap.Data[key] = raw
+		}
+		for _, key := range deleted {
+			delete(configMap.Data, key)
+		}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// / File store (mostly for out-of-cluster runs)
+type fileCheckpointStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Must be called with the lock held
+func (s *fileCheckpointStore) readAll() (map[string]*eventsCheckpoint, error) {
+	checkpoints := map[string]*eventsCheckpoint{}
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &checkpoints); err != nil {
+		return nil, fmt.Errorf("cannot decode checkpoint file %q: %v", s.path, err)
+	}
+	return checkpoints, nil
+}
+
+func (s *fileCheckpointStore) Load(ctx context.Context) (map[string]*eventsCheckpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readAll()
+}
+
+func (s *fileCheckpointStore) Save(ctx context.Context, checkpoints map[string]*eventsCheckpoint, deleted []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.readAll()
+	if err != nil {
+		return err
+	}
+	for key, checkpoint := range checkpoints {
+		stored[key] = checkpoint
+	}
+	for _, key := range deleted {
+		delete(stored, key)
+	}
+	raw, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so the checkpoint is never half-written
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(raw); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.path)
+}
+
+func getAgentNamespace() string {
+	if namespace := strings.TrimSpace(getConfigValue("SENTRY_K8S_CHECKPOINT_NAMESPACE")); namespace != "" {
+		return namespace
+	}
+	if raw, err := os.ReadFile(serviceAccountNamespacePath); err == nil {
+		if namespace := strings.TrimSpace(string(raw)); namespace != "" {
+			return namespace
+		}
+	}
+	return v1.NamespaceDefault
+}
+
+// Returns nil if checkpointing is disabled
+func getCheckpointStore(clientset kubernetes.Interface) (checkpointStore, error) {
+	checkpointType := strings.ToLower(strings.TrimSpace(getConfigValue("SENTRY_K8S_EVENTS_CHECKPOINT")))
+
+	switch checkpointType {
+	case "":
+		return nil, nil
+	case checkpointTypeConfigMap:
+		name := strings.TrimSpace(getConfigValue("SENTRY_K8S_CHECKPOINT_CONFIGMAP"))
+		if name == "" {
+			name = defaultCheckpointConfigMapName
+		}
+		return &configMapCheckpointStore{
+			clientset: clientset,
+			namespace: getAgentNamespace(),
+			name:      name,
+		}, nil
+	case checkpointTypeFile:
+		path := strings.TrimSpace(getConfigValue("SENTRY_K8S_CHECKPOINT_FILE"))
+		if path == "" {
+			path = defaultCheckpointFilePath
+		}
+		return &fileCheckpointStore{path: path}, nil
+	default:
+		return nil, fmt.Errorf("invalid checkpoint type provided in SENTRY_K8S_EVENTS_CHECKPOINT: %s", checkpointType)
+	}
+}
+
+func getCheckpointInterval() time.Duration {
+	interval, err := parseDurationSetting("SENTRY_K8S_CHECKPOINT_INTERVAL", defaultCheckpointInterval, minCheckpointInterval)
+	if err != nil {
+		globalLogger.Warn().Msgf("%v, using the default: %s", err, defaultCheckpointInterval)
+		return defaultCheckpointInterval
+	}
+	return interval
+}
+
+func getCheckpointKey(namespace string) string {
+	if namespace == v1.NamespaceAll {
+		return "events." + allNamespacesLabel
+	}
+	return "events." + namespace
+}
+
+func getEventKey(event *v1.Event) string {
+	return fmt.Sprintf("%s:%s", event.UID, event.ResourceVersion)
+}
+
+// Resource versions are opaque strings, but the ones of the etcd-backed API
+// server are increasing integers. Returns false if they cannot be compared.
+func compareResourceVersions(a, b string) (int, bool) {
+	aVersion, err := strconv.ParseUint(a, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	bVersion, err := strconv.ParseUint(b, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case aVersion < bVersion:
+		return -1, true
+	case aVersion > bVersion:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
+func getEventTimestamp(event *v1.Event) metav1.Time {
+	eventTs := event.LastTimestamp
+	if eventTs.IsZero() && event.Series != nil {
+		eventTs = metav1.Time(event.Series.LastObservedTime)
+	}
+	if eventTs.IsZero() {
+		eventTs = metav1.Time(event.EventTime)
+	}
+	return eventTs
+}
+
+// Keeps track of the last processed event of a single watcher and
+// periodically persists it to the checkpoint store. The watcher of a dynamic
+// namespace selection keeps a checkpoint per namespace, so namespaces can be
+// handed over to another replica and removed when they are no longer watched.
+type eventsCheckpointer struct {
+	store checkpointStore
+	// The key of all checkpointed events, empty if every namespace has its
+	// own key
+	key      string
+	interval time.Duration
+
+	mu        sync.Mutex
+	current   map[string]*eventsCheckpoint
+	dirty     map[string]bool
+	deleted   map[string]bool
+	lastSaved time.Time
+}
+
+func newEventsCheckpointer(store checkpointStore, namespace string, interval time.Duration) *eventsCheckpointer {
+	checkpointer := newNamespacedEventsCheckpointer(store, interval)
+	checkpointer.key = getCheckpointKey(namespace)
+	return checkpointer
+}
+
+func newNamespacedEventsCheckpointer(store checkpointStore, interval time.Duration) *eventsCheckpointer {
+	return &eventsCheckpointer{
+		store:    store,
+		interval: interval,
+		current:  map[string]*eventsCheckpoint{},
+		dirty:    map[string]bool{},
+		deleted:  map[string]bool{},
+	}
+}
+
+func (c *eventsCheckpointer) getKey(namespace string) string {
+	if c.key != "" {
+		return c.key
+	}
+	return getCheckpointKey(namespace)
+}
+
+// true -> the key belongs to this checkpointer
+func (c *eventsCheckpointer) ownsKey(key string) bool {
+	if c.key != "" {
+		return key == c.key
+	}
+	return key != getCheckpointKey(v1.NamespaceAll)
+}
+
+// Loads the stored checkpoints, returns false if nothing was stored before
+func (c *eventsCheckpointer) load(ctx context.Context) (bool, error) {
+	checkpoints, err := c.store.Load(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = map[string]*eventsCheckpoint{}
+	for key, checkpoint := range checkpoints {
+		if c.ownsKey(key) && !c.deleted[key] {
+			c.current[key] = checkpoint
+		}
+	}
+	c.lastSaved = time.Now()
+	return len(c.current) > 0, nil
+}
+
+// Loads the stored checkpoint of a namespace that starts being watched,
+// another replica might have watched it before
+func (c *eventsCheckpointer) loadNamespace(ctx context.Context, namespace string) error {
+	checkpoints, err := c.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := c.getKey(namespace)
+	delete(c.deleted, key)
+	if checkpoint, found := checkpoints[key]; found && !c.dirty[key] {
+		c.current[key] = checkpoint
+	}
+	return nil
+}
+
+// Drops the checkpoint of a namespace that is no longer watched. If remove is
+// true, the stored checkpoint is removed on the next save, otherwise it is
+// saved for the replica that watches the namespace next.
+func (c *eventsCheckpointer) forgetNamespace(ctx context.Context, namespace string, remove bool) error {
+	c.mu.Lock()
+	key := c.getKey(namespace)
+	if remove {
+		delete(c.current, key)
+		delete(c.dirty, key)
+		c.deleted[key] = true
+	}
+	c.mu.Unlock()
+
+	if err := c.save(ctx, true); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty[key] {
+		delete(c.current, key)
+	}
+	return nil
+}
+
+// true -> the namespace has a checkpoint to resume from
+func (c *eventsCheckpointer) hasCheckpoint(namespace string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found := c.current[c.getKey(namespace)]
+	return found
+}
+
+// Returns the resource version to resume watching from, or an empty string if
+// the events have to be listed. The watcher of a dynamic namespace selection
+// resumes from the oldest checkpoint of its namespaces.
+func (c *eventsCheckpointer) resourceVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key != "" {
+		if checkpoint := c.current[c.key]; checkpoint != nil {
+			return checkpoint.ResourceVersion
+		}
+		return ""
+	}
+
+	oldest := ""
+	for _, checkpoint := range c.current {
+		if oldest == "" {
+			oldest = checkpoint.ResourceVersion
+			continue
+		}
+		cmp, ok := compareResourceVersions(checkpoint.ResourceVersion, oldest)
+		if !ok {
+			return ""
+		}
+		if cmp < 0 {
+			oldest = checkpoint.ResourceVersion
+		}
+	}
+	if _, ok := compareResourceVersions(oldest, oldest); !ok {
+		return ""
+	}
+	return oldest
+}
+
+// true -> the event was already processed before
+func (c *eventsCheckpointer) isProcessed(event *v1.Event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.current[c.getKey(event.Namespace)]
+	if current == nil {
+		return false
+	}
+	if cmp, ok := compareResourceVersions(event.ResourceVersion, current.ResourceVersion); ok {
+		return cmp <= 0
+	}
+	if current.Timestamp.IsZero() {
+		return false
+	}
+	eventTs := getEventTimestamp(event)
+	if eventTs.IsZero() {
+		return false
+	}
+	ts := eventTs.Time.Truncate(time.Second)
+	if ts.Before(current.Timestamp) {
+		return true
+	}
+	if ts.Equal(current.Timestamp) {
+		key := getEventKey(event)
+		for _, seenKey := range current.SeenKeys {
+			if seenKey == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *eventsCheckpointer) markProcessed(event *v1.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.getKey(event.Namespace)
+	current := c.current[key]
+	if current == nil {
+		current = &eventsCheckpoint{}
+		c.current[key] = current
+	}
+	// Replays of the same events must not move the checkpoint back
+	if cmp, ok := compareResourceVersions(event.ResourceVersion, current.ResourceVersion); !ok || cmp > 0 {
+		if event.ResourceVersion != "" {
+			current.ResourceVersion = event.ResourceVersion
+		}
+	}
+	c.dirty[key] = true
+
+	eventTs := getEventTimestamp(event)
+	if eventTs.IsZero() {
+		return
+	}
+	// Timestamps are stored with second precision, be consistent here
+	ts := eventTs.Time.Truncate(time.Second)
+	eventKey := getEventKey(event)
+	if ts.After(current.Timestamp) {
+		current.Timestamp = ts
+		current.SeenKeys = []string{eventKey}
+	} else if ts.Equal(current.Timestamp) && len(current.SeenKeys) < checkpointSeenKeysLimit {
+		current.SeenKeys = append(current.SeenKeys, eventKey)
+	}
+}
+
+// Persists the checkpoints that changed. If force is false, they are saved
+// at most once per interval.
+func (c *eventsCheckpointer) save(ctx context.Context, force bool) error {
+	c.mu.Lock()
+	if (len(c.dirty) == 0 && len(c.deleted) == 0) || (!force && time.Since(c.lastSaved) < c.interval) {
+		c.mu.Unlock()
+		return nil
+	}
+	checkpoints := make(map[string]*eventsCheckpoint, len(c.dirty))
+	for key := range c.dirty {
+		checkpoint := *c.current[key]
+		checkpoint.SeenKeys = append([]string{}, checkpoint.SeenKeys...)
+		checkpoints[key] = &checkpoint
+	}
+	deleted := make([]string, 0, len(c.deleted))
+	for key := range c.deleted {
+		deleted = append(deleted, key)
+	}
+	c.dirty = map[string]bool{}
+	c.deleted = map[string]bool{}
+	c.lastSaved = time.Now()
+	c.mu.Unlock()
+
+	if err := c.store.Save(ctx, checkpoints, deleted); err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for key := range checkpoints {
+			if _, found := c.current[key]; found {
+				c.dirty[key] = true
+			}
+		}
+		for _, key := range deleted {
+			if _, found := c.current[key]; !found {
+				c.deleted[key] = true
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Saves the checkpoints once per interval until the context is done, and one
+// last time after that. The shutdown waits for the last save.
+func (c *eventsCheckpointer) run(ctx context.Context) {
+	logger := zerolog.Ctx(ctx)
+
+	if !inFlightEvents.start() {
+		return
+	}
+	defer inFlightEvents.done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.save(ctx, true); err != nil {
+				logger.Error().Msgf("Cannot save the events checkpoint: %s", err)
+			}
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), checkpointFlushTimeout)
+			defer cancel()
+			if err := c.save(flushCtx, true); err != nil {
+				logger.Error().Msgf("Cannot save the events checkpoint: %s", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Build a mock event with the given identity and timestamp
+func newCheckpointTestEvent(uid string, resourceVersion string, ts time.Time) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "TestCheckpointEvent",
+			Namespace:       "TestCheckpointNamespace",
+			UID:             types.UID("uid-" + uid),
+			ResourceVersion: resourceVersion,
+		},
+		LastTimestamp: metav1.NewTime(ts),
+		Type:          corev1.EventTypeWarning,
+	}
+}
+
+// Test that the checkpoint survives a round trip through both stores,
+// and that the restored checkpoint recognizes already processed events
+func TestCheckpointStores(t *testing.T) {
+	ctx := context.Background()
+
+	stores := map[string]checkpointStore{
+		"file": &fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoint.json")},
+		"configmap": &configMapCheckpointStore{
+			clientset: fake.NewSimpleClientset(),
+			namespace: "TestCheckpointNamespace",
+			name:      "TestCheckpointConfigMap",
+		},
+	}
+
+	ts, _ := time.Parse("2006-01-02 15:04:05", "2023-11-15 18:42:00")
+	processedEvent := newCheckpointTestEvent("1", "100", ts)
+	sameTimeEvent := newCheckpointTestEvent("2", "101", ts)
+	olderEvent := newCheckpointTestEvent("3", "99", ts.Add(-time.Minute))
+	newerEvent := newCheckpointTestEvent("4", "102", ts.Add(time.Minute))
+	// Reported late, by a node with a skewed clock
+	skewedEvent := newCheckpointTestEvent("5", "103", ts.Add(-time.Hour))
+
+	for name, store := range stores {
+		// Nothing is stored yet
+		checkpointer := newEventsCheckpointer(store, "TestCheckpointNamespace", time.Hour)
+		resumed, err := checkpointer.load(ctx)
+		if err != nil {
+			t.Fatalf("[%s] unexpected error: %v", name, err)
+		}
+		if resumed {
+			t.Errorf("[%s] resumed from an empty store", name)
+		}
+
+		checkpointer.markProcessed(processedEvent)
+		if err := checkpointer.save(ctx, true); err != nil {
+			t.Fatalf("[%s] unexpected error: %v", name, err)
+		}
+
+		// Simulate a restart
+		restored := newEventsCheckpointer(store, "TestCheckpointNamespace", time.Hour)
+		resumed, err = restored.load(ctx)
+		if err != nil {
+			t.Fatalf("[%s] unexpected error: %v", name, err)
+		}
+		if !resumed {
+			t.Fatalf("[%s] cannot resume from a saved checkpoint", name)
+		}
+		if restored.resourceVersion() != "100" {
+			t.Errorf("[%s] received resource version %q, wanted %q", name, restored.resourceVersion(), "100")
+		}
+
+		expected := map[*corev1.Event]bool{
+			processedEvent: true,
+			olderEvent:     true,
+			sameTimeEvent:  false,
+			newerEvent:     false,
+			skewedEvent:    false,
+		}
+		for event, wanted := range expected {
+			if restored.isProcessed(event) != wanted {
+				t.Errorf("[%s] event %s: received isProcessed=%v, wanted %v", name, getEventKey(event), !wanted, wanted)
+			}
+		}
+	}
+}
+
+// Test that events are processed in the order of their resource versions, so
+// an older event that comes after a newer one is not skipped as processed
+func TestEventsProcessorReplayOrder(t *testing.T) {
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := sentry.SetHubOnContext(context.Background(), sentry.NewHub(client, sentry.NewScope()))
+
+	store := &fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoint.json")}
+	ts, _ := time.Parse("2006-01-02 15:04:05", "2023-11-15 18:42:00")
+	newEvent := func(uid string, resourceVersion string, ts time.Time) *corev1.Event {
+		event := newCheckpointTestEvent(uid, resourceVersion, ts)
+		event.Name = "TestEventsProcessorReplayOrder" + uid
+		event.Message = "TestEventsProcessorReplayOrder " + uid
+		return event
+	}
+
+	// The previous run stopped after the first event
+	previous := newEventsCheckpointer(store, "TestCheckpointNamespace", time.Hour)
+	previous.markProcessed(newEvent("1", "100", ts))
+	if err := previous.save(ctx, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkpointer := newEventsCheckpointer(store, "TestCheckpointNamespace", time.Hour)
+	processor := newEventsProcessor(metav1.Time{}, checkpointer)
+	newerEvent := newEvent("3", "102", ts.Add(2*time.Minute))
+
+	// Notifications before the initial replay are ignored
+	processor.handle(ctx, &watch.Event{Type: watch.Added, Object: newerEvent})
+
+	informer := cache.NewSharedIndexInformer(nil, &corev1.Event{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, event := range []*corev1.Event{newerEvent, newEvent("2", "101", ts.Add(time.Minute)), newEvent("1", "100", ts)} {
+		if err := informer.GetStore().Add(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replays before the initial list only reload the checkpoint
+	if err := processor.replay(ctx, informer.GetStore().List(), true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(transport.Events()) != 0 {
+		t.Fatalf("reported %d events before the initial replay", len(transport.Events()))
+	}
+	processor.replayInitial(ctx, informer)
+
+	// Pending notifications of the replayed events
+	processor.handle(ctx, &watch.Event{Type: watch.Added, Object: newerEvent})
+	processor.handle(ctx, &watch.Event{Type: watch.Modified, Object: newEvent("2", "101", ts.Add(time.Minute))})
+	processor.handle(ctx, &watch.Event{Type: watch.Added, Object: newEvent("4", "103", ts.Add(3*time.Minute))})
+	// The watch caught up with the replay
+	if len(processor.replayedKeys) != 0 {
+		t.Errorf("kept %d replayed keys after the watch caught up", len(processor.replayedKeys))
+	}
+
+	expectedMessages := []string{
+		"TestEventsProcessorReplayOrder 2",
+		"TestEventsProcessorReplayOrder 3",
+		"TestEventsProcessorReplayOrder 4",
+	}
+	events := transport.Events()
+	if len(events) != len(expectedMessages) {
+		t.Fatalf("reported %d events, wanted %d", len(events), len(expectedMessages))
+	}
+	for i, event := range events {
+		if event.Message != expectedMessages[i] {
+			t.Errorf("event %d has message %q, wanted %q", i, event.Message, expectedMessages[i])
+		}
+	}
+}
+
+// Test that the checkpoints of a dynamic selection are kept per namespace,
+// kept for the next owner of a namespace, and removed once the namespace is
+// no longer selected
+func TestNamespacedCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	store := &fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoint.json")}
+
+	ts, _ := time.Parse("2006-01-02 15:04:05", "2023-11-15 18:42:00")
+	newEvent := func(namespace string, uid string) *corev1.Event {
+		event := newCheckpointTestEvent(uid, uid, ts)
+		event.Namespace = namespace
+		return event
+	}
+
+	// A checkpoint of a static selection is not touched
+	static := newEventsCheckpointer(store, corev1.NamespaceAll, time.Hour)
+	static.markProcessed(newEvent("payments", "1"))
+	if err := static.save(ctx, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checkpointer := newNamespacedEventsCheckpointer(store, time.Hour)
+	if resumed, err := checkpointer.load(ctx); err != nil || resumed {
+		t.Fatalf("resumed from the checkpoint of a static selection: %v, %v", resumed, err)
+	}
+	for _, namespace := range []string{"payments", "sandbox", "moved"} {
+		checkpointer.markProcessed(newEvent(namespace, "2"))
+	}
+	if err := checkpointer.save(ctx, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := checkpointer.forgetNamespace(ctx, "sandbox", true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkpointer.forgetNamespace(ctx, "moved", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checkpointer.hasCheckpoint("sandbox") || checkpointer.hasCheckpoint("moved") {
+		t.Errorf("checkpoints of namespaces that are no longer watched are kept in memory")
+	}
+
+	checkpoints, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, key := range []string{"events.__all__", "events.payments", "events.moved"} {
+		if _, found := checkpoints[key]; !found {
+			t.Errorf("checkpoint %q was removed", key)
+		}
+	}
+	if _, found := checkpoints["events.sandbox"]; found {
+		t.Errorf("checkpoint of an unselected namespace was not removed")
+	}
+
+	// The next owner of the moved namespace resumes after its checkpoint
+	next := newNamespacedEventsCheckpointer(store, time.Hour)
+	if err := next.loadNamespace(ctx, "moved"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !next.isProcessed(newEvent("moved", "2")) {
+		t.Errorf("the checkpoint of the moved namespace was not handed over")
+	}
+
+	// The watch resumes from the oldest checkpoint of the namespaces
+	next.markProcessed(newEvent("payments", "5"))
+	if next.resourceVersion() != "2" {
+		t.Errorf("received resource version %q, wanted %q", next.resourceVersion(), "2")
+	}
+}
+
+// Test that the first list only carries the resource version of the
+// checkpoint, and that the events are listed in full after that
+func TestResumableListWatch(t *testing.T) {
+	event := newCheckpointTestEvent("1", "100", time.Now())
+	clientset := fake.NewSimpleClientset(event)
+
+	var listed []interface{}
+	lw := &resumableListWatch{
+		ListerWatcher:   newEventsListWatch(clientset, eventsAPICoreV1, corev1.NamespaceAll),
+		resourceVersion: "100",
+		onList: func(objects []interface{}) {
+			listed = objects
+		},
+	}
+
+	list, err := lw.List(metav1.ListOptions{ResourceVersion: "0", Limit: 500})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resourceVersion := list.(metav1.ListInterface).GetResourceVersion(); resourceVersion != "100" {
+		t.Errorf("received resource version %q, wanted %q", resourceVersion, "100")
+	}
+	if listed != nil {
+		t.Errorf("the first list was replayed")
+	}
+
+	// The resource version expired
+	list, err = lw.List(metav1.ListOptions{Limit: 500})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if items := list.(*corev1.EventList).Items; len(items) != 1 {
+		t.Errorf("listed %d events, wanted 1", len(items))
+	}
+	if len(listed) != 1 {
+		t.Errorf("replayed %d events, wanted 1", len(listed))
+	}
+}
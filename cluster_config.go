@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -22,7 +21,7 @@ func getClusterConfig() (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
-	configType := strings.ToLower(os.Getenv("SENTRY_K8S_CLUSTER_CONFIG_TYPE"))
+	configType := strings.ToLower(getConfigValue("SENTRY_K8S_CLUSTER_CONFIG_TYPE"))
 	configType = strings.TrimSpace(configType)
 
 	if configType == "" {
@@ -62,7 +61,7 @@ func getClusterConfig() (*rest.Config, error) {
 	if autoConfig || configType == typeOutCluster {
 		log.Debug().Msg("Initializing out-of-cluster config...")
 
-		kubeconfig := os.Getenv("SENTRY_K8S_KUBECONFIG_PATH")
+		kubeconfig := getConfigValue("SENTRY_K8S_KUBECONFIG_PATH")
 
 		if kubeconfig == "" {
 			log.Debug().Msg("Trying to read kubeconfig from home directory...")
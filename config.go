@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	globalLogger "github.com/rs/zerolog/log"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultConfigReloadInterval = 10 * time.Second
+const minConfigReloadInterval = time.Second
+
+// The configuration file (YAML or JSON), e.g. mounted from a ConfigMap.
+// Every setting maps to an environment variable, and environment variables
+// have priority over the file. Unset fields keep the defaults.
+type agentConfig struct {
+	LogLevel        string   `json:"logLevel,omitempty" env:"SENTRY_K8S_LOG_LEVEL"`
+	FlushTimeout    string   `json:"flushTimeout,omitempty" env:"SENTRY_K8S_FLUSH_TIMEOUT"`
+	StatusAddress   string   `json:"statusAddress,omitempty" env:"SENTRY_K8S_STATUS_ADDRESS"`
+	WatchNamespaces []string `json:"watchNamespaces,omitempty" env:"SENTRY_K8S_WATCH_NAMESPACES"`
+	// Label selector, e.g. "team=payments,env!=dev"
+	WatchNamespacesSelector string   `json:"watchNamespacesSelector,omitempty" env:"SENTRY_K8S_WATCH_NAMESPACES_SELECTOR"`
+	ExcludeNamespaces       []string `json:"excludeNamespaces,omitempty" env:"SENTRY_K8S_EXCLUDE_NAMESPACES"`
+	WatchHistorical         *bool    `json:"watchHistorical,omitempty" env:"SENTRY_K8S_WATCH_HISTORICAL"`
+	WatchNodes              *bool    `json:"watchNodes,omitempty" env:"SENTRY_K8S_WATCH_NODES"`
+	TrackReleases           *bool    `json:"trackReleases,omitempty" env:"SENTRY_K8S_TRACK_RELEASES"`
+	MonitorCronJobs         *bool    `json:"monitorCronJobs,omitempty" env:"SENTRY_K8S_MONITOR_CRONJOBS"`
+	EventsAPI               string   `json:"eventsAPI,omitempty" env:"SENTRY_K8S_EVENTS_API"`
+
+	Sentry struct {
+		DSN         string   `json:"dsn,omitempty" env:"SENTRY_DSN"`
+		Environment string   `json:"environment,omitempty" env:"SENTRY_ENVIRONMENT"`
+		Release     string   `json:"release,omitempty" env:"SENTRY_RELEASE"`
+		URL         string   `json:"url,omitempty" env:"SENTRY_URL"`
+		AuthToken   string   `json:"authToken,omitempty" env:"SENTRY_AUTH_TOKEN"`
+		Org         string   `json:"org,omitempty" env:"SENTRY_ORG"`
+		Projects    []string `json:"projects,omitempty" env:"SENTRY_PROJECT"`
+	} `json:"sentry,omitempty"`
+
+	Cluster struct {
+		ConfigType     string `json:"configType,omitempty" env:"SENTRY_K8S_CLUSTER_CONFIG_TYPE"`
+		KubeconfigPath string `json:"kubeconfigPath,omitempty" env:"SENTRY_K8S_KUBECONFIG_PATH"`
+	} `json:"cluster,omitempty"`
+
+	Checkpoint struct {
+		Type      string `json:"type,omitempty" env:"SENTRY_K8S_EVENTS_CHECKPOINT"`
+		ConfigMap string `json:"configMap,omitempty" env:"SENTRY_K8S_CHECKPOINT_CONFIGMAP"`
+		File      string `json:"file,omitempty" env:"SENTRY_K8S_CHECKPOINT_FILE"`
+		Namespace string `json:"namespace,omitempty" env:"SENTRY_K8S_CHECKPOINT_NAMESPACE"`
+		Interval  string `json:"interval,omitempty" env:"SENTRY_K8S_CHECKPOINT_INTERVAL"`
+	} `json:"checkpoint,omitempty"`
+
+	LeaderElection struct {
+		Enabled       *bool  `json:"enabled,omitempty" env:"SENTRY_K8S_LEADER_ELECTION"`
+		LeaseName     string `json:"leaseName,omitempty" env:"SENTRY_K8S_LEADER_ELECTION_LEASE_NAME"`
+		Namespace     string `json:"namespace,omitempty" env:"SENTRY_K8S_LEADER_ELECTION_NAMESPACE"`
+		LeaseDuration string `json:"leaseDuration,omitempty" env:"SENTRY_K8S_LEADER_ELECTION_LEASE_DURATION"`
+	} `json:"leaderElection,omitempty"`
+
+	Sharding struct {
+		Enabled     *bool  `json:"enabled,omitempty" env:"SENTRY_K8S_SHARDING"`
+		StatefulSet string `json:"statefulSet,omitempty" env:"SENTRY_K8S_SHARDING_STATEFULSET"`
+	} `json:"sharding,omitempty"`
+
+	Integrations struct {
+		GKE *bool `json:"gke,omitempty" env:"SENTRY_K8S_INTEGRATION_GKE_ENABLED"`
+	} `json:"integrations,omitempty"`
+
+	Filters struct {
+		OutEventReasons   []string           `json:"outEventReasons,omitempty" env:"SENTRY_K8S_FILTER_OUT_EVENT_REASONS"`
+		OutEventSources   []string           `json:"outEventSources,omitempty" env:"SENTRY_K8S_FILTER_OUT_EVENT_SOURCES"`
+		PodWaitingReasons []string           `json:"podWaitingReasons,omitempty" env:"SENTRY_K8S_POD_WAITING_REASONS"`
+		NormalEvents      []string           `json:"normalEvents,omitempty" env:"SENTRY_K8S_REPORT_NORMAL_EVENTS"`
+		NormalEventsMode  string             `json:"normalEventsMode,omitempty" env:"SENTRY_K8S_NORMAL_EVENTS_MODE"`
+		Rules             []filterRuleConfig `json:"rules,omitempty" env:"SENTRY_K8S_FILTER_RULES"`
+	} `json:"filters,omitempty"`
+
+	PodLogs struct {
+		TailLines  *int `json:"tailLines,omitempty" env:"SENTRY_K8S_POD_LOGS_TAIL_LINES"`
+		LimitBytes *int `json:"limitBytes,omitempty" env:"SENTRY_K8S_POD_LOGS_LIMIT_BYTES"`
+	} `json:"podLogs,omitempty"`
+
+	Releases struct {
+		Template           string   `json:"template,omitempty" env:"SENTRY_K8S_RELEASE_TEMPLATE"`
+		Sources            []string `json:"sources,omitempty" env:"SENTRY_K8S_RELEASE_SOURCES"`
+		EnvironmentSources []string `json:"environmentSources,omitempty" env:"SENTRY_K8S_ENVIRONMENT_SOURCES"`
+	} `json:"releases,omitempty"`
+
+	SeverityRules []severityRuleConfig `json:"severityRules,omitempty" env:"SENTRY_K8S_SEVERITY_RULES"`
+	Routes        []routeConfig        `json:"routes,omitempty" env:"SENTRY_K8S_ROUTES"`
+}
+
+// The values of the configuration file, by environment variable
+var configValues = struct {
+	mu     sync.RWMutex
+	values map[string]string
+}{values: map[string]string{}}
+
+// Held for reading while an event is processed, so a reload doesn't
+// change the settings midway
+var configLock sync.RWMutex
+
+// Returns the value of the environment variable, or the value from the
+// configuration file if the variable is not set
+func getConfigValue(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	configValues.mu.RLock()
+	defer configValues.mu.RUnlock()
+	return configValues.values[name]
+}
+
+func setConfigValues(values map[string]string) {
+	configValues.mu.Lock()
+	defer configValues.mu.Unlock()
+	configValues.values = values
+}
+
+func getConfigValues() map[string]string {
+	configValues.mu.RLock()
+	defer configValues.mu.RUnlock()
+	return configValues.values
+}
+
+// Converts a field to the format of its environment variable; lists are
+// comma-separated, structured values are JSON
+func formatConfigValue(value reflect.Value) (string, bool, error) {
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return "", false, nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), value.String() != "", nil
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), true, nil
+	case reflect.Int:
+		return strconv.FormatInt(value.Int(), 10), true, nil
+	case reflect.Slice:
+		if value.Len() == 0 {
+			return "", false, nil
+		}
+		if value.Type().Elem().Kind() == reflect.String {
+			return strings.Join(value.Interface().([]string), ","), true, nil
+		}
+		// Expressions contain "&&", which shouldn't be escaped
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(value.Interface())
+		return strings.TrimSpace(buffer.String()), true, err
+	}
+	return "", false, fmt.Errorf("unsupported type %s", value.Type())
+}
+
+func collectConfigValues(value reflect.Value, values map[string]string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		env := field.Tag.Get("env")
+		if env == "" {
+			if field.Type.Kind() == reflect.Struct {
+				if err := collectConfigValues(value.Field(i), values); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		formatted, set, err := formatConfigValue(value.Field(i))
+		if err != nil {
+			return fmt.Errorf("%s: %v", field.Name, err)
+		}
+		if set {
+			values[env] = formatted
+		}
+	}
+	return nil
+}
+
+func (c *agentConfig) toValues() (map[string]string, error) {
+	values := map[string]string{}
+	if err := collectConfigValues(reflect.ValueOf(c).Elem(), values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Unknown fields and wrong types are errors
+func parseConfig(raw []byte) (*agentConfig, error) {
+	config := &agentConfig{}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return config, nil
+	}
+	if err := yaml.UnmarshalStrict(raw, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func parseConfigValues(path string, raw []byte) (map[string]string, error) {
+	config, err := parseConfig(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	values, err := config.toValues()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// Returns the default if the setting is empty
+func parseDurationSetting(name string, defaultValue time.Duration, minValue time.Duration) (time.Duration, error) {
+	raw := strings.TrimSpace(getConfigValue(name))
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", name, raw)
+	}
+	if value < minValue {
+		return 0, fmt.Errorf("invalid %s: %q, must be at least %s", name, raw, minValue)
+	}
+	return value, nil
+}
+
+// Returns the default if the setting is empty
+func parsePositiveIntSetting(name string, defaultValue int64) (int64, error) {
+	raw := strings.TrimSpace(getConfigValue(name))
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q, must be a positive integer", name, raw)
+	}
+	return value, nil
+}
+
+// Returns the environment variables of the settings of the given kind
+func collectConfigSettings(configType reflect.Type, kind reflect.Kind, names []string) []string {
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		env := field.Tag.Get("env")
+		if env == "" {
+			if field.Type.Kind() == reflect.Struct {
+				names = collectConfigSettings(field.Type, kind, names)
+			}
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == kind {
+			names = append(names, env)
+		}
+	}
+	return names
+}
+
+// Checks the settings that are only read later (e.g. when the informers
+// start), so mistakes are reported at startup
+func validateConfig() error {
+	for _, name := range collectConfigSettings(reflect.TypeOf(agentConfig{}), reflect.Bool, nil) {
+		if raw := getConfigValue(name); !isValidBool(raw) {
+			return fmt.Errorf("invalid %s: %q, must be one of: 1, true, yes, 0, false, no", name, raw)
+		}
+	}
+	if _, err := parseDurationSetting("SENTRY_K8S_FLUSH_TIMEOUT", defaultFlushTimeout, 0); err != nil {
+		return err
+	}
+	if _, err := parseDurationSetting("SENTRY_K8S_CHECKPOINT_INTERVAL", defaultCheckpointInterval, minCheckpointInterval); err != nil {
+		return err
+	}
+	if _, err := parseDurationSetting("SENTRY_K8S_LEADER_ELECTION_LEASE_DURATION", defaultLeaseDuration, minLeaseDuration); err != nil {
+		return err
+	}
+	if _, err := parseDurationSetting("SENTRY_K8S_CONFIG_RELOAD_INTERVAL", defaultConfigReloadInterval, minConfigReloadInterval); err != nil {
+		return err
+	}
+	if _, _, err := parsePodLogsOptions(); err != nil {
+		return err
+	}
+	if _, err := parseNormalEventsMode(); err != nil {
+		return err
+	}
+	if _, err := getEventsAPI(); err != nil {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(getConfigValue("SENTRY_K8S_CLUSTER_CONFIG_TYPE"))) {
+	case "", typeAutoCluster, typeInCluster, typeOutCluster:
+	default:
+		return fmt.Errorf("invalid cluster configuration type provided in SENTRY_K8S_CLUSTER_CONFIG_TYPE")
+	}
+	switch strings.ToLower(strings.TrimSpace(getConfigValue("SENTRY_K8S_EVENTS_CHECKPOINT"))) {
+	case "", checkpointTypeConfigMap, checkpointTypeFile:
+	default:
+		return fmt.Errorf("invalid checkpoint type provided in SENTRY_K8S_EVENTS_CHECKPOINT")
+	}
+	if isTruthy(getConfigValue("SENTRY_K8S_SHARDING")) && isTruthy(getConfigValue("SENTRY_K8S_LEADER_ELECTION")) {
+		return fmt.Errorf("SENTRY_K8S_SHARDING and SENTRY_K8S_LEADER_ELECTION cannot be enabled together")
+	}
+	if logLevel := getConfigValue("SENTRY_K8S_LOG_LEVEL"); logLevel != "" {
+		if _, found := logLevels[strings.ToLower(logLevel)]; !found {
+			return fmt.Errorf("invalid log level provided in SENTRY_K8S_LOG_LEVEL: %s", logLevel)
+		}
+	}
+	return nil
+}
+
+// Prepares everything that can be changed without restarting the watchers
+func prepareReloadableConfig() error {
+	configureLogLevel()
+	if err := prepareEventFilters(); err != nil {
+		return err
+	}
+	if err := preparePodLogsOptions(); err != nil {
+		return err
+	}
+	if err := prepareFilterRules(); err != nil {
+		return err
+	}
+	if err := prepareSeverityRules(); err != nil {
+		return err
+	}
+	if err := prepareRoutes(); err != nil {
+		return err
+	}
+	if err := prepareReleaseTemplate(); err != nil {
+		return err
+	}
+	return prepareReleaseMapping()
+}
+
+// Loads the configuration file set in SENTRY_K8S_CONFIG_FILE, if any.
+// Returns the raw content, to detect changes.
+func loadConfigFile() ([]byte, error) {
+	path := strings.TrimSpace(os.Getenv("SENTRY_K8S_CONFIG_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseConfigValues(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	setConfigValues(values)
+	globalLogger.Info().Msgf("Loaded the configuration file %s", path)
+	return raw, nil
+}
+
+// Applies the new configuration file, the previous one is restored if the
+// new one is invalid
+func reloadConfig(values map[string]string) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	previousValues := getConfigValues()
+	setConfigValues(values)
+	// The settings that are not reloaded must stay valid, too
+	err := validateConfig()
+	if err == nil {
+		err = prepareReloadableConfig()
+	}
+	if err != nil {
+		setConfigValues(previousValues)
+		if restoreErr := prepareReloadableConfig(); restoreErr != nil {
+			globalLogger.Error().Msgf("Cannot restore the previous configuration: %v", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Polls the configuration file, which works for ConfigMap mounts (they are
+// updated by swapping symlinks, which file watchers miss)
+func watchConfigFile(ctx context.Context, lastRaw []byte) {
+	path := strings.TrimSpace(os.Getenv("SENTRY_K8S_CONFIG_FILE"))
+	if path == "" {
+		return
+	}
+	interval, err := parseDurationSetting("SENTRY_K8S_CONFIG_RELOAD_INTERVAL", defaultConfigReloadInterval, minConfigReloadInterval)
+	if err != nil {
+		globalLogger.Warn().Msgf("%v, using %s", err, defaultConfigReloadInterval)
+		interval = defaultConfigReloadInterval
+	}
+
+	lastHash := sha256.Sum256(lastRaw)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			globalLogger.Error().Msgf("Cannot read the configuration file: %v", err)
+			continue
+		}
+		hash := sha256.Sum256(raw)
+		if hash == lastHash {
+			continue
+		}
+		lastHash = hash
+
+		values, err := parseConfigValues(path, raw)
+		if err != nil {
+			globalLogger.Error().Msgf("Cannot reload the configuration, keeping the current one: %v", err)
+			continue
+		}
+		if err := reloadConfig(values); err != nil {
+			globalLogger.Error().Msgf("Invalid configuration in %s, keeping the current one: %v", path, err)
+			continue
+		}
+		globalLogger.Info().Msgf("Reloaded the configuration file %s", path)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// test that the configuration file is mapped to the environment variables,
+// and that environment variables have priority
+func TestLoadConfigFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	raw := `
+logLevel: debug
+watchNamespaces: [default, payments]
+watchNodes: true
+filters:
+  outEventReasons: [DockerStart]
+  rules:
+    - name: ci-backoff
+      expression: namespace startsWith "ci-" && reason == "BackOff"
+podLogs:
+  tailLines: 20
+routes:
+  - namespaces: ["payments-*"]
+    dsn: https://key@example.com/1
+`
+	if err := os.WriteFile(path, []byte(raw), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SENTRY_K8S_CONFIG_FILE", path)
+	t.Setenv("SENTRY_K8S_LOG_LEVEL", "warn")
+	defer setConfigValues(map[string]string{})
+
+	if _, err := loadConfigFile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedValues := map[string]string{
+		"SENTRY_K8S_LOG_LEVEL":                "warn",
+		"SENTRY_K8S_WATCH_NAMESPACES":         "default,payments",
+		"SENTRY_K8S_WATCH_NODES":              "true",
+		"SENTRY_K8S_FILTER_OUT_EVENT_REASONS": "DockerStart",
+		"SENTRY_K8S_FILTER_RULES":             `[{"name":"ci-backoff","expression":"namespace startsWith \"ci-\" && reason == \"BackOff\""}]`,
+		"SENTRY_K8S_POD_LOGS_TAIL_LINES":      "20",
+		"SENTRY_K8S_ROUTES":                   `[{"namespaces":["payments-*"],"dsn":"https://key@example.com/1"}]`,
+		"SENTRY_K8S_WATCH_HISTORICAL":         "",
+	}
+	for name, expected := range expectedValues {
+		if value := getConfigValue(name); value != expected {
+			t.Errorf("received %s=%q, wanted %q", name, value, expected)
+		}
+	}
+
+	// The structured values are accepted by the parsers
+	rules, err := parseFilterRules(getConfigValue("SENTRY_K8S_FILTER_RULES"))
+	if err != nil || len(rules) != 1 {
+		t.Errorf("cannot parse the filter rules from the config file: %v", err)
+	}
+	parsedRoutes, err := parseRoutes(getConfigValue("SENTRY_K8S_ROUTES"))
+	if err != nil || len(parsedRoutes) != 1 {
+		t.Errorf("cannot parse the routes from the config file: %v", err)
+	}
+
+	invalidConfigs := []string{
+		"unknownField: 1",
+		"watchNodes: maybe",
+		"filters:\n  outEventReason: [DockerStart]",
+		"podLogs:\n  tailLines: twenty",
+	}
+	for _, invalidConfig := range invalidConfigs {
+		if _, err := parseConfig([]byte(invalidConfig)); err == nil {
+			t.Errorf("no error for invalid config %q", invalidConfig)
+		}
+	}
+}
+
+// test that an invalid configuration is rejected on reload, and the
+// previous one stays active
+func TestReloadConfig(t *testing.T) {
+
+	defer func() {
+		setConfigValues(map[string]string{})
+		if err := prepareReloadableConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := reloadConfig(map[string]string{"SENTRY_K8S_FILTER_RULES": `[{"expression": "reason == \"BackOff\""}]`}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(filterRules) != 1 {
+		t.Fatalf("received %d filter rules, wanted %d", len(filterRules), 1)
+	}
+
+	if err := reloadConfig(map[string]string{"SENTRY_K8S_FILTER_RULES": `[{"expression": "reason =="}]`}); err == nil {
+		t.Fatalf("no error for an invalid filter rule")
+	}
+	if len(filterRules) != 1 || getConfigValue("SENTRY_K8S_FILTER_RULES") == `[{"expression": "reason =="}]` {
+		t.Errorf("the previous configuration was not restored")
+	}
+}
+
+// test that invalid typed settings are rejected at startup, and that valid
+// ones are accepted
+func TestValidateConfig(t *testing.T) {
+
+	if err := validateConfig(); err != nil {
+		t.Fatalf("unexpected error for the defaults: %v", err)
+	}
+
+	invalidSettings := map[string]string{
+		"SENTRY_K8S_FLUSH_TIMEOUT":                  "10",
+		"SENTRY_K8S_CHECKPOINT_INTERVAL":            "0s",
+		"SENTRY_K8S_LEADER_ELECTION_LEASE_DURATION": "1s",
+		"SENTRY_K8S_CONFIG_RELOAD_INTERVAL":         "soon",
+		"SENTRY_K8S_POD_LOGS_TAIL_LINES":            "-1",
+		"SENTRY_K8S_POD_LOGS_LIMIT_BYTES":           "16KiB",
+		"SENTRY_K8S_NORMAL_EVENTS_MODE":             "breadcrumbs",
+		"SENTRY_K8S_WATCH_NODES":                    "ture",
+	}
+	for name, value := range invalidSettings {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if err := validateConfig(); err == nil {
+				t.Errorf("no error for %s=%q", name, value)
+			}
+		})
+	}
+
+	validSettings := map[string]string{
+		"SENTRY_K8S_FLUSH_TIMEOUT":       "0s",
+		"SENTRY_K8S_CHECKPOINT_INTERVAL": "30s",
+		"SENTRY_K8S_POD_LOGS_TAIL_LINES": "100",
+		"SENTRY_K8S_NORMAL_EVENTS_MODE":  "Breadcrumb",
+		"SENTRY_K8S_WATCH_NODES":         "false",
+	}
+	for name, value := range validSettings {
+		t.Setenv(name, value)
+	}
+	if err := validateConfig(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
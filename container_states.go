@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Containers that run this long are not crash-looping anymore, the kubelet
+// resets its restart back-off after the same time
+const containerStableAfter = 10 * time.Minute
+
+// The last observed state of a single container
+type trackedContainerState struct {
+	seen         bool
+	restartCount int32
+	// Waiting reasons seen since the container last ran successfully
+	waitingReasons map[string]bool
+	// The termination that last reset the waiting reasons
+	stableTerminationKey string
+	// The last known termination
+	lastFinishedAt     time.Time
+	lastTerminationKey string
+}
+
+// A container termination that should be reported
+type containerTermination struct {
+	state *v1.ContainerStateTerminated
+	// true if the container was already restarted after the termination
+	restarted bool
+	// Restarts that happened before this termination, but that were not
+	// observed by the agent (e.g. while it was not running)
+	missedRestarts int32
+}
+
+// Remembers the state of every container we've seen, so we only report
+// state transitions, and not every pod update.
+type containerStateTracker struct {
+	// When seeing a container for the first time, terminations that happened
+	// before this moment are not reported
+	since time.Time
+
+	mu sync.Mutex
+	// pod key -> container name -> state
+	pods map[string]map[string]*trackedContainerState
+}
+
+func newContainerStateTracker() *containerStateTracker {
+	return &containerStateTracker{
+		pods: make(map[string]map[string]*trackedContainerState),
+	}
+}
+
+var containerTracker = newContainerStateTracker()
+
+func prepareContainerTracker() {
+	// Same as for events: old terminations are only reported in historical mode
+	if !isTruthy(getConfigValue("SENTRY_K8S_WATCH_HISTORICAL")) {
+		containerTracker.since = time.Now()
+	}
+	globalLogger.Debug().Msgf("Prepared the container state tracker, reporting terminations since: %s", containerTracker.since)
+}
+
+// Forgets the containers of the namespace (all namespaces if empty), and
+// only reports the terminations since the given time for the containers seen
+// from now on. Used after taking over the leadership: the state recorded
+// during an earlier leadership is stale.
+func (t *containerStateTracker) restart(namespace string, since time.Time) {
+	t.mu.Lock()
+	if since.After(t.since) {
+		t.since = since
+	}
+	t.mu.Unlock()
+
+	if namespace == v1.NamespaceAll {
+		t.forgetAll()
+	} else {
+		t.forgetNamespace(namespace)
+	}
+}
+
+func getPodKey(pod *v1.Pod) string {
+	return fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, pod.UID)
+}
+
+// Must be called with the lock held
+func (t *containerStateTracker) getState(pod *v1.Pod, containerName string) *trackedContainerState {
+	podKey := getPodKey(pod)
+	containers, found := t.pods[podKey]
+	if !found {
+		containers = make(map[string]*trackedContainerState)
+		t.pods[podKey] = containers
+	}
+	state, found := containers[containerName]
+	if !found {
+		state = &trackedContainerState{}
+		containers[containerName] = state
+	}
+	return state
+}
+
+// Image pulls keep flipping between the two reasons while retrying
+func getWaitingReasonKey(reason string) string {
+	if reason == "ErrImagePull" {
+		return "ImagePullBackOff"
+	}
+	return reason
+}
+
+// Must be called with the lock held
+func (state *trackedContainerState) ranSuccessfully(containerStatus *v1.ContainerStatus, now time.Time) bool {
+	if running := containerStatus.State.Running; running != nil {
+		return containerStatus.Ready && now.Sub(running.StartedAt.Time) >= containerStableAfter
+	}
+	if terminated := containerStatus.State.Terminated; terminated != nil && terminated.ExitCode == 0 {
+		return true
+	}
+	// The container might have run for a long time between two pod updates
+	lastTermination := containerStatus.LastTerminationState.Terminated
+	if lastTermination == nil || lastTermination.FinishedAt.Sub(lastTermination.StartedAt.Time) < containerStableAfter {
+		return false
+	}
+	key := getTerminationKey(lastTermination)
+	if key == state.stableTerminationKey {
+		return false
+	}
+	state.stableTerminationKey = key
+	return true
+}
+
+// Records the current waiting reason of the container, returns true if the
+// container didn't wait for the same reason since it last ran successfully.
+// This way a crash-looping container is reported once, and not on every
+// restart.
+func (t *containerStateTracker) observeWaitingReason(pod *v1.Pod, containerStatus *v1.ContainerStatus) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.getState(pod, containerStatus.Name)
+	if state.ranSuccessfully(containerStatus, time.Now()) {
+		state.waitingReasons = nil
+	}
+
+	waiting := containerStatus.State.Waiting
+	if waiting == nil || waiting.Reason == "" {
+		return false
+	}
+	key := getWaitingReasonKey(waiting.Reason)
+	if state.waitingReasons[key] {
+		return false
+	}
+	if state.waitingReasons == nil {
+		state.waitingReasons = make(map[string]bool)
+	}
+	state.waitingReasons[key] = true
+	return true
+}
+
+func getTerminationKey(state *v1.ContainerStateTerminated) string {
+	return fmt.Sprintf("%s/%s/%d/%s", state.ContainerID, state.FinishedAt.UTC().Format(time.RFC3339), state.ExitCode, state.Reason)
+}
+
+// Must be called with the lock held
+func (state *trackedContainerState) isNewTermination(termination *v1.ContainerStateTerminated) bool {
+	if !termination.FinishedAt.IsZero() && !state.lastFinishedAt.IsZero() {
+		return termination.FinishedAt.Time.After(state.lastFinishedAt)
+	}
+	return getTerminationKey(termination) != state.lastTerminationKey
+}
+
+// Must be called with the lock held
+func (state *trackedContainerState) recordTermination(termination *v1.ContainerStateTerminated) {
+	if termination.FinishedAt.Time.After(state.lastFinishedAt) {
+		state.lastFinishedAt = termination.FinishedAt.Time
+	}
+	state.lastTerminationKey = getTerminationKey(termination)
+}
+
+// Records the terminations (both the current state and the last termination
+// state) and the restart count of the container, and returns the terminations
+// that were not seen before. Every termination is returned exactly once.
+func (t *containerStateTracker) observeTerminations(pod *v1.Pod, containerStatus *v1.ContainerStatus) []containerTermination {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.getState(pod, containerStatus.Name)
+	firstSeen := !state.seen
+	state.seen = true
+
+	restarts := containerStatus.RestartCount - state.restartCount
+	if firstSeen || restarts < 0 {
+		// We know nothing about the restarts before
+		restarts = 0
+	}
+	state.restartCount = containerStatus.RestartCount
+
+	terminations := []containerTermination{}
+
+	// From older to newer: the previous termination, then the current one
+	candidates := []containerTermination{}
+	if lastTermination := containerStatus.LastTerminationState.Terminated; lastTermination != nil {
+		candidates = append(candidates, containerTermination{state: lastTermination, restarted: true})
+	}
+	if currentTermination := containerStatus.State.Terminated; currentTermination != nil {
+		candidates = append(candidates, containerTermination{state: currentTermination})
+	}
+
+	for _, candidate := range candidates {
+		if !state.isNewTermination(candidate.state) {
+			continue
+		}
+		state.recordTermination(candidate.state)
+
+		finishedAt := candidate.state.FinishedAt
+		if firstSeen && !finishedAt.IsZero() && finishedAt.Time.Before(t.since) {
+			// Happened before we started watching
+			continue
+		}
+
+		if candidate.restarted && restarts > 1 {
+			// The restart count jumped: we only know the details of the last termination
+			candidate.missedRestarts = restarts - 1
+		}
+		terminations = append(terminations, candidate)
+	}
+
+	return terminations
+}
+
+func (t *containerStateTracker) forgetPod(pod *v1.Pod) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pods, getPodKey(pod))
+}
+
+func (t *containerStateTracker) forgetAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pods = make(map[string]map[string]*trackedContainerState)
+}
+
+// Drops the state of all pods in the namespace, e.g. when it's no longer watched
+func (t *containerStateTracker) forgetNamespace(namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prefix := namespace + "/"
+	for key := range t.pods {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.pods, key)
+		}
+	}
+}
@@ -9,18 +9,58 @@ import (
 
 type clientsetCtxKey struct{}
 
-func setClientsetOnContext(ctx context.Context, clientset *kubernetes.Clientset) context.Context {
+func setClientsetOnContext(ctx context.Context, clientset kubernetes.Interface) context.Context {
 	return context.WithValue(ctx, clientsetCtxKey{}, clientset)
 }
 
-func getClientsetFromContext(ctx context.Context) (*kubernetes.Clientset, error) {
+func getClientsetFromContext(ctx context.Context) (kubernetes.Interface, error) {
 	val := ctx.Value(clientsetCtxKey{})
 	if val == nil {
 		return nil, fmt.Errorf("no clientset present on context")
 	}
-	if clientset, ok := val.(*kubernetes.Clientset); ok {
+	if clientset, ok := val.(kubernetes.Interface); ok {
 		return clientset, nil
 	} else {
 		return nil, fmt.Errorf("cannot convert clientset value from context")
 	}
 }
+
+type listersCtxKey struct{}
+
+func setListersOnContext(ctx context.Context, listers *objectListers) context.Context {
+	return context.WithValue(ctx, listersCtxKey{}, listers)
+}
+
+// Returns nil if no listers are available (e.g. the informers are not running)
+func getListersFromContext(ctx context.Context) *objectListers {
+	val := ctx.Value(listersCtxKey{})
+	if val == nil {
+		return nil
+	}
+	listers, _ := val.(*objectListers)
+	return listers
+}
+
+type sentryAPIClientCtxKey struct{}
+
+func setSentryAPIClientOnContext(ctx context.Context, client *sentryAPIClient) context.Context {
+	return context.WithValue(ctx, sentryAPIClientCtxKey{}, client)
+}
+
+// Returns nil if the Sentry API is not configured
+func getSentryAPIClientFromContext(ctx context.Context) *sentryAPIClient {
+	client, _ := ctx.Value(sentryAPIClientCtxKey{}).(*sentryAPIClient)
+	return client
+}
+
+type namespaceWatchersCtxKey struct{}
+
+func setNamespaceWatchersOnContext(ctx context.Context, watchers *namespaceWatchers) context.Context {
+	return context.WithValue(ctx, namespaceWatchersCtxKey{}, watchers)
+}
+
+// Returns nil if the namespace selection is static
+func getNamespaceWatchersFromContext(ctx context.Context) *namespaceWatchers {
+	watchers, _ := ctx.Value(namespaceWatchersCtxKey{}).(*namespaceWatchers)
+	return watchers
+}
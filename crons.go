@@ -10,9 +10,6 @@ import (
 	"github.com/rs/zerolog"
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/informers"
-	"k8s.io/client-go/tools/cache"
 )
 
 type EventHandlerType string
@@ -23,80 +20,62 @@ const (
 	EventHandlerDelete EventHandlerType = "DELETE"
 )
 
-// Starts the crons informer which has event handlers
-// adds to the crons monitor data struct used for sending
-// checkin events to Sentry
-func startCronsInformers(ctx context.Context, namespace string) error {
-
-	clientset, err := getClientsetFromContext(ctx)
-	if err != nil {
-		return errors.New("failed to get clientset")
-	}
-
-	// create factory that will produce both the cronjob informer and job informer
-	factory := informers.NewSharedInformerFactoryWithOptions(
-		clientset,
-		5*time.Second,
-		informers.WithNamespace(namespace),
-	)
-
-	// create the cronjob informer
-	cronjobInformer, err := createCronjobInformer(ctx, factory, namespace)
-	if err != nil {
-		return err
-	}
-	// create the job informer
-	jobInformer, err := createJobInformer(ctx, factory, namespace)
-	if err != nil {
-		return err
-	}
-
-	// channel to tell the factory to stop the informers
-	doneChan := make(chan struct{})
-	factory.Start(doneChan)
-
-	// sync the cronjob informer cache
-	if ok := cache.WaitForCacheSync(doneChan, cronjobInformer.HasSynced); !ok {
-		return errors.New("cronjob informer failed to sync")
-	}
-	// sync the job informer cache
-	if ok := cache.WaitForCacheSync(doneChan, jobInformer.HasSynced); !ok {
-		return errors.New("job informer failed to sync")
-	}
-
-	// wait for the channel to be closed
-	<-doneChan
-
-	return nil
+// CronJobs are identified by namespace and name, the same name can be used in
+// several namespaces
+func getCronsMonitorDataKey(namespace string, name string) string {
+	return namespace + "/" + name
 }
 
-// Starts the jobs informer with event handlers that trigger
-// checkin events during the start and end of a job (along with the exit status)
-func runSentryCronsCheckin(ctx context.Context, job *batchv1.Job, eventHandlerType EventHandlerType) error {
-
+// Returns the data of the CronJob that owns the job
+// Must be called with cronsDataLock held
+func getCronsMonitorData(ctx context.Context, job *batchv1.Job) (CronsMonitorData, error) {
 	// Query the crons informer data
 	val := ctx.Value(CronsInformerDataKey{})
 	if val == nil {
-		return errors.New("no crons informer data struct given")
+		return CronsMonitorData{}, errors.New("no crons informer data struct given")
 	}
 	var cronsInformerData *map[string]CronsMonitorData
 	var ok bool
 	if cronsInformerData, ok = val.(*map[string]CronsMonitorData); !ok {
-		return errors.New("cannot convert cronsInformerData value from context")
+		return CronsMonitorData{}, errors.New("cannot convert cronsInformerData value from context")
 	}
 
 	// Try to find the cronJob name that owns the job
 	// in order to get the crons monitor data
 	if len(job.OwnerReferences) == 0 {
-		return errors.New("job does not have cronjob reference")
+		return CronsMonitorData{}, errors.New("job does not have cronjob reference")
 	}
 	cronjobRef := job.OwnerReferences[0]
 	if !*cronjobRef.Controller || cronjobRef.Kind != "CronJob" {
-		return errors.New("job does not have cronjob reference")
+		return CronsMonitorData{}, errors.New("job does not have cronjob reference")
 	}
-	cronsMonitorData, ok := (*cronsInformerData)[cronjobRef.Name]
+	cronsMonitorData, ok := (*cronsInformerData)[getCronsMonitorDataKey(job.Namespace, cronjobRef.Name)]
 	if !ok {
-		return errors.New("cannot find cronJob data")
+		return CronsMonitorData{}, errors.New("cannot find cronJob data")
+	}
+	return cronsMonitorData, nil
+}
+
+// Starts the jobs informer with event handlers that trigger
+// checkin events during the start and end of a job (along with the exit status)
+func runSentryCronsCheckin(ctx context.Context, job *batchv1.Job, eventHandlerType EventHandlerType) error {
+	if !inFlightEvents.start() {
+		return nil
+	}
+	defer inFlightEvents.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+	cronsDataLock.Lock()
+	defer cronsDataLock.Unlock()
+
+	cronsMonitorData, err := getCronsMonitorData(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	// Followers don't record the jobs, the new leader replays them
+	if !isLeader() {
+		return nil
 	}
 
 	// capture checkin event called for by informer handler
@@ -105,12 +84,49 @@ func runSentryCronsCheckin(ctx context.Context, job *batchv1.Job, eventHandlerTy
 		checkinJobStarting(ctx, job, cronsMonitorData)
 	} else if eventHandlerType == EventHandlerUpdate || eventHandlerType == EventHandlerDelete {
 		// Delete pod from the cronJob informer data
-		checkinJobEnding(ctx, job, cronsMonitorData)
+		checkinJobEnding(ctx, job, cronsMonitorData, eventHandlerType == EventHandlerDelete)
+	}
+	// Deleted jobs are never seen again, e.g. the ones removed by the history
+	// limits of the CronJob
+	if eventHandlerType == EventHandlerDelete {
+		cronsMonitorData.removeJob(job)
 	}
 
 	return nil
 }
 
+// Checks in the jobs that started or finished since the given time, when the
+// previous leader might not have reported them anymore
+func replayCronsCheckins(ctx context.Context, jobs []*batchv1.Job, since time.Time) {
+	if !inFlightEvents.start() {
+		return
+	}
+	defer inFlightEvents.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+	cronsDataLock.Lock()
+	defer cronsDataLock.Unlock()
+
+	for _, job := range jobs {
+		cronsMonitorData, err := getCronsMonitorData(ctx, job)
+		if err != nil {
+			continue
+		}
+		if isJobFinished(job) {
+			if getJobFinishTime(job).Before(since) {
+				cronsMonitorData.addJob(job, true)
+			} else {
+				checkinJobEnding(ctx, job, cronsMonitorData, false)
+			}
+		} else if getJobStartTime(job).Before(since) {
+			// The start was checked in by the previous leader
+			cronsMonitorData.addJob(job, false)
+		} else {
+			checkinJobStarting(ctx, job, cronsMonitorData)
+		}
+	}
+}
+
 // sends the checkin event to sentry crons for when a job starts
 func checkinJobStarting(ctx context.Context, job *batchv1.Job, cronsMonitorData CronsMonitorData) error {
 
@@ -121,27 +137,42 @@ func checkinJobStarting(ctx context.Context, job *batchv1.Job, cronsMonitorData
 	if ok {
 		return nil
 	}
+
+	// Finished jobs are seen when the agent starts, they were either reported
+	// before, or finished while the agent was not running
+	if isJobFinished(job) {
+		logger.Debug().Msgf("Skipping a finished job: %s\n", job.Name)
+		cronsMonitorData.addJob(job, true)
+		return nil
+	}
 	logger.Debug().Msgf("Checking in at start of job: %s\n", job.Name)
 
 	// All containers running in the pod
-	checkinId := sentry.CaptureCheckIn(
+	captureRoutedCheckIn(
+		ctx,
+		newRoutingTargetForObject(job),
 		&sentry.CheckIn{
+			ID:          getJobCheckinId(job),
 			MonitorSlug: cronsMonitorData.MonitorSlug,
 			Status:      sentry.CheckInStatusInProgress,
 		},
 		cronsMonitorData.monitorConfig,
 	)
-	cronsMonitorData.addJob(job, *checkinId)
+	cronsMonitorData.addJob(job, false)
 
 	return nil
 }
 
 // sends the checkin event to sentry crons for when a job ends
-func checkinJobEnding(ctx context.Context, job *batchv1.Job, cronsMonitorData CronsMonitorData) error {
+func checkinJobEnding(ctx context.Context, job *batchv1.Job, cronsMonitorData CronsMonitorData, deleted bool) error {
 
 	logger := zerolog.Ctx(ctx)
 	// do not check in to exit if there are still active pods
-	if job.Status.Active > 0 {
+	if job.Status.Active > 0 && !deleted {
+		return nil
+	}
+	// Jobs without active pods can be waiting for new pods (e.g. retries)
+	if !isJobFinished(job) && !deleted {
 		return nil
 	}
 
@@ -153,28 +184,31 @@ func checkinJobEnding(ctx context.Context, job *batchv1.Job, cronsMonitorData Cr
 		jobStatus = sentry.CheckInStatusError
 	}
 
-	// Get job data to retrieve the checkin ID
-	jobData, ok := cronsMonitorData.JobDatas[job.Name]
-	if !ok {
+	// Jobs that were started before the agent (or while this replica was not
+	// the leader) are checked in as well, the ID is the same
+	if jobData, ok := cronsMonitorData.JobDatas[job.Name]; ok && jobData.Finished {
 		return nil
 	}
 
 	logger.Trace().Msgf("checking in at end of job: %s\n", job.Name)
-	sentry.CaptureCheckIn(
+	captureRoutedCheckIn(
+		ctx,
+		newRoutingTargetForObject(job),
 		&sentry.CheckIn{
-			ID:          jobData.getCheckinId(),
+			ID:          getJobCheckinId(job),
 			MonitorSlug: cronsMonitorData.MonitorSlug,
 			Status:      jobStatus,
 		},
 		cronsMonitorData.monitorConfig,
 	)
+	cronsMonitorData.addJob(job, true)
 	return nil
 }
 
 // adds to the sentry events whenever it is associated with a cronjob
 // so the sentry event contains the corresponding slug monitor, cronjob name, timestamp of when the cronjob began, and
 // the k8s cronjob metadata
-func runCronsDataHandler(ctx context.Context, scope *sentry.Scope, pod *v1.Pod, sentryEvent *sentry.Event) (bool, error) {
+func runCronsDataHandler(ctx context.Context, scope *sentry.Scope, pod *v1.Pod) (bool, error) {
 
 	// get owningCronJob if exists
 	owningCronJob, err := getOwningCronJob(ctx, pod)
@@ -191,8 +225,6 @@ func runCronsDataHandler(ctx context.Context, scope *sentry.Scope, pod *v1.Pod,
 		"Slug": owningCronJob.Name,
 	})
 
-	sentryEvent.Fingerprint = append(sentryEvent.Fingerprint, owningCronJob.Kind, owningCronJob.Name)
-
 	setTagIfNotEmpty(scope, "cronjob_name", owningCronJob.Name)
 
 	// add breadcrumb with cronJob timestamps
@@ -219,11 +251,6 @@ func runCronsDataHandler(ctx context.Context, scope *sentry.Scope, pod *v1.Pod,
 // but returns nil is no cronjob is found
 func getOwningCronJob(ctx context.Context, pod *v1.Pod) (*batchv1.CronJob, error) {
 
-	clientset, err := getClientsetFromContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-
 	namespace := pod.Namespace
 
 	// first attempt to group events by cronJobs
@@ -236,7 +263,7 @@ func getOwningCronJob(ctx context.Context, pod *v1.Pod) (*batchv1.CronJob, error
 			continue
 		}
 		// find the owning job
-		owningJob, err := clientset.BatchV1().Jobs(namespace).Get(context.Background(), podRef.Name, metav1.GetOptions{})
+		owningJob, err := getJob(ctx, namespace, podRef.Name)
 		if err != nil {
 			continue
 		}
@@ -245,7 +272,7 @@ func getOwningCronJob(ctx context.Context, pod *v1.Pod) (*batchv1.CronJob, error
 			if !*jobRef.Controller || jobRef.Kind != "CronJob" {
 				continue
 			}
-			owningCronJob, err = clientset.BatchV1().CronJobs(namespace).Get(context.Background(), jobRef.Name, metav1.GetOptions{})
+			owningCronJob, err = getCronJob(ctx, namespace, jobRef.Name)
 			if err != nil {
 				continue
 			}
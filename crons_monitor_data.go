@@ -1,21 +1,34 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
 	"github.com/getsentry/sentry-go"
 	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
 )
 
 type CronsInformerDataKey struct{}
 
+// Guards the crons informer data, which is shared by the CronJob and Job
+// informers
+var cronsDataLock sync.Mutex
+
 // Struct associated with a job
 type CronsJobData struct {
 	CheckinId sentry.EventID
+	// true if the final check-in was sent
+	Finished bool
 }
 
 // Constructor for cronsMonitorData
-func NewCronsJobData(checkinId sentry.EventID) *CronsJobData {
+func NewCronsJobData(checkinId sentry.EventID, finished bool) *CronsJobData {
 	return &CronsJobData{
 		CheckinId: checkinId,
+		Finished:  finished,
 	}
 }
 
@@ -56,7 +69,46 @@ func NewCronsMonitorData(monitorSlug string, schedule string, maxRunTime int64,
 }
 
 // Add a job to the crons monitor
-func (c *CronsMonitorData) addJob(job *batchv1.Job, checkinId sentry.EventID) error {
-	c.JobDatas[job.Name] = NewCronsJobData(checkinId)
+func (c *CronsMonitorData) addJob(job *batchv1.Job, finished bool) error {
+	c.JobDatas[job.Name] = NewCronsJobData(getJobCheckinId(job), finished)
 	return nil
 }
+
+func (c *CronsMonitorData) removeJob(job *batchv1.Job) {
+	delete(c.JobDatas, job.Name)
+}
+
+// The check-in ID is derived from the job UID, so the final check-in of a job
+// matches its "in_progress" check-in even if it is sent after a restart of
+// the agent, or by another replica
+func getJobCheckinId(job *batchv1.Job) sentry.EventID {
+	hash := sha256.Sum256([]byte(job.UID))
+	return sentry.EventID(hex.EncodeToString(hash[:16]))
+}
+
+// true if the job completed or failed
+func isJobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// The time the job completed or failed, zero if it's still running
+func getJobFinishTime(job *batchv1.Job) time.Time {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == v1.ConditionTrue {
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+func getJobStartTime(job *batchv1.Job) time.Time {
+	if job.Status.StartTime != nil {
+		return job.Status.StartTime.Time
+	}
+	return job.CreationTimestamp.Time
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// test that the check-ins of a job share the ID derived from the job, also
+// after a restart, and that finished jobs are not checked in on startup
+func TestRunSentryCronsCheckin(t *testing.T) {
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isController := true
+	newJob := func(name string, active int32, conditions ...batchv1.JobCondition) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "TestRunSentryCronsCheckinNamespace",
+				UID:       types.UID("TestRunSentryCronsCheckinUID-" + name),
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "CronJob", Name: "backup", Controller: &isController},
+				},
+			},
+			Status: batchv1.JobStatus{Active: active, Succeeded: 1 - active, Conditions: conditions},
+		}
+	}
+	complete := batchv1.JobCondition{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}
+
+	newCtx := func() context.Context {
+		cronsInformerData := map[string]CronsMonitorData{
+			"TestRunSentryCronsCheckinNamespace/backup": *NewCronsMonitorData("backup", "0 * * * *", 5, 3, nil),
+			// A CronJob with the same name in another namespace
+			"TestRunSentryCronsCheckinOtherNamespace/backup": *NewCronsMonitorData("backup", "30 * * * *", 5, 3, nil),
+		}
+		ctx := context.WithValue(context.Background(), CronsInformerDataKey{}, &cronsInformerData)
+		return sentry.SetHubOnContext(ctx, sentry.NewHub(client, sentry.NewScope()))
+	}
+
+	ctx := newCtx()
+	runningJob := newJob("backup-1", 1)
+	if err := runSentryCronsCheckin(ctx, runningJob, EventHandlerAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Seen on startup, already finished
+	if err := runSentryCronsCheckin(ctx, newJob("backup-0", 0, complete), EventHandlerAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The agent is restarted while the job is running
+	ctx = newCtx()
+	if err := runSentryCronsCheckin(ctx, newJob("backup-1", 0, complete), EventHandlerUpdate); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Deletion of a finished job
+	if err := runSentryCronsCheckin(ctx, newJob("backup-1", 0, complete), EventHandlerDelete); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Deleted jobs are forgotten
+	cronsInformerData := ctx.Value(CronsInformerDataKey{}).(*map[string]CronsMonitorData)
+	if jobDatas := (*cronsInformerData)["TestRunSentryCronsCheckinNamespace/backup"].JobDatas; len(jobDatas) != 0 {
+		t.Errorf("%d deleted jobs are still tracked", len(jobDatas))
+	}
+
+	events := transport.Events()
+	if len(events) != 2 {
+		t.Fatalf("received %d check-ins, wanted %d", len(events), 2)
+	}
+	expectedStatuses := []sentry.CheckInStatus{sentry.CheckInStatusInProgress, sentry.CheckInStatusOK}
+	for i, event := range events {
+		if event.CheckIn == nil {
+			t.Fatalf("event %d is not a check-in", i)
+		}
+		if event.CheckIn.ID != getJobCheckinId(runningJob) {
+			t.Errorf("check-in %d has ID %q, wanted %q", i, event.CheckIn.ID, getJobCheckinId(runningJob))
+		}
+		if event.CheckIn.Status != expectedStatuses[i] {
+			t.Errorf("check-in %d has status %q, wanted %q", i, event.CheckIn.Status, expectedStatuses[i])
+		}
+	}
+	// The CronJob of the job's namespace is used
+	if schedule := events[0].MonitorConfig.Schedule; schedule != sentry.CrontabSchedule("0 * * * *") {
+		t.Errorf("check-in has schedule %v, wanted the schedule of the CronJob in the job's namespace", schedule)
+	}
+}
+
+// test that the new leader checks in the jobs that started or finished while
+// there was no leader, and only those
+func TestReplayCronsCheckins(t *testing.T) {
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cronsInformerData := map[string]CronsMonitorData{
+		"TestReplayCronsCheckinsNamespace/backup": *NewCronsMonitorData("backup", "0 * * * *", 5, 3, nil),
+	}
+	ctx := context.WithValue(context.Background(), CronsInformerDataKey{}, &cronsInformerData)
+	ctx = sentry.SetHubOnContext(ctx, sentry.NewHub(client, sentry.NewScope()))
+
+	since := time.Date(2023, time.November, 15, 1, 0, 0, 0, time.UTC)
+	isController := true
+	newJob := func(name string, startedAt time.Time, finishedAt time.Time) *batchv1.Job {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "TestReplayCronsCheckinsNamespace",
+				UID:       types.UID("TestReplayCronsCheckinsUID-" + name),
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "CronJob", Name: "backup", Controller: &isController},
+				},
+			},
+			Status: batchv1.JobStatus{StartTime: &metav1.Time{Time: startedAt}, Active: 1},
+		}
+		if !finishedAt.IsZero() {
+			job.Status.Active = 0
+			job.Status.Succeeded = 1
+			job.Status.Conditions = []batchv1.JobCondition{{
+				Type:               batchv1.JobComplete,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: metav1.Time{Time: finishedAt},
+			}}
+		}
+		return job
+	}
+
+	reportedStart := newJob("backup-3", since.Add(time.Second), time.Time{})
+	reportedEnd := newJob("backup-2", since.Add(-time.Hour), since.Add(time.Second))
+	replayCronsCheckins(ctx, []*batchv1.Job{
+		newJob("backup-0", since.Add(-2*time.Hour), since.Add(-time.Hour)),
+		newJob("backup-1", since.Add(-time.Hour), time.Time{}),
+		reportedEnd,
+		reportedStart,
+	}, since)
+
+	// The jobs are known now
+	if err := runSentryCronsCheckin(ctx, reportedEnd, EventHandlerUpdate); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	events := transport.Events()
+	if len(events) != 2 {
+		t.Fatalf("received %d check-ins, wanted %d", len(events), 2)
+	}
+	expected := []struct {
+		job    *batchv1.Job
+		status sentry.CheckInStatus
+	}{
+		{reportedEnd, sentry.CheckInStatusOK},
+		{reportedStart, sentry.CheckInStatusInProgress},
+	}
+	for i, event := range events {
+		if event.CheckIn == nil {
+			t.Fatalf("event %d is not a check-in", i)
+		}
+		if event.CheckIn.ID != getJobCheckinId(expected[i].job) || event.CheckIn.Status != expected[i].status {
+			t.Errorf("check-in %d is %q/%q, wanted %q/%q", i, event.CheckIn.ID, event.CheckIn.Status, getJobCheckinId(expected[i].job), expected[i].status)
+		}
+	}
+}
@@ -3,28 +3,171 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/getsentry/sentry-go"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
+// Enhancer adds data about the involved object to the Sentry event.
+// cachedObject is the involved object itself if it's already available
+// (e.g. the pod from the pods watcher), and nil otherwise.
+type Enhancer interface {
+	Enhance(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error
+}
+
+// EnhancerFunc allows using ordinary functions as enhancers
+type EnhancerFunc func(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error
+
+func (f EnhancerFunc) Enhance(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+	return f(ctx, objectRef, cachedObject, scope, sentryEvent)
+}
+
+// Enhancers run in the ascending order; enhancers with the same order run
+// in the order of registration
+const (
+	EnhancerOrderCommon = 0
+	EnhancerOrderKind   = 100
+	EnhancerOrderCustom = 200
+	// The sentry.io/* annotations of the objects, after all other enhancers
+	EnhancerOrderOverrides = 1000
+)
+
+type registeredEnhancer struct {
+	name     string
+	gvk      schema.GroupVersionKind
+	order    int
+	enhancer Enhancer
+}
+
+type enhancerRegistry struct {
+	mu        sync.RWMutex
+	enhancers []*registeredEnhancer
+}
+
+var defaultEnhancerRegistry = &enhancerRegistry{}
+
+// Matching rules:
+// - an empty Kind matches objects of all kinds
+// - an empty Version matches all versions of the group
+// - objects without an API version are matched by Kind only
+func (r *registeredEnhancer) matches(gvk schema.GroupVersionKind) bool {
+	if r.gvk.Kind == "" {
+		return true
+	}
+	if r.gvk.Kind != gvk.Kind {
+		return false
+	}
+	if gvk.Group == "" && gvk.Version == "" {
+		return true
+	}
+	if r.gvk.Group != gvk.Group {
+		return false
+	}
+	return r.gvk.Version == "" || r.gvk.Version == gvk.Version
+}
+
+func (r *enhancerRegistry) register(name string, gvk schema.GroupVersionKind, order int, enhancer Enhancer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.enhancers = append(r.enhancers, &registeredEnhancer{
+		name:     name,
+		gvk:      gvk,
+		order:    order,
+		enhancer: enhancer,
+	})
+	sort.SliceStable(r.enhancers, func(i, j int) bool {
+		return r.enhancers[i].order < r.enhancers[j].order
+	})
+}
+
+// Returns the enhancers for the given object kind, in the execution order
+func (r *enhancerRegistry) getEnhancers(gvk schema.GroupVersionKind) []*registeredEnhancer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	matched := []*registeredEnhancer{}
+	for _, enhancer := range r.enhancers {
+		if enhancer.matches(gvk) {
+			matched = append(matched, enhancer)
+		}
+	}
+	return matched
+}
+
+// RegisterEnhancer adds an enhancer for objects of the given kind. Custom
+// enhancers are usually registered from init() in a separate file.
+func RegisterEnhancer(name string, gvk schema.GroupVersionKind, order int, enhancer Enhancer) {
+	defaultEnhancerRegistry.register(name, gvk, order, enhancer)
+}
+
+func init() {
+	RegisterEnhancer(
+		"common",
+		schema.GroupVersionKind{},
+		EnhancerOrderCommon,
+		EnhancerFunc(func(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+			return runCommonEnhancer(ctx, scope, sentryEvent)
+		}),
+	)
+	RegisterEnhancer(
+		"pod",
+		v1.SchemeGroupVersion.WithKind("Pod"),
+		EnhancerOrderKind,
+		EnhancerFunc(runPodEnhancer),
+	)
+	RegisterEnhancer(
+		"node",
+		v1.SchemeGroupVersion.WithKind("Node"),
+		EnhancerOrderKind,
+		EnhancerFunc(runNodeEnhancer),
+	)
+	for _, kind := range []string{"Deployment", "StatefulSet", "DaemonSet"} {
+		RegisterEnhancer(
+			"workload",
+			appsv1.SchemeGroupVersion.WithKind(kind),
+			EnhancerOrderKind,
+			EnhancerFunc(runWorkloadEnhancer),
+		)
+	}
+	// Run after the kind-specific enhancers, and for all kinds.
+	// Explicit mapping rules have priority over tracked releases.
+	RegisterEnhancer(
+		"release-mapping",
+		schema.GroupVersionKind{},
+		EnhancerOrderKind+50,
+		EnhancerFunc(runReleaseMappingEnhancer),
+	)
+	RegisterEnhancer(
+		"release",
+		schema.GroupVersionKind{},
+		EnhancerOrderKind+50,
+		EnhancerFunc(runReleaseEnhancer),
+	)
+	// The sentry.io/* annotations override what the other enhancers set,
+	// including the custom ones
+	RegisterEnhancer(
+		"overrides",
+		schema.GroupVersionKind{},
+		EnhancerOrderOverrides,
+		EnhancerFunc(runOverridesEnhancer),
+	)
+}
+
 func runEnhancers(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) {
 	involvedObject := fmt.Sprintf("%s/%s", objectRef.Kind, objectRef.Name)
 	ctx, logger := getLoggerWithTag(ctx, "object", involvedObject)
 
-	var err error
 	logger.Debug().Msgf("Running enhancers...")
 
-	// First, run the basic (common) enhancer
-	runCommonEnhancer(ctx, scope, sentryEvent)
-
-	// Then, run kind-specific enhancers
-	switch objectRef.Kind {
-	case "Pod":
-		err = runPodEnhancer(ctx, objectRef, cachedObject, scope, sentryEvent)
-	}
-
-	if err != nil {
-		logger.Error().Msgf("Error running an enhancer: %v", err)
+	// The common enhancer goes first, then the kind-specific ones
+	for _, enhancer := range defaultEnhancerRegistry.getEnhancers(objectRef.GroupVersionKind()) {
+		if err := enhancer.enhancer.Enhance(ctx, objectRef, cachedObject, scope, sentryEvent); err != nil {
+			logger.Error().Msgf("Error running the %s enhancer: %v", enhancer.name, err)
+		}
 	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Conditions that mean that the node is under pressure when they're "True"
+var nodePressureConditions = []v1.NodeConditionType{
+	v1.NodeMemoryPressure,
+	v1.NodeDiskPressure,
+	v1.NodePIDPressure,
+	v1.NodeNetworkUnavailable,
+}
+
+// Unique IDs in node messages, e.g. "Node foo has been rebooted, boot id: <uuid>"
+var nodeMessageIdRegex = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,}`)
+
+// Returns the value of the first label that is set
+func getFirstLabel(labels map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Comma-separated pressure conditions that are currently active
+func getNodePressure(node *v1.Node) string {
+	pressure := []string{}
+	for _, condition := range node.Status.Conditions {
+		for _, conditionType := range nodePressureConditions {
+			if condition.Type == conditionType && condition.Status == v1.ConditionTrue {
+				pressure = append(pressure, string(condition.Type))
+			}
+		}
+	}
+	return strings.Join(pressure, ",")
+}
+
+func getNodeConditionStatus(node *v1.Node, conditionType v1.NodeConditionType) v1.ConditionStatus {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status
+		}
+	}
+	return v1.ConditionUnknown
+}
+
+func setNodeTags(scope *sentry.Scope, node *v1.Node) {
+	labels := node.Labels
+	setTagIfNotEmpty(scope, "node_name", node.Name)
+	setTagIfNotEmpty(scope, "node_instance_type", getFirstLabel(labels, v1.LabelInstanceTypeStable, v1.LabelInstanceType))
+	setTagIfNotEmpty(scope, "node_zone", getFirstLabel(labels, v1.LabelTopologyZone, v1.LabelFailureDomainBetaZone))
+	setTagIfNotEmpty(scope, "node_region", getFirstLabel(labels, v1.LabelTopologyRegion, v1.LabelFailureDomainBetaRegion))
+	setTagIfNotEmpty(scope, "node_ready", string(getNodeConditionStatus(node, v1.NodeReady)))
+	setTagIfNotEmpty(scope, "node_pressure", getNodePressure(node))
+	setTagIfNotEmpty(scope, "kubelet_version", node.Status.NodeInfo.KubeletVersion)
+	setTagIfNotEmpty(scope, "container_runtime", node.Status.NodeInfo.ContainerRuntimeVersion)
+}
+
+func setNodeContexts(scope *sentry.Scope, node *v1.Node) {
+	nodeInfo := node.Status.NodeInfo
+	scope.SetContext("Node", sentry.Context{
+		"Kubelet version":   nodeInfo.KubeletVersion,
+		"Container runtime": nodeInfo.ContainerRuntimeVersion,
+		"Kernel version":    nodeInfo.KernelVersion,
+		"OS image":          nodeInfo.OSImage,
+		"Architecture":      nodeInfo.Architecture,
+		"Unschedulable":     node.Spec.Unschedulable,
+		"Created at":        node.CreationTimestamp.String(),
+	})
+
+	conditions := sentry.Context{}
+	for _, condition := range node.Status.Conditions {
+		value := string(condition.Status)
+		if condition.Reason != "" {
+			value = fmt.Sprintf("%s (%s)", value, condition.Reason)
+		}
+		if condition.Message != "" {
+			value = fmt.Sprintf("%s: %s", value, condition.Message)
+		}
+		conditions[string(condition.Type)] = value
+	}
+	scope.SetContext("Node Conditions", conditions)
+
+	// "allocatable / capacity" for every resource
+	resources := sentry.Context{}
+	for name, capacity := range node.Status.Capacity {
+		allocatable, found := node.Status.Allocatable[name]
+		if !found {
+			resources[string(name)] = fmt.Sprintf("- / %s", capacity.String())
+			continue
+		}
+		resources[string(name)] = fmt.Sprintf("%s / %s", allocatable.String(), capacity.String())
+	}
+	scope.SetContext("Node Resources (allocatable / capacity)", resources)
+
+	if len(node.Spec.Taints) > 0 {
+		taints := make([]string, 0, len(node.Spec.Taints))
+		for _, taint := range node.Spec.Taints {
+			taints = append(taints, taint.ToString())
+		}
+		sort.Strings(taints)
+		scope.SetContext("Node Taints", sentry.Context{
+			"Taints": taints,
+		})
+	}
+}
+
+// Node messages contain the node name and sometimes unique IDs, which would
+// create a separate issue for every occurrence
+func getNodeFingerprintMessage(message string, nodeName string) string {
+	message = strings.ReplaceAll(message, nodeName, "<node>")
+	return nodeMessageIdRegex.ReplaceAllString(message, "<id>")
+}
+
+func runNodeEnhancer(ctx context.Context, nodeMeta *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+	logger := zerolog.Ctx(ctx)
+
+	logger.Debug().Msgf("Running the node enhancer")
+
+	nodeName := nodeMeta.Name
+
+	cachedNode, _ := cachedObject.(*v1.Node)
+	if cachedNode == nil {
+		logger.Debug().Msgf("Fetching node data")
+		var err error
+		cachedNode, err = getNode(ctx, nodeName)
+		if err != nil {
+			return err
+		}
+	} else {
+		logger.Debug().Msgf("Reusing the available node object")
+	}
+	// The node might come from the informer cache, so don't modify it
+	node := cachedNode.DeepCopy()
+
+	setNodeTags(scope, node)
+	setNodeContexts(scope, node)
+
+	// Group by the node, so events of a flapping node end up in one issue.
+	// If there's already a non-empty fingerprint set, we assume that it was
+	// set by another enhancer, so we only add the node to it.
+	if len(sentryEvent.Fingerprint) == 0 {
+		sentryEvent.Fingerprint = []string{getNodeFingerprintMessage(sentryEvent.Message, nodeName)}
+	}
+	sentryEvent.Fingerprint = append(sentryEvent.Fingerprint, "Node", nodeName)
+
+	logger.Trace().Msgf("Fingerprint after adjustment: %v", sentryEvent.Fingerprint)
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// test that the node enhancer adds the node tags, and that reboots
+// of the same node are grouped together regardless of the boot ID
+func TestRunNodeEnhancer(t *testing.T) {
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "TestRunNodeEnhancerNode",
+			Labels: map[string]string{
+				corev1.LabelInstanceTypeStable: "m5.large",
+				corev1.LabelTopologyZone:       "eu-west-1a",
+			},
+		},
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule}},
+		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionTrue},
+				{Type: corev1.NodeDiskPressure, Status: corev1.ConditionFalse},
+			},
+			Capacity:    corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")},
+			Allocatable: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("7Gi")},
+			NodeInfo:    corev1.NodeSystemInfo{KubeletVersion: "v1.27.3"},
+		},
+	}
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(node))
+	objectRef := &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: node.Name}
+
+	fingerprints := [][]string{}
+	for _, bootId := range []string{"3c1d8a4e-0b8f-4f5e-9a51-1e0f3c0b7a11", "f0e4c2b1-7d3a-4c1e-8b2f-5a6d7e8f9a00"} {
+		scope := sentry.NewScope()
+		sentryEvent := &sentry.Event{Message: "Node TestRunNodeEnhancerNode has been rebooted, boot id: " + bootId}
+		if err := runNodeEnhancer(ctx, objectRef, nil, scope, sentryEvent); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fingerprints = append(fingerprints, sentryEvent.Fingerprint)
+
+		sentryEvent = scope.ApplyToEvent(sentryEvent, nil)
+		expectedTags := map[string]string{
+			"node_name":          node.Name,
+			"node_instance_type": "m5.large",
+			"node_zone":          "eu-west-1a",
+			"node_ready":         "True",
+			"node_pressure":      "MemoryPressure",
+			"kubelet_version":    "v1.27.3",
+		}
+		for key, value := range expectedTags {
+			if sentryEvent.Tags[key] != value {
+				t.Errorf("received tag %s=%q, wanted %q", key, sentryEvent.Tags[key], value)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(fingerprints[0], fingerprints[1]) {
+		t.Errorf("received different fingerprints for the same node: %v and %v", fingerprints[0], fingerprints[1])
+	}
+}
@@ -17,28 +17,22 @@ func runPodEnhancer(ctx context.Context, podMeta *v1.ObjectReference, cachedObje
 
 	logger.Debug().Msgf("Running the pod enhancer")
 
-	clientset, err := getClientsetFromContext(ctx)
-	if err != nil {
-		return err
-	}
-
 	namespace := podMeta.Namespace
 	podName := podMeta.Name
-	opts := metav1.GetOptions{}
 
 	cachedPod, _ := cachedObject.(*v1.Pod)
-	var pod *v1.Pod
 	if cachedPod == nil {
 		logger.Debug().Msgf("Fetching pod data")
-		// FIXME: this can probably be cached if we use NewSharedInformerFactory
-		pod, err = clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, opts)
+		var err error
+		cachedPod, err = getPod(ctx, namespace, podName)
 		if err != nil {
 			return err
 		}
 	} else {
 		logger.Debug().Msgf("Reusing the available pod object")
-		pod = cachedPod
 	}
+	// The pod might come from the informer cache, so don't modify it
+	pod := cachedPod.DeepCopy()
 
 	// Clean-up the object
 	pod.ManagedFields = []metav1.ManagedFieldsEntry{}
@@ -79,8 +73,13 @@ func runPodEnhancer(ctx context.Context, podMeta *v1.ObjectReference, cachedObje
 	// Adjust fingerprint.
 	// If there's already a non-empty fingerprint set, we assume that it was set by
 	// another enhancer, so we don't touch it.
+	// Events with a stack trace are grouped by the code location instead.
 	if len(sentryEvent.Fingerprint) == 0 {
-		sentryEvent.Fingerprint = []string{message}
+		if len(sentryEvent.Exception) > 0 {
+			sentryEvent.Fingerprint = []string{"{{ default }}"}
+		} else {
+			sentryEvent.Fingerprint = []string{message}
+		}
 	}
 
 	// Using finger print to group events together
@@ -91,21 +90,23 @@ func runPodEnhancer(ctx context.Context, podMeta *v1.ObjectReference, cachedObje
 		// The pod is owned by a higher resource
 	} else {
 		// Check if pod is part of cronJob (as grandchild workload resource)
-
-		// check if a cronJob
-		var ok bool
 		if pod.OwnerReferences[0].Kind == "Job" {
-			ok, err = runCronsDataHandler(ctx, scope, pod, sentryEvent)
+			_, err = runCronsDataHandler(ctx, scope, pod)
 			if err != nil {
 				return err
 			}
 		}
 
-		// The job is not owned by a cronJob
-		if !ok {
-			owner := pod.OwnerReferences[0]
-			sentryEvent.Fingerprint = append(sentryEvent.Fingerprint, owner.Kind, owner.Name)
+		// Intermediate owners (e.g. ReplicaSets) change on every rollout,
+		// so group by the top-level workload
+		workload, err := podOwnerResolver.resolve(ctx, pod)
+		if err != nil || workload == nil {
+			logger.Warn().Msgf("Cannot resolve the workload of the pod, using the direct owner: %v", err)
+			workload = newWorkloadRef(&pod.OwnerReferences[0])
 		}
+		sentryEvent.Fingerprint = append(sentryEvent.Fingerprint, workload.Kind, workload.Name)
+		setTagIfNotEmpty(scope, "workload_kind", workload.Kind)
+		setTagIfNotEmpty(scope, "workload_name", workload.Name)
 	}
 
 	logger.Trace().Msgf("Fingerprint after adjustment: %v", sentryEvent.Fingerprint)
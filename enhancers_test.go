@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// test that only the enhancers matching the object kind are returned,
+// in the execution order
+func TestEnhancerRegistry(t *testing.T) {
+
+	registry := &enhancerRegistry{}
+	noop := EnhancerFunc(func(context.Context, *v1.ObjectReference, interface{}, *sentry.Scope, *sentry.Event) error {
+		return nil
+	})
+
+	registry.register("overrides", schema.GroupVersionKind{}, EnhancerOrderOverrides, noop)
+	registry.register("custom", schema.GroupVersionKind{}, EnhancerOrderCustom, noop)
+	registry.register("deployment", schema.GroupVersionKind{Group: "apps", Kind: "Deployment"}, EnhancerOrderKind, noop)
+	registry.register("pod", v1.SchemeGroupVersion.WithKind("Pod"), EnhancerOrderKind, noop)
+	registry.register("common", schema.GroupVersionKind{}, EnhancerOrderCommon, noop)
+	registry.register("deployment-v2", schema.GroupVersionKind{Group: "apps", Version: "v2", Kind: "Deployment"}, EnhancerOrderKind, noop)
+
+	testCases := map[string]struct {
+		objectRef *v1.ObjectReference
+		expected  []string
+	}{
+		"pod": {
+			objectRef: &v1.ObjectReference{Kind: "Pod", APIVersion: "v1"},
+			expected:  []string{"common", "pod", "custom", "overrides"},
+		},
+		"pod without API version": {
+			objectRef: &v1.ObjectReference{Kind: "Pod"},
+			expected:  []string{"common", "pod", "custom", "overrides"},
+		},
+		"deployment": {
+			objectRef: &v1.ObjectReference{Kind: "Deployment", APIVersion: "apps/v1"},
+			expected:  []string{"common", "deployment", "custom", "overrides"},
+		},
+		"service": {
+			objectRef: &v1.ObjectReference{Kind: "Service", APIVersion: "v1"},
+			expected:  []string{"common", "custom", "overrides"},
+		},
+		"pod from another group": {
+			objectRef: &v1.ObjectReference{Kind: "Pod", APIVersion: "metrics.k8s.io/v1beta1"},
+			expected:  []string{"common", "custom", "overrides"},
+		},
+	}
+
+	for name, testCase := range testCases {
+		names := []string{}
+		for _, enhancer := range registry.getEnhancers(testCase.objectRef.GroupVersionKind()) {
+			names = append(names, enhancer.name)
+		}
+		if !reflect.DeepEqual(names, testCase.expected) {
+			t.Errorf("[%s] received enhancers %v, wanted %v", name, names, testCase.expected)
+		}
+	}
+}
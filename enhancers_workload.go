@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+const daemonSetGenerationAnnotation = "deprecated.daemonset.template.generation"
+
+// Possible values of the "rollout_status" tag
+const (
+	rolloutStatusComplete   = "complete"
+	rolloutStatusInProgress = "in_progress"
+	rolloutStatusStalled    = "stalled"
+)
+
+// The rollout state of a Deployment, StatefulSet or DaemonSet, in a form
+// that's common for all of them
+type workloadState struct {
+	objectMeta         metav1.ObjectMeta
+	podTemplate        v1.PodTemplateSpec
+	observedGeneration int64
+	revision           string
+	strategy           string
+	replicas           sentry.Context
+	conditions         sentry.Context
+	rolloutStatus      string
+}
+
+func formatIntOrString(value *intstr.IntOrString) string {
+	if value == nil {
+		return ""
+	}
+	return value.String()
+}
+
+func formatRollingUpdateStrategy(strategyType string, maxUnavailable *intstr.IntOrString, maxSurge *intstr.IntOrString) string {
+	strategy := strategyType
+	if maxUnavailable != nil {
+		strategy += fmt.Sprintf(", max unavailable: %s", formatIntOrString(maxUnavailable))
+	}
+	if maxSurge != nil {
+		strategy += fmt.Sprintf(", max surge: %s", formatIntOrString(maxSurge))
+	}
+	return strategy
+}
+
+func formatWorkloadCondition(status v1.ConditionStatus, reason string, message string) string {
+	value := string(status)
+	if reason != "" {
+		value = fmt.Sprintf("%s (%s)", value, reason)
+	}
+	if message != "" {
+		value = fmt.Sprintf("%s: %s", value, message)
+	}
+	return value
+}
+
+func getDesiredReplicas(replicas *int32) int32 {
+	// The API server defaults it to 1
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+func getDeploymentState(deployment *appsv1.Deployment) *workloadState {
+	status := deployment.Status
+	desired := getDesiredReplicas(deployment.Spec.Replicas)
+
+	state := &workloadState{
+		objectMeta:         deployment.ObjectMeta,
+		podTemplate:        deployment.Spec.Template,
+		observedGeneration: status.ObservedGeneration,
+		revision:           deployment.Annotations[deploymentRevisionAnnotation],
+		strategy:           string(deployment.Spec.Strategy.Type),
+		replicas: sentry.Context{
+			"Desired":     desired,
+			"Current":     status.Replicas,
+			"Updated":     status.UpdatedReplicas,
+			"Ready":       status.ReadyReplicas,
+			"Available":   status.AvailableReplicas,
+			"Unavailable": status.UnavailableReplicas,
+		},
+		conditions: sentry.Context{},
+	}
+	if rollingUpdate := deployment.Spec.Strategy.RollingUpdate; rollingUpdate != nil {
+		state.strategy = formatRollingUpdateStrategy(state.strategy, rollingUpdate.MaxUnavailable, rollingUpdate.MaxSurge)
+	}
+
+	state.rolloutStatus = rolloutStatusInProgress
+	if status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == desired &&
+		status.Replicas == desired &&
+		status.AvailableReplicas == desired {
+		state.rolloutStatus = rolloutStatusComplete
+	}
+	for _, condition := range status.Conditions {
+		state.conditions[string(condition.Type)] = formatWorkloadCondition(condition.Status, condition.Reason, condition.Message)
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			state.rolloutStatus = rolloutStatusStalled
+		}
+	}
+	return state
+}
+
+func getStatefulSetState(statefulSet *appsv1.StatefulSet) *workloadState {
+	status := statefulSet.Status
+	desired := getDesiredReplicas(statefulSet.Spec.Replicas)
+
+	state := &workloadState{
+		objectMeta:         statefulSet.ObjectMeta,
+		podTemplate:        statefulSet.Spec.Template,
+		observedGeneration: status.ObservedGeneration,
+		revision:           status.UpdateRevision,
+		strategy:           string(statefulSet.Spec.UpdateStrategy.Type),
+		replicas: sentry.Context{
+			"Desired":   desired,
+			"Current":   status.CurrentReplicas,
+			"Updated":   status.UpdatedReplicas,
+			"Ready":     status.ReadyReplicas,
+			"Available": status.AvailableReplicas,
+		},
+		conditions: sentry.Context{},
+	}
+	if rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil {
+		state.strategy = formatRollingUpdateStrategy(state.strategy, rollingUpdate.MaxUnavailable, nil)
+		if rollingUpdate.Partition != nil {
+			state.strategy += fmt.Sprintf(", partition: %d", *rollingUpdate.Partition)
+		}
+	}
+	if status.CurrentRevision != status.UpdateRevision {
+		state.replicas["Current revision"] = status.CurrentRevision
+	}
+
+	state.rolloutStatus = rolloutStatusInProgress
+	if status.ObservedGeneration >= statefulSet.Generation &&
+		status.CurrentRevision == status.UpdateRevision &&
+		status.UpdatedReplicas == desired &&
+		status.ReadyReplicas == desired {
+		state.rolloutStatus = rolloutStatusComplete
+	}
+	for _, condition := range status.Conditions {
+		state.conditions[string(condition.Type)] = formatWorkloadCondition(condition.Status, condition.Reason, condition.Message)
+	}
+	return state
+}
+
+func getDaemonSetState(daemonSet *appsv1.DaemonSet) *workloadState {
+	status := daemonSet.Status
+
+	state := &workloadState{
+		objectMeta:         daemonSet.ObjectMeta,
+		podTemplate:        daemonSet.Spec.Template,
+		observedGeneration: status.ObservedGeneration,
+		revision:           daemonSet.Annotations[daemonSetGenerationAnnotation],
+		strategy:           string(daemonSet.Spec.UpdateStrategy.Type),
+		replicas: sentry.Context{
+			"Desired":      status.DesiredNumberScheduled,
+			"Current":      status.CurrentNumberScheduled,
+			"Updated":      status.UpdatedNumberScheduled,
+			"Ready":        status.NumberReady,
+			"Available":    status.NumberAvailable,
+			"Unavailable":  status.NumberUnavailable,
+			"Misscheduled": status.NumberMisscheduled,
+		},
+		conditions: sentry.Context{},
+	}
+	if rollingUpdate := daemonSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil {
+		state.strategy = formatRollingUpdateStrategy(state.strategy, rollingUpdate.MaxUnavailable, rollingUpdate.MaxSurge)
+	}
+
+	state.rolloutStatus = rolloutStatusInProgress
+	if status.ObservedGeneration >= daemonSet.Generation &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+		status.NumberAvailable == status.DesiredNumberScheduled {
+		state.rolloutStatus = rolloutStatusComplete
+	}
+	for _, condition := range status.Conditions {
+		state.conditions[string(condition.Type)] = formatWorkloadCondition(condition.Status, condition.Reason, condition.Message)
+	}
+	return state
+}
+
+// Fetches the workload and returns its state, the cached object is used if
+// it's available
+func getWorkloadState(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}) (*workloadState, error) {
+	switch objectRef.Kind {
+	case "Deployment":
+		deployment, _ := cachedObject.(*appsv1.Deployment)
+		if deployment == nil {
+			var err error
+			if deployment, err = getDeployment(ctx, objectRef.Namespace, objectRef.Name); err != nil {
+				return nil, err
+			}
+		}
+		return getDeploymentState(deployment.DeepCopy()), nil
+	case "StatefulSet":
+		statefulSet, _ := cachedObject.(*appsv1.StatefulSet)
+		if statefulSet == nil {
+			var err error
+			if statefulSet, err = getStatefulSet(ctx, objectRef.Namespace, objectRef.Name); err != nil {
+				return nil, err
+			}
+		}
+		return getStatefulSetState(statefulSet.DeepCopy()), nil
+	case "DaemonSet":
+		daemonSet, _ := cachedObject.(*appsv1.DaemonSet)
+		if daemonSet == nil {
+			var err error
+			if daemonSet, err = getDaemonSet(ctx, objectRef.Namespace, objectRef.Name); err != nil {
+				return nil, err
+			}
+		}
+		return getDaemonSetState(daemonSet.DeepCopy()), nil
+	default:
+		return nil, fmt.Errorf("unsupported workload kind: %s", objectRef.Kind)
+	}
+}
+
+func runWorkloadEnhancer(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+	logger := zerolog.Ctx(ctx)
+
+	logger.Debug().Msgf("Running the workload enhancer")
+
+	namespace := objectRef.Namespace
+	kind := objectRef.Kind
+	name := objectRef.Name
+
+	state, err := getWorkloadState(ctx, objectRef, cachedObject)
+	if err != nil {
+		return err
+	}
+
+	setTagIfNotEmpty(scope, "workload_kind", kind)
+	setTagIfNotEmpty(scope, "workload_name", name)
+	setTagIfNotEmpty(scope, "workload_revision", state.revision)
+	setTagIfNotEmpty(scope, "rollout_status", state.rolloutStatus)
+
+	scope.SetContext("Rollout", sentry.Context{
+		"Revision":            state.revision,
+		"Strategy":            state.strategy,
+		"Generation":          state.objectMeta.Generation,
+		"Observed generation": state.observedGeneration,
+		"Status":              state.rolloutStatus,
+	})
+	scope.SetContext("Replicas", state.replicas)
+	if len(state.conditions) > 0 {
+		scope.SetContext("Conditions", state.conditions)
+	}
+
+	images := sentry.Context{}
+	for _, container := range state.podTemplate.Spec.InitContainers {
+		images[container.Name+" (init)"] = container.Image
+	}
+	for _, container := range state.podTemplate.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+	scope.SetContext("Images", images)
+
+	// Clean-up the object
+	state.objectMeta.ManagedFields = []metav1.ManagedFieldsEntry{}
+	if metadataJson, err := prettyJson(state.objectMeta); err == nil {
+		scope.SetContext(kind, sentry.Context{
+			"Metadata": metadataJson,
+		})
+	}
+
+	// The data will be mostly duplicated in the workload metadata
+	scope.RemoveExtra("Involved Object")
+
+	// Add related events as breadcrumbs, so a stuck rollout can be told
+	// apart from a one-off failure
+	workloadEvents := filterEventsFromBuffer(namespace, kind, name)
+	for _, workloadEvent := range workloadEvents {
+		breadcrumbLevel := sentry.LevelInfo
+		if workloadEvent.Type == v1.EventTypeWarning {
+			breadcrumbLevel = sentry.LevelWarning
+		}
+
+		scope.AddBreadcrumb(&sentry.Breadcrumb{
+			Message:   workloadEvent.Message,
+			Level:     breadcrumbLevel,
+			Timestamp: workloadEvent.LastTimestamp.Time,
+		}, breadcrumbLimit)
+	}
+
+	// Same as for pods: group by the workload
+	if len(sentryEvent.Fingerprint) == 0 {
+		sentryEvent.Fingerprint = []string{sentryEvent.Message}
+	}
+	sentryEvent.Fingerprint = append(sentryEvent.Fingerprint, kind, name)
+
+	logger.Trace().Msgf("Fingerprint after adjustment: %v", sentryEvent.Fingerprint)
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// test that the workload enhancer recognizes a stalled rollout, and adds
+// the recent events of the workload as breadcrumbs
+func TestRunWorkloadEnhancer(t *testing.T) {
+
+	namespace := "TestRunWorkloadEnhancerNamespace"
+	replicas := int32(3)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "TestRunWorkloadEnhancerDeployment",
+			Namespace:   namespace,
+			Generation:  4,
+			Annotations: map[string]string{deploymentRevisionAnnotation: "7"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "web", Image: "web:1.2.3"}},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 4,
+			Replicas:           4,
+			UpdatedReplicas:    1,
+			AvailableReplicas:  3,
+			Conditions: []appsv1.DeploymentCondition{
+				{
+					Type:   appsv1.DeploymentProgressing,
+					Status: corev1.ConditionFalse,
+					Reason: "ProgressDeadlineExceeded",
+				},
+			},
+		},
+	}
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(deployment))
+
+	addEventToBuffer(&corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Deployment",
+			Name: deployment.Name,
+		},
+		Message:       "Scaled up replica set TestRunWorkloadEnhancerDeployment-5d8f7c to 1",
+		Type:          corev1.EventTypeNormal,
+		LastTimestamp: metav1.NewTime(time.Now()),
+	})
+
+	scope := sentry.NewScope()
+	sentryEvent := &sentry.Event{Message: "Deployment does not have minimum availability"}
+	objectRef := &corev1.ObjectReference{Kind: "Deployment", APIVersion: "apps/v1", Name: deployment.Name, Namespace: namespace}
+	runEnhancers(ctx, objectRef, nil, scope, sentryEvent)
+
+	sentryEvent = scope.ApplyToEvent(sentryEvent, nil)
+	expectedTags := map[string]string{
+		"workload_kind":     "Deployment",
+		"workload_name":     deployment.Name,
+		"workload_revision": "7",
+		"rollout_status":    rolloutStatusStalled,
+	}
+	for key, value := range expectedTags {
+		if sentryEvent.Tags[key] != value {
+			t.Errorf("received tag %s=%q, wanted %q", key, sentryEvent.Tags[key], value)
+		}
+	}
+
+	if len(sentryEvent.Breadcrumbs) != 1 {
+		t.Errorf("received %d breadcrumbs, wanted 1", len(sentryEvent.Breadcrumbs))
+	}
+
+	expectedFingerprint := []string{"Deployment does not have minimum availability", "Deployment", deployment.Name}
+	if len(sentryEvent.Fingerprint) != len(expectedFingerprint) {
+		t.Fatalf("received fingerprint %v, wanted %v", sentryEvent.Fingerprint, expectedFingerprint)
+	}
+	for i := range expectedFingerprint {
+		if sentryEvent.Fingerprint[i] != expectedFingerprint[i] {
+			t.Errorf("received fingerprint %v, wanted %v", sentryEvent.Fingerprint, expectedFingerprint)
+			break
+		}
+	}
+}
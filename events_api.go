@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	eventsAPICoreV1   = "core/v1"
+	eventsAPIEventsV1 = "events.k8s.io/v1"
+)
+
+func getEventsAPI() (string, error) {
+	eventsAPI := strings.ToLower(strings.TrimSpace(getConfigValue("SENTRY_K8S_EVENTS_API")))
+
+	switch eventsAPI {
+	case "", eventsAPICoreV1, "v1":
+		return eventsAPICoreV1, nil
+	case eventsAPIEventsV1:
+		return eventsAPIEventsV1, nil
+	default:
+		return "", fmt.Errorf("invalid events API provided in SENTRY_K8S_EVENTS_API: %s", eventsAPI)
+	}
+}
+
+// Converts an events.k8s.io/v1 event to the core/v1 representation, which
+// is used everywhere else in the agent. Both APIs are served from the same
+// storage, so the conversion does not lose anything important.
+func convertEventsV1Event(event *eventsv1.Event) *v1.Event {
+	coreEvent := &v1.Event{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Event",
+			APIVersion: "v1",
+		},
+		ObjectMeta:          *event.ObjectMeta.DeepCopy(),
+		InvolvedObject:      event.Regarding,
+		Reason:              event.Reason,
+		Message:             event.Note,
+		Source:              event.DeprecatedSource,
+		FirstTimestamp:      event.DeprecatedFirstTimestamp,
+		LastTimestamp:       event.DeprecatedLastTimestamp,
+		Count:               event.DeprecatedCount,
+		Type:                event.Type,
+		EventTime:           event.EventTime,
+		Action:              event.Action,
+		ReportingController: event.ReportingController,
+		ReportingInstance:   event.ReportingInstance,
+	}
+	if event.Related != nil {
+		coreEvent.Related = event.Related.DeepCopy()
+	}
+	if event.Series != nil {
+		coreEvent.Series = &v1.EventSeries{
+			Count:            event.Series.Count,
+			LastObservedTime: event.Series.LastObservedTime,
+		}
+		if coreEvent.Count == 0 {
+			coreEvent.Count = event.Series.Count
+		}
+	}
+	return coreEvent
+}
+
+// Returns the core/v1 representation of the event object, supports both
+// core/v1 and events.k8s.io/v1 events
+func getCoreEvent(object runtime.Object) (*v1.Event, bool) {
+	switch event := object.(type) {
+	case *v1.Event:
+		return event, true
+	case *eventsv1.Event:
+		return convertEventsV1Event(event), true
+	default:
+		return nil, false
+	}
+}
+
+// Newer controllers only fill in "reportingController"
+func getEventSourceComponent(event *v1.Event) string {
+	if event.Source.Component != "" {
+		return event.Source.Component
+	}
+	return event.ReportingController
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// A small expression language for filter rules, e.g.
+//
+//	namespace startsWith "ci-" && reason == "BackOff"
+//	kind == "Pod" && (count > 5 || message matches "(?i)timeout")
+//	labels selects "app=web,tier!=db" && labels["team"] != "payments"
+//	reason in ["Evicted", "Preempted"]
+//
+// Operators: == != < <= > >= startsWith endsWith contains matches selects
+// in, combined with && || ! and parentheses.
+
+type filterValueType int
+
+const (
+	filterValueString filterValueType = iota
+	filterValueInt
+	filterValueLabels
+	filterValueList
+)
+
+// The fields available in expressions
+var filterFieldTypes = map[string]filterValueType{
+	"type":      filterValueString,
+	"reason":    filterValueString,
+	"message":   filterValueString,
+	"kind":      filterValueString,
+	"name":      filterValueString,
+	"namespace": filterValueString,
+	"component": filterValueString,
+	"container": filterValueString,
+	"count":     filterValueInt,
+	"exitCode":  filterValueInt,
+	"labels":    filterValueLabels,
+}
+
+// / Lexer
+
+type filterTokenKind int
+
+const (
+	filterTokenEOF filterTokenKind = iota
+	filterTokenIdent
+	filterTokenString
+	filterTokenNumber
+	filterTokenPunct
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	value string
+	pos   int
+}
+
+var filterPunctuation = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func tokenizeFilterExpression(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	pos := 0
+	for pos < len(expression) {
+		char := rune(expression[pos])
+		switch {
+		case unicode.IsSpace(char):
+			pos++
+		case char == '"':
+			end := pos + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			value, err := strconv.Unquote(expression[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %v", pos, err)
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenString, value: value, pos: pos})
+			pos = end + 1
+		case unicode.IsDigit(char) || (char == '-' && pos+1 < len(expression) && unicode.IsDigit(rune(expression[pos+1]))):
+			end := pos + 1
+			for end < len(expression) && unicode.IsDigit(rune(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenNumber, value: expression[pos:end], pos: pos})
+			pos = end
+		case unicode.IsLetter(char) || char == '_':
+			end := pos + 1
+			for end < len(expression) && (unicode.IsLetter(rune(expression[end])) || unicode.IsDigit(rune(expression[end])) || expression[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenIdent, value: expression[pos:end], pos: pos})
+			pos = end
+		default:
+			matched := false
+			for _, punct := range filterPunctuation {
+				if strings.HasPrefix(expression[pos:], punct) {
+					tokens = append(tokens, filterToken{kind: filterTokenPunct, value: punct, pos: pos})
+					pos += len(punct)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", char, pos)
+			}
+		}
+	}
+	return append(tokens, filterToken{kind: filterTokenEOF, pos: pos}), nil
+}
+
+// / Syntax tree
+
+type filterNode interface {
+	eval(input *filterInput) bool
+}
+
+type filterAndNode struct{ left, right filterNode }
+type filterOrNode struct{ left, right filterNode }
+type filterNotNode struct{ operand filterNode }
+
+func (n *filterAndNode) eval(input *filterInput) bool {
+	return n.left.eval(input) && n.right.eval(input)
+}
+
+func (n *filterOrNode) eval(input *filterInput) bool {
+	return n.left.eval(input) || n.right.eval(input)
+}
+
+func (n *filterNotNode) eval(input *filterInput) bool {
+	return !n.operand.eval(input)
+}
+
+// A field, a single label, or a literal
+type filterOperand struct {
+	field    string
+	labelKey string
+	literal  interface{}
+	// The type of the value
+	valueType filterValueType
+}
+
+func (o *filterOperand) value(input *filterInput) interface{} {
+	if o.field == "" {
+		return o.literal
+	}
+	if o.labelKey != "" {
+		return input.getLabels()[o.labelKey]
+	}
+	return input.getField(o.field)
+}
+
+type filterComparisonNode struct {
+	left     *filterOperand
+	operator string
+	right    *filterOperand
+	regex    *regexp.Regexp
+	selector labels.Selector
+}
+
+func (n *filterComparisonNode) eval(input *filterInput) bool {
+	left := n.left.value(input)
+	right := n.right.value(input)
+
+	switch n.operator {
+	case "selects":
+		labelSet, _ := left.(map[string]string)
+		return n.selector.Matches(labels.Set(labelSet))
+	case "matches":
+		return n.regex.MatchString(fmt.Sprint(left))
+	case "in":
+		for _, item := range right.([]string) {
+			if item == fmt.Sprint(left) {
+				return true
+			}
+		}
+		return false
+	case "startsWith":
+		return strings.HasPrefix(fmt.Sprint(left), fmt.Sprint(right))
+	case "endsWith":
+		return strings.HasSuffix(fmt.Sprint(left), fmt.Sprint(right))
+	case "contains":
+		return strings.Contains(fmt.Sprint(left), fmt.Sprint(right))
+	}
+
+	if n.left.valueType == filterValueInt {
+		leftInt, _ := left.(int64)
+		rightInt, _ := right.(int64)
+		switch n.operator {
+		case "==":
+			return leftInt == rightInt
+		case "!=":
+			return leftInt != rightInt
+		case "<":
+			return leftInt < rightInt
+		case "<=":
+			return leftInt <= rightInt
+		case ">":
+			return leftInt > rightInt
+		case ">=":
+			return leftInt >= rightInt
+		}
+		return false
+	}
+
+	switch n.operator {
+	case "==":
+		return fmt.Sprint(left) == fmt.Sprint(right)
+	case "!=":
+		return fmt.Sprint(left) != fmt.Sprint(right)
+	}
+	return false
+}
+
+// / Parser
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.pos]
+	if token.kind != filterTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *filterParser) isPunct(value string) bool {
+	token := p.peek()
+	return token.kind == filterTokenPunct && token.value == value
+}
+
+func (p *filterParser) expectPunct(value string) error {
+	token := p.next()
+	if token.kind != filterTokenPunct || token.value != value {
+		return fmt.Errorf("expected %q at position %d", value, token.pos)
+	}
+	return nil
+}
+
+func parseFilterExpression(expression string) (filterNode, error) {
+	tokens, err := tokenizeFilterExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != filterTokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", token.value, token.pos)
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOrNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAndNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.isPunct("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNotNode{operand: operand}, nil
+	}
+	if p.isPunct("(") {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseOperand() (*filterOperand, error) {
+	token := p.next()
+	switch token.kind {
+	case filterTokenString:
+		return &filterOperand{literal: token.value, valueType: filterValueString}, nil
+	case filterTokenNumber:
+		value, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at position %d: %v", token.pos, err)
+		}
+		return &filterOperand{literal: value, valueType: filterValueInt}, nil
+	case filterTokenIdent:
+		valueType, found := filterFieldTypes[token.value]
+		if !found {
+			return nil, fmt.Errorf("unknown field %q at position %d", token.value, token.pos)
+		}
+		operand := &filterOperand{field: token.value, valueType: valueType}
+		// labels["key"]
+		if valueType == filterValueLabels && p.isPunct("[") {
+			p.next()
+			key := p.next()
+			if key.kind != filterTokenString {
+				return nil, fmt.Errorf("expected a label key at position %d", key.pos)
+			}
+			if err := p.expectPunct("]"); err != nil {
+				return nil, err
+			}
+			operand.labelKey = key.value
+			operand.valueType = filterValueString
+		}
+		return operand, nil
+	case filterTokenPunct:
+		if token.value == "[" {
+			return p.parseList()
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", token.value, token.pos)
+}
+
+// ["a", "b"], the opening bracket is already consumed
+func (p *filterParser) parseList() (*filterOperand, error) {
+	items := []string{}
+	for !p.isPunct("]") {
+		if len(items) > 0 {
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+		}
+		token := p.next()
+		if token.kind != filterTokenString && token.kind != filterTokenNumber {
+			return nil, fmt.Errorf("expected a string or a number at position %d", token.pos)
+		}
+		items = append(items, token.value)
+	}
+	p.next()
+	return &filterOperand{literal: items, valueType: filterValueList}, nil
+}
+
+var filterComparisonOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"startsWith": true, "endsWith": true, "contains": true, "matches": true, "selects": true, "in": true,
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	operatorToken := p.next()
+	if !filterComparisonOperators[operatorToken.value] || operatorToken.kind == filterTokenString {
+		return nil, fmt.Errorf("expected an operator at position %d", operatorToken.pos)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &filterComparisonNode{left: left, operator: operatorToken.value, right: right}
+	if err := node.check(); err != nil {
+		return nil, fmt.Errorf("%v at position %d", err, operatorToken.pos)
+	}
+	return node, nil
+}
+
+// Checks the types of the operands, and compiles regular expressions and
+// label selectors
+func (n *filterComparisonNode) check() error {
+	leftType, rightType := n.left.valueType, n.right.valueType
+	if leftType == filterValueList {
+		return fmt.Errorf("a list cannot be on the left side of %q", n.operator)
+	}
+	if rightType == filterValueList && n.operator != "in" {
+		return fmt.Errorf("a list can only be used with \"in\"")
+	}
+
+	switch n.operator {
+	case "selects":
+		literal, ok := n.right.literal.(string)
+		if leftType != filterValueLabels || n.right.field != "" || !ok {
+			return fmt.Errorf("%q needs labels on the left and a string on the right", n.operator)
+		}
+		selector, err := labels.Parse(literal)
+		if err != nil {
+			return fmt.Errorf("invalid label selector: %v", err)
+		}
+		n.selector = selector
+		return nil
+	case "in":
+		if rightType != filterValueList {
+			return fmt.Errorf("%q needs a list on the right", n.operator)
+		}
+	case "matches":
+		literal, ok := n.right.literal.(string)
+		if n.right.field != "" || !ok {
+			return fmt.Errorf("%q needs a string on the right", n.operator)
+		}
+		regex, err := regexp.Compile(literal)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+		n.regex = regex
+	case "<", "<=", ">", ">=":
+		if leftType != filterValueInt || rightType != filterValueInt {
+			return fmt.Errorf("%q needs numbers on both sides", n.operator)
+		}
+	default:
+		if (leftType == filterValueInt) != (rightType == filterValueInt) {
+			return fmt.Errorf("cannot compare a number and a string with %q", n.operator)
+		}
+	}
+	if leftType == filterValueLabels || rightType == filterValueLabels {
+		return fmt.Errorf("labels can only be used with \"selects\" or as labels[\"key\"]")
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// What a matching rule does with the event
+const (
+	filterActionDrop = "drop"
+	// Stops the evaluation, so later rules don't drop the event
+	filterActionKeep = "keep"
+)
+
+// A single entry of SENTRY_K8S_FILTER_RULES
+type filterRuleConfig struct {
+	Name       string `json:"name,omitempty"`
+	Expression string `json:"expression"`
+	// "drop" (default) or "keep"
+	Action string `json:"action,omitempty"`
+}
+
+type filterRule struct {
+	name   string
+	action string
+	node   filterNode
+}
+
+// The rules are evaluated in order, the first matching rule decides
+var filterRules []*filterRule
+
+func parseFilterRules(raw string) ([]*filterRule, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	configs := []filterRuleConfig{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&configs); err != nil {
+		return nil, err
+	}
+
+	rules := make([]*filterRule, 0, len(configs))
+	for i, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		action := strings.ToLower(strings.TrimSpace(config.Action))
+		switch action {
+		case "":
+			action = filterActionDrop
+		case filterActionDrop, filterActionKeep:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", name, config.Action)
+		}
+		node, err := parseFilterExpression(config.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		rules = append(rules, &filterRule{name: name, action: action, node: node})
+	}
+	return rules, nil
+}
+
+func prepareFilterRules() error {
+	rules, err := parseFilterRules(getConfigValue("SENTRY_K8S_FILTER_RULES"))
+	if err != nil {
+		return fmt.Errorf("invalid SENTRY_K8S_FILTER_RULES: %v", err)
+	}
+	filterRules = rules
+	globalLogger.Debug().Msgf("Prepared %d filter rule(s)", len(filterRules))
+	return nil
+}
+
+// The values the expressions are evaluated against. The labels are only
+// fetched if a rule needs them.
+type filterInput struct {
+	eventType string
+	reason    string
+	message   string
+	kind      string
+	name      string
+	namespace string
+	component string
+	container string
+	count     int64
+	exitCode  int64
+
+	fetchLabels   func() map[string]string
+	labels        map[string]string
+	labelsFetched bool
+}
+
+func (in *filterInput) getLabels() map[string]string {
+	if !in.labelsFetched {
+		in.labelsFetched = true
+		if in.fetchLabels != nil {
+			in.labels = in.fetchLabels()
+		}
+	}
+	return in.labels
+}
+
+func (in *filterInput) getField(field string) interface{} {
+	switch field {
+	case "type":
+		return in.eventType
+	case "reason":
+		return in.reason
+	case "message":
+		return in.message
+	case "kind":
+		return in.kind
+	case "name":
+		return in.name
+	case "namespace":
+		return in.namespace
+	case "component":
+		return in.component
+	case "container":
+		return in.container
+	case "count":
+		return in.count
+	case "exitCode":
+		return in.exitCode
+	case "labels":
+		return in.getLabels()
+	}
+	return nil
+}
+
+// Returns a function that fetches the labels of the object, for objects
+// that can carry annotation overrides
+func newObjectLabelsFetcher(lookup *objectLookup) func() map[string]string {
+	return func() map[string]string {
+		object := lookup.get()
+		if object == nil {
+			return nil
+		}
+		return object.GetLabels()
+	}
+}
+
+// The lookup of the involved object is shared with the annotation overrides
+func newFilterInputFromEvent(event *v1.Event, lookup *objectLookup) *filterInput {
+	count := int64(event.Count)
+	if event.Series != nil && int64(event.Series.Count) > count {
+		count = int64(event.Series.Count)
+	}
+	return &filterInput{
+		eventType:   event.Type,
+		reason:      event.Reason,
+		message:     event.Message,
+		kind:        event.InvolvedObject.Kind,
+		name:        event.InvolvedObject.Name,
+		namespace:   event.InvolvedObject.Namespace,
+		component:   getEventSourceComponent(event),
+		count:       count,
+		fetchLabels: newObjectLabelsFetcher(lookup),
+	}
+}
+
+// The count is the restart count of the container
+func newFilterInputFromContainer(pod *v1.Pod, containerStatus *v1.ContainerStatus, reason string, message string, exitCode int32) *filterInput {
+	return &filterInput{
+		eventType:   v1.EventTypeWarning,
+		reason:      reason,
+		message:     message,
+		kind:        "Pod",
+		name:        pod.Name,
+		namespace:   pod.Namespace,
+		component:   podControllerComponent,
+		container:   containerStatus.Name,
+		count:       int64(containerStatus.RestartCount),
+		exitCode:    int64(exitCode),
+		fetchLabels: pod.GetLabels,
+	}
+}
+
+// true -> the event should be dropped
+func isFilteredByRules(ctx context.Context, input *filterInput) bool {
+	logger := zerolog.Ctx(ctx)
+
+	for _, rule := range filterRules {
+		if !rule.node.eval(input) {
+			continue
+		}
+		logger.Debug().Msgf("Filter rule %s matched (%s/%s, reason %q), action: %s", rule.name, input.kind, input.name, input.reason, rule.action)
+		return rule.action == filterActionDrop
+	}
+	if len(filterRules) > 0 {
+		logger.Debug().Msgf("No filter rule matched (%s/%s, reason %q)", input.kind, input.name, input.reason)
+	}
+	return false
+}
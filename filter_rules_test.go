@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// test that the expressions are evaluated against the event, and the
+// first matching rule decides
+func TestFilterRules(t *testing.T) {
+
+	input := func() *filterInput {
+		return &filterInput{
+			eventType: "Warning",
+			reason:    "BackOff",
+			message:   "Back-off restarting failed container web",
+			kind:      "Pod",
+			name:      "web-5d4f8-x2k9q",
+			namespace: "ci-1234",
+			component: "kubelet",
+			count:     7,
+			fetchLabels: func() map[string]string {
+				return map[string]string{"app": "web", "tier": "frontend"}
+			},
+		}
+	}
+
+	cases := []struct {
+		expression string
+		matches    bool
+	}{
+		{`namespace startsWith "ci-" && reason == "BackOff"`, true},
+		{`namespace startsWith "prod-" || reason != "BackOff"`, false},
+		{`message matches "(?i)^back-off restarting"`, true},
+		{`kind == "Pod" && (count > 5 || message contains "timeout")`, true},
+		{`count <= 5`, false},
+		{`!(component == "kubelet")`, false},
+		{`labels selects "app=web,tier!=db"`, true},
+		{`labels["app"] == "web" && labels["team"] == ""`, true},
+		{`reason in ["Evicted", "BackOff"]`, true},
+		{`name endsWith "x2k9q" && exitCode == 0`, true},
+	}
+	for _, c := range cases {
+		node, err := parseFilterExpression(c.expression)
+		if err != nil {
+			t.Errorf("cannot parse %s: %v", c.expression, err)
+			continue
+		}
+		if matches := node.eval(input()); matches != c.matches {
+			t.Errorf("%s: received %v, wanted %v", c.expression, matches, c.matches)
+		}
+	}
+
+	invalidExpressions := []string{
+		`reason ==`,
+		`unknown == "x"`,
+		`reason == "BackOff" &&`,
+		`count > "5"`,
+		`message matches "("`,
+		`labels selects "app in"`,
+		`labels == "app"`,
+		`reason == ["BackOff"]`,
+		`(reason == "BackOff"`,
+		`reason == "BackOff`,
+	}
+	for _, expression := range invalidExpressions {
+		if _, err := parseFilterExpression(expression); err == nil {
+			t.Errorf("no error for invalid expression %s", expression)
+		}
+	}
+
+	var err error
+	filterRules, err = parseFilterRules(`[
+		{"name": "keep-payments", "expression": "labels[\"team\"] == \"payments\"", "action": "keep"},
+		{"name": "ci-backoff", "expression": "namespace startsWith \"ci-\" && reason == \"BackOff\""}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		filterRules = nil
+	}()
+
+	ctx := context.Background()
+	if !isFilteredByRules(ctx, input()) {
+		t.Errorf("the event is not dropped")
+	}
+	kept := input()
+	kept.fetchLabels = func() map[string]string {
+		return map[string]string{"team": "payments"}
+	}
+	if isFilteredByRules(ctx, kept) {
+		t.Errorf("the event is dropped, but the keep rule matched")
+	}
+
+	if _, err := parseFilterRules(`[{"expression": "reason == \"x\"", "action": "ignore"}]`); err == nil {
+		t.Errorf("no error for an unknown action")
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"os"
+	"fmt"
 	"strings"
 
 	globalLogger "github.com/rs/zerolog/log"
@@ -18,13 +18,15 @@ var defaultFilterReasons = []string{
 }
 
 func prepareEventReasonFilter() {
-	filterReasonsRaw := strings.TrimSpace(os.Getenv("SENTRY_K8S_FILTER_OUT_EVENT_REASONS"))
+	filterReasonsRaw := strings.TrimSpace(getConfigValue("SENTRY_K8S_FILTER_OUT_EVENT_REASONS"))
 	var filterReasons []string
 	if filterReasonsRaw == "" {
 		filterReasons = defaultFilterReasons
 	} else {
 		filterReasons = strings.Split(filterReasonsRaw, ",")
 	}
+	// Replaced as a whole, so reloads don't keep old entries
+	reasonFilterSet = map[string]struct{}{}
 	for _, reason := range filterReasons {
 		reason = strings.ToLower(strings.TrimSpace(reason))
 		if reason != "" {
@@ -50,13 +52,14 @@ var eventSourceFilterSet = map[string]struct{}{}
 var defaultFilterEventSources = []string{}
 
 func prepareEventSourceFilter() {
-	filterEventSourcesRaw := strings.TrimSpace(os.Getenv("SENTRY_K8S_FILTER_OUT_EVENT_SOURCES"))
+	filterEventSourcesRaw := strings.TrimSpace(getConfigValue("SENTRY_K8S_FILTER_OUT_EVENT_SOURCES"))
 	var filterEventSources []string
 	if filterEventSourcesRaw == "" {
 		filterEventSources = defaultFilterEventSources
 	} else {
 		filterEventSources = strings.Split(filterEventSourcesRaw, ",")
 	}
+	eventSourceFilterSet = map[string]struct{}{}
 	for _, eventSource := range filterEventSources {
 		eventSource = strings.ToLower(strings.TrimSpace(eventSource))
 		if eventSource != "" {
@@ -68,7 +71,7 @@ func prepareEventSourceFilter() {
 
 // true -> the event should be dropped
 func isFilteredByEventSource(event *v1.Event) bool {
-	eventSource := strings.TrimSpace(strings.ToLower(event.Source.Component))
+	eventSource := strings.TrimSpace(strings.ToLower(getEventSourceComponent(event)))
 	if eventSource == "" {
 		// Weird case, do not touch the event
 		return false
@@ -77,7 +80,131 @@ func isFilteredByEventSource(event *v1.Event) bool {
 	return found
 }
 
-func prepareEventFilters() {
+// / Pod waiting reasons that should be reported
+var podWaitingReasonSet = map[string]struct{}{}
+var defaultPodWaitingReasons = []string{
+	"CrashLoopBackOff",
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"CreateContainerConfigError",
+	"InvalidImageName",
+}
+
+func preparePodWaitingReasons() {
+	waitingReasonsRaw := strings.TrimSpace(getConfigValue("SENTRY_K8S_POD_WAITING_REASONS"))
+	var waitingReasons []string
+	if waitingReasonsRaw == "" {
+		waitingReasons = defaultPodWaitingReasons
+	} else {
+		waitingReasons = strings.Split(waitingReasonsRaw, ",")
+	}
+	podWaitingReasonSet = map[string]struct{}{}
+	for _, reason := range waitingReasons {
+		reason = strings.ToLower(strings.TrimSpace(reason))
+		if reason != "" {
+			podWaitingReasonSet[reason] = struct{}{}
+		}
+	}
+	globalLogger.Debug().Msgf("Prepared the pod waiting reasons: %v", podWaitingReasonSet)
+}
+
+// true -> the waiting state should be reported
+func isReportedWaitingReason(state *v1.ContainerStateWaiting) bool {
+	waitingReason := strings.TrimSpace(strings.ToLower(state.Reason))
+	if waitingReason == "" {
+		return false
+	}
+	_, found := podWaitingReasonSet[waitingReason]
+	return found
+}
+
+// / Normal events that should be reported
+type normalEventRule struct {
+	reason string
+	// Empty matches all components
+	component string
+	// Part of the event message, empty matches all messages
+	message string
+}
+
+var normalEventAllowlist = []normalEventRule{}
+
+// How the allowed Normal events are reported
+const (
+	// As low-severity Sentry events
+	normalEventsModeEvent = "event"
+	// Only as breadcrumbs of other events
+	normalEventsModeBreadcrumb = "breadcrumb"
+)
+
+var normalEventsMode = normalEventsModeEvent
+
+// Entries are "<reason>", "<reason>:<source component>" or
+// "<reason>:<source component>:<message part>", e.g.
+// "Preempted,ScalingReplicaSet:deployment-controller,Killing::due to eviction"
+func prepareNormalEventAllowlist() error {
+	normalEventAllowlist = []normalEventRule{}
+	for _, entry := range strings.Split(getConfigValue("SENTRY_K8S_REPORT_NORMAL_EVENTS"), ",") {
+		parts := append(strings.SplitN(entry, ":", 3), "", "")
+		rule := normalEventRule{
+			reason:    strings.ToLower(strings.TrimSpace(parts[0])),
+			component: strings.ToLower(strings.TrimSpace(parts[1])),
+			message:   strings.ToLower(strings.TrimSpace(parts[2])),
+		}
+		if rule.reason != "" {
+			normalEventAllowlist = append(normalEventAllowlist, rule)
+		}
+	}
+
+	mode, err := parseNormalEventsMode()
+	if err != nil {
+		return err
+	}
+	normalEventsMode = mode
+	globalLogger.Debug().Msgf("Prepared the Normal event allowlist: %v, mode: %s", normalEventAllowlist, normalEventsMode)
+	return nil
+}
+
+func parseNormalEventsMode() (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(getConfigValue("SENTRY_K8S_NORMAL_EVENTS_MODE")))
+	switch mode {
+	case "", normalEventsModeEvent:
+		return normalEventsModeEvent, nil
+	case normalEventsModeBreadcrumb:
+		return normalEventsModeBreadcrumb, nil
+	default:
+		return "", fmt.Errorf("invalid SENTRY_K8S_NORMAL_EVENTS_MODE: %q", mode)
+	}
+}
+
+// true -> the Normal event is on the allowlist
+func isAllowedNormalEvent(event *v1.Event) bool {
+	eventReason := strings.TrimSpace(strings.ToLower(event.Reason))
+	eventSource := strings.TrimSpace(strings.ToLower(getEventSourceComponent(event)))
+	eventMessage := strings.ToLower(event.Message)
+	for _, rule := range normalEventAllowlist {
+		if rule.reason != eventReason || (rule.component != "" && rule.component != eventSource) {
+			continue
+		}
+		if rule.message == "" || strings.Contains(eventMessage, rule.message) {
+			return true
+		}
+	}
+	return false
+}
+
+// true -> the event is kept for the breadcrumbs of other events. In the
+// breadcrumb mode, only the allowed Normal events are kept.
+func isBufferedEvent(event *v1.Event) bool {
+	if event.Type != v1.EventTypeNormal || normalEventsMode != normalEventsModeBreadcrumb {
+		return true
+	}
+	return isAllowedNormalEvent(event)
+}
+
+func prepareEventFilters() error {
 	prepareEventReasonFilter()
 	prepareEventSourceFilter()
+	preparePodWaitingReasons()
+	return prepareNormalEventAllowlist()
 }
@@ -11,6 +11,8 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
+const cronJobsWatcherName = "cronjobs"
+
 func createCronjobInformer(ctx context.Context, factory informers.SharedInformerFactory, namespace string) (cache.SharedIndexInformer, error) {
 
 	logger := zerolog.Ctx(ctx)
@@ -35,27 +37,34 @@ func createCronjobInformer(ctx context.Context, factory informers.SharedInformer
 	handler.AddFunc = func(obj interface{}) {
 		cronjob := obj.(*batchv1.CronJob)
 		logger.Debug().Msgf("ADD: CronJob Added to Store: %s\n", cronjob.GetName())
-		_, ok := (*cronsInformerData)[cronjob.Name]
+		key := getCronsMonitorDataKey(cronjob.Namespace, cronjob.Name)
+		cronsDataLock.Lock()
+		defer cronsDataLock.Unlock()
+		_, ok := (*cronsInformerData)[key]
 		if ok {
-			logger.Debug().Msgf("cronJob %s already exists in the crons informer data struct...\n", cronjob.Name)
+			logger.Debug().Msgf("cronJob %s already exists in the crons informer data struct...\n", key)
 		} else {
-			(*cronsInformerData)[cronjob.Name] = *NewCronsMonitorData(cronjob.Name, cronjob.Spec.Schedule, 5, 3, cronjob.Spec.JobTemplate.Spec.Completions)
+			(*cronsInformerData)[key] = *NewCronsMonitorData(cronjob.Name, cronjob.Spec.Schedule, 5, 3, cronjob.Spec.JobTemplate.Spec.Completions)
 		}
 	}
 
 	handler.DeleteFunc = func(obj interface{}) {
 		cronjob := obj.(*batchv1.CronJob)
 		logger.Debug().Msgf("DELETE: CronJob deleted from Store: %s\n", cronjob.GetName())
-		_, ok := (*cronsInformerData)[cronjob.Name]
+		key := getCronsMonitorDataKey(cronjob.Namespace, cronjob.Name)
+		cronsDataLock.Lock()
+		defer cronsDataLock.Unlock()
+		_, ok := (*cronsInformerData)[key]
 		if ok {
-			delete((*cronsInformerData), cronjob.Name)
-			logger.Debug().Msgf("cronJob %s deleted from the crons informer data struct...\n", cronjob.Name)
+			delete((*cronsInformerData), key)
+			logger.Debug().Msgf("cronJob %s deleted from the crons informer data struct...\n", key)
 		} else {
-			logger.Debug().Msgf("cronJob %s not in the crons informer data struct...\n", cronjob.Name)
+			logger.Debug().Msgf("cronJob %s not in the crons informer data struct...\n", key)
 		}
 	}
 
-	cronjobInformer.AddEventHandler(handler)
+	status := registerWatcher(ctx, cronJobsWatcherName, getNamespaceLabel(namespace), cronjobInformer)
+	cronjobInformer.AddEventHandler(filterWatchedNamespaces(ctx, cronjobInformer, namespace, status.wrapHandler(handler), nil))
 
 	return cronjobInformer, nil
 }
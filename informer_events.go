@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+func createEventInformer(ctx context.Context, factory informers.SharedInformerFactory, namespace string) (cache.SharedIndexInformer, error) {
+	localHub := sentry.CurrentHub().Clone()
+	ctx = sentry.SetHubOnContext(ctx, localHub)
+
+	// Attach the "watcher" tag to logger
+	ctx, logger := getLoggerWithTag(ctx, "watcher", eventsWatcherName)
+
+	logger.Debug().Msgf("Starting event informer")
+
+	clientset, err := getClientsetFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := getCheckpointStore(clientset)
+	if err != nil {
+		return nil, err
+	}
+
+	// The informer of a dynamic namespace selection watches all namespaces,
+	// and keeps a checkpoint per namespace
+	watchers := getNamespaceWatchersFromContext(ctx)
+	perNamespace := watchers != nil && namespace == v1.NamespaceAll
+	var checkpointer *eventsCheckpointer
+	resumed := false
+	if store != nil {
+		if perNamespace {
+			checkpointer = newNamespacedEventsCheckpointer(store, getCheckpointInterval())
+		} else {
+			checkpointer = newEventsCheckpointer(store, namespace, getCheckpointInterval())
+		}
+		resumed, err = checkpointer.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	watchFromBeginning := isTruthy(getConfigValue("SENTRY_K8S_WATCH_HISTORICAL"))
+	var watchSince time.Time
+	if resumed && !perNamespace {
+		// The checkpoint knows which events were already processed
+		watchSince = time.Time{}
+		logger.Info().Msgf("Resuming watching events after the checkpoint")
+	} else if watchFromBeginning {
+		watchSince = time.Time{}
+		logger.Info().Msgf("Watching all available events (no starting timestamp)")
+	} else {
+		watchSince = time.Now()
+		logger.Info().Msgf("Watching events starting from: %s", watchSince.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+		if resumed {
+			logger.Info().Msgf("Resuming watching events after the checkpoints of the namespaces")
+		}
+	}
+	cutoffTime := metav1.Time{Time: watchSince}
+
+	eventsAPI, err := getEventsAPI()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Msgf("Using the %s events API", eventsAPI)
+
+	processor := newEventsProcessor(cutoffTime, checkpointer)
+	if perNamespace {
+		processor.watchers = watchers
+		processor.cutoffPerNamespace = !watchFromBeginning
+	}
+
+	listWatch := newEventsListWatch(clientset, eventsAPI, namespace)
+	var exampleObject runtime.Object = &v1.Event{}
+	if eventsAPI == eventsAPIEventsV1 {
+		exampleObject = &eventsv1.Event{}
+	}
+	if checkpointer != nil {
+		resumable := &resumableListWatch{
+			ListerWatcher:   listWatch,
+			resourceVersion: checkpointer.resourceVersion(),
+			// Whatever the watch missed is replayed in order, the
+			// notifications of the listed events are skipped then
+			onList: func(objects []interface{}) {
+				if !isLeader() {
+					return
+				}
+				logger.Info().Msgf("The events were listed again, replaying them after the checkpoint")
+				if err := processor.replay(ctx, objects, false); err != nil {
+					logger.Error().Msgf("Cannot replay the events: %s", err)
+				}
+			},
+		}
+		if resumable.resourceVersion != "" {
+			logger.Info().Msgf("Resuming the watch from resource version %q", resumable.resourceVersion)
+		}
+		listWatch = resumable
+	}
+	eventInformer := factory.InformerFor(exampleObject, func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		return cache.NewSharedIndexInformer(
+			listWatch,
+			exampleObject,
+			resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+	})
+
+	var handler cache.ResourceEventHandlerFuncs
+
+	handler.AddFunc = func(obj interface{}) {
+		event, ok := obj.(runtime.Object)
+		if !ok {
+			return
+		}
+		processor.handle(ctx, &watch.Event{Type: watch.Added, Object: event})
+	}
+
+	handler.UpdateFunc = func(oldObj, newObj interface{}) {
+		oldEvent, ok := oldObj.(metav1.Object)
+		if !ok {
+			return
+		}
+		newEvent, ok := newObj.(metav1.Object)
+		if !ok {
+			return
+		}
+		if oldEvent.GetResourceVersion() == newEvent.GetResourceVersion() {
+			// Periodic resync, nothing changed
+			return
+		}
+		newEventObject, ok := newObj.(runtime.Object)
+		if !ok {
+			return
+		}
+		processor.handle(ctx, &watch.Event{Type: watch.Modified, Object: newEventObject})
+	}
+
+	status := registerWatcher(ctx, eventsWatcherName, getNamespaceLabel(namespace), eventInformer)
+	eventInformer.AddEventHandler(filterWatchedNamespaces(ctx, eventInformer, namespace, status.wrapHandler(handler), func(ctx context.Context, namespace string) {
+		if err := processor.replayNamespace(ctx, eventInformer, namespace); err != nil {
+			logger.Error().Msgf("Cannot load the events checkpoint of namespace %q: %s", namespace, err)
+		}
+	}))
+	if watchers != nil {
+		watchers.subscribe(ctx, nil, func(ctx context.Context, stoppedNamespace string, unselected bool) {
+			if !perNamespace && stoppedNamespace != namespace {
+				return
+			}
+			if err := processor.forgetNamespace(ctx, stoppedNamespace, unselected); err != nil {
+				logger.Error().Msgf("Cannot save the events checkpoint of namespace %q: %s", stoppedNamespace, err)
+			}
+		})
+	}
+
+	// The initial list is processed once it is complete, in the order of
+	// the event timestamps
+	go func() {
+		if cache.WaitForCacheSync(ctx.Done(), eventInformer.HasSynced) {
+			processor.replayInitial(ctx, eventInformer)
+		}
+	}()
+
+	// Events that arrived while this replica was a follower are replayed
+	// after the checkpoint of the previous leader
+	if checkpointer != nil {
+		go checkpointer.run(ctx)
+		onLeadershipAcquired(ctx, func(ctx context.Context, _ time.Time) {
+			if err := processor.replay(ctx, eventInformer.GetStore().List(), true); err != nil {
+				logger.Error().Msgf("Cannot load the events checkpoint: %s", err)
+			}
+		})
+	}
+
+	return eventInformer, nil
+}
+
+func newEventsListWatch(clientset kubernetes.Interface, eventsAPI string, namespace string) cache.ListerWatcher {
+	if eventsAPI == eventsAPIEventsV1 {
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return clientset.EventsV1().Events(namespace).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return clientset.EventsV1().Events(namespace).Watch(context.TODO(), options)
+			},
+		}
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return clientset.CoreV1().Events(namespace).List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return clientset.CoreV1().Events(namespace).Watch(context.TODO(), options)
+		},
+	}
+}
+
+// Resumes watching from the resource version of the checkpoint instead of
+// listing all events. The first list is empty and only carries the resource
+// version, so the informer starts watching from there. If the API server
+// doesn't keep that resource version anymore (410 Gone), the informer lists
+// the events again.
+type resumableListWatch struct {
+	cache.ListerWatcher
+	// Empty once the first list was returned
+	resourceVersion string
+	// Called with the listed events before the informer stores them
+	onList func(objects []interface{})
+}
+
+func (lw *resumableListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	if lw.resourceVersion != "" {
+		resourceVersion := lw.resourceVersion
+		lw.resourceVersion = ""
+		return &metav1.List{ListMeta: metav1.ListMeta{ResourceVersion: resourceVersion}}, nil
+	}
+
+	// The replay needs all events at once to process them in order
+	options.Limit = 0
+	options.Continue = ""
+	list, err := lw.ListerWatcher.List(options)
+	if err != nil {
+		return nil, err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		objects = append(objects, item)
+	}
+	lw.onList(objects)
+	return list, nil
+}
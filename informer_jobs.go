@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/rs/zerolog"
 	batchv1 "k8s.io/api/batch/v1"
@@ -11,6 +12,8 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
+const jobsWatcherName = "jobs"
+
 func createJobInformer(ctx context.Context, factory informers.SharedInformerFactory, namespace string) (cache.SharedIndexInformer, error) {
 
 	logger := zerolog.Ctx(ctx)
@@ -56,7 +59,19 @@ func createJobInformer(ctx context.Context, factory informers.SharedInformerFact
 		}
 	}
 
-	jobInformer.AddEventHandler(handler)
+	status := registerWatcher(ctx, jobsWatcherName, getNamespaceLabel(namespace), jobInformer)
+	jobInformer.AddEventHandler(filterWatchedNamespaces(ctx, jobInformer, namespace, status.wrapHandler(handler), nil))
+
+	// Jobs that started or finished while this replica was a follower
+	onLeadershipAcquired(ctx, func(ctx context.Context, since time.Time) {
+		jobs := []*batchv1.Job{}
+		for _, obj := range filterWatchedObjects(ctx, jobInformer.GetStore().List()) {
+			if job, ok := obj.(*batchv1.Job); ok {
+				jobs = append(jobs, job)
+			}
+		}
+		replayCronsCheckins(ctx, jobs, since)
+	})
 
 	return jobInformer, nil
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+func createNamespaceInformer(ctx context.Context, factory informers.SharedInformerFactory, watchers *namespaceWatchers) (cache.SharedIndexInformer, error) {
+	// Attach the "watcher" tag to logger
+	ctx, logger := getLoggerWithTag(ctx, "watcher", namespacesWatcherName)
+
+	logger.Debug().Msgf("Starting namespace informer")
+
+	namespaceInformer := factory.Core().V1().Namespaces().Informer()
+
+	var handler cache.ResourceEventHandlerFuncs
+
+	handler.AddFunc = func(obj interface{}) {
+		namespace, ok := obj.(*v1.Namespace)
+		if !ok {
+			return
+		}
+		watchers.sync(ctx, namespace)
+	}
+
+	// Labels can change, so the namespace can start or stop matching
+	handler.UpdateFunc = func(oldObj, newObj interface{}) {
+		newNamespace, ok := newObj.(*v1.Namespace)
+		if !ok {
+			return
+		}
+		watchers.sync(ctx, newNamespace)
+	}
+
+	handler.DeleteFunc = func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		namespace, ok := obj.(*v1.Namespace)
+		if !ok {
+			return
+		}
+		watchers.stop(ctx, namespace.Name, true)
+	}
+
+	status := registerWatcher(ctx, namespacesWatcherName, "", namespaceInformer)
+	namespaceInformer.AddEventHandler(status.wrapHandler(handler))
+
+	return namespaceInformer, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	"github.com/getsentry/sentry-go"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+func createNodeInformer(ctx context.Context, factory informers.SharedInformerFactory) (cache.SharedIndexInformer, error) {
+	localHub := sentry.CurrentHub().Clone()
+	ctx = sentry.SetHubOnContext(ctx, localHub)
+
+	// Attach the "watcher" tag to logger
+	ctx, logger := getLoggerWithTag(ctx, "watcher", nodesWatcherName)
+
+	logger.Debug().Msgf("Starting node informer")
+
+	nodeInformer := factory.Core().V1().Nodes().Informer()
+
+	var handler cache.ResourceEventHandlerFuncs
+
+	// Nodes that already have problems when we see them for the first time
+	// were most probably reported before, so only transitions are reported
+	handler.UpdateFunc = func(oldObj, newObj interface{}) {
+		oldNode, ok := oldObj.(*v1.Node)
+		if !ok {
+			return
+		}
+		newNode, ok := newObj.(*v1.Node)
+		if !ok {
+			return
+		}
+		if oldNode.ResourceVersion == newNode.ResourceVersion {
+			// Periodic resync, nothing changed
+			return
+		}
+		handleNodeUpdate(ctx, oldNode, newNode)
+	}
+
+	status := registerWatcher(ctx, nodesWatcherName, "", nodeInformer)
+	nodeInformer.AddEventHandler(status.wrapHandler(handler))
+
+	return nodeInformer, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+func createPodInformer(ctx context.Context, factory informers.SharedInformerFactory, namespace string) (cache.SharedIndexInformer, error) {
+	localHub := sentry.CurrentHub().Clone()
+	ctx = sentry.SetHubOnContext(ctx, localHub)
+
+	// Attach the "watcher" tag to logger
+	ctx, logger := getLoggerWithTag(ctx, "watcher", podsWatcherName)
+
+	logger.Debug().Msgf("Starting pod informer")
+
+	podInformer := factory.Core().V1().Pods().Informer()
+
+	var handler cache.ResourceEventHandlerFuncs
+
+	handler.AddFunc = func(obj interface{}) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return
+		}
+		handlePodWatchEvent(ctx, &watch.Event{Type: watch.Added, Object: pod})
+	}
+
+	handler.UpdateFunc = func(oldObj, newObj interface{}) {
+		oldPod, ok := oldObj.(*v1.Pod)
+		if !ok {
+			return
+		}
+		newPod, ok := newObj.(*v1.Pod)
+		if !ok {
+			return
+		}
+		if oldPod.ResourceVersion == newPod.ResourceVersion {
+			// Periodic resync, nothing changed
+			return
+		}
+		handlePodWatchEvent(ctx, &watch.Event{Type: watch.Modified, Object: newPod})
+	}
+
+	handler.DeleteFunc = func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return
+		}
+		handlePodWatchEvent(ctx, &watch.Event{Type: watch.Deleted, Object: pod})
+	}
+
+	status := registerWatcher(ctx, podsWatcherName, getNamespaceLabel(namespace), podInformer)
+	podInformer.AddEventHandler(filterWatchedNamespaces(ctx, podInformer, namespace, status.wrapHandler(handler), nil))
+
+	// Followers don't look at the pods, so the new leader sees them as new
+	onLeadershipAcquired(ctx, func(ctx context.Context, since time.Time) {
+		containerTracker.restart(namespace, since)
+		for _, obj := range filterWatchedObjects(ctx, podInformer.GetStore().List()) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				handlePodWatchEvent(ctx, &watch.Event{Type: watch.Added, Object: pod})
+			}
+		}
+	})
+
+	return podInformer, nil
+}
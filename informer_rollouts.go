@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+
+	"github.com/getsentry/sentry-go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Watches Deployments, StatefulSets and DaemonSets for new revisions
+func createRolloutInformers(ctx context.Context, factory informers.SharedInformerFactory, namespace string) ([]cache.SharedIndexInformer, error) {
+	localHub := sentry.CurrentHub().Clone()
+	ctx = sentry.SetHubOnContext(ctx, localHub)
+
+	// Attach the "watcher" tag to logger
+	ctx, logger := getLoggerWithTag(ctx, "watcher", rolloutsWatcherName)
+
+	logger.Debug().Msgf("Starting rollout informers")
+
+	var handler cache.ResourceEventHandlerFuncs
+
+	handler.AddFunc = func(obj interface{}) {
+		object, ok := obj.(runtime.Object)
+		if !ok {
+			return
+		}
+		handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Added, Object: object})
+	}
+
+	handler.UpdateFunc = func(oldObj, newObj interface{}) {
+		oldMeta, ok := oldObj.(metav1.Object)
+		if !ok {
+			return
+		}
+		newObject, ok := newObj.(runtime.Object)
+		if !ok {
+			return
+		}
+		newMeta, ok := newObj.(metav1.Object)
+		if !ok {
+			return
+		}
+		if oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+			// Periodic resync, nothing changed
+			return
+		}
+		handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Modified, Object: newObject})
+	}
+
+	handler.DeleteFunc = func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		object, ok := obj.(runtime.Object)
+		if !ok {
+			return
+		}
+		handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Deleted, Object: object})
+	}
+
+	rolloutInformers := []cache.SharedIndexInformer{
+		factory.Apps().V1().Deployments().Informer(),
+		factory.Apps().V1().StatefulSets().Informer(),
+		factory.Apps().V1().DaemonSets().Informer(),
+	}
+	status := registerWatcher(ctx, rolloutsWatcherName, getNamespaceLabel(namespace), rolloutInformers...)
+	for _, informer := range rolloutInformers {
+		informer.AddEventHandler(filterWatchedNamespaces(ctx, informer, namespace, status.wrapHandler(handler), nil))
+	}
+
+	return rolloutInformers, nil
+}
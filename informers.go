@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Starts a single shared informer factory that drives all watchers (events,
+// pods, crons) in the given namespace, so every kind of object is listed and
+// watched only once. The informers are stopped when the context is cancelled.
+// For a dynamic namespace selection, the informers of all namespaces skip the
+// namespaces that are not selected.
+func startInformersInNamespace(ctx context.Context, config *rest.Config, namespace string) error {
+	// Attach the "namespace" tag to logger
+	ctx, logger := getLoggerWithTag(ctx, "namespace", getNamespaceLabel(namespace))
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	ctx = setClientsetOnContext(ctx, clientset)
+
+	// No resync: all handlers only react to actual changes
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		clientset,
+		0,
+		informers.WithNamespace(namespace),
+	)
+
+	// Listers have to be requested before the factory is started.
+	// The cluster-scoped listers are shared by all namespaces.
+	listers := &objectListers{}
+	if clusterListers := getListersFromContext(ctx); clusterListers != nil {
+		*listers = *clusterListers
+	}
+	listers.pods = factory.Core().V1().Pods().Lister()
+	listers.replicaSets = factory.Apps().V1().ReplicaSets().Lister()
+	listers.deployments = factory.Apps().V1().Deployments().Lister()
+	listers.statefulSets = factory.Apps().V1().StatefulSets().Lister()
+	listers.daemonSets = factory.Apps().V1().DaemonSets().Lister()
+	listers.jobs = factory.Batch().V1().Jobs().Lister()
+	listers.cronJobs = factory.Batch().V1().CronJobs().Lister()
+	// The informers of all namespaces also run the node watcher, so it
+	// looks up the pods of a node in the pod cache (see startClusterInformers)
+	watchNodes := namespace == v1.NamespaceAll && runsNodeWatcher()
+	if watchNodes {
+		podInformer := factory.Core().V1().Pods().Informer()
+		if err := podInformer.AddIndexers(cache.Indexers{podNodeNameIndex: indexPodByNodeName}); err != nil {
+			return err
+		}
+		listers.podsByNode = podInformer.GetIndexer()
+		listers.nodes = factory.Core().V1().Nodes().Lister()
+	}
+	ctx = setListersOnContext(ctx, listers)
+
+	if _, err := createEventInformer(ctx, factory, namespace); err != nil {
+		return err
+	}
+	if _, err := createPodInformer(ctx, factory, namespace); err != nil {
+		return err
+	}
+	if watchNodes {
+		if _, err := createNodeInformer(ctx, factory); err != nil {
+			return err
+		}
+	}
+	if isTruthy(getConfigValue("SENTRY_K8S_TRACK_RELEASES")) {
+		if _, err := createRolloutInformers(ctx, factory, namespace); err != nil {
+			return err
+		}
+	}
+
+	// create the informers to integrate with sentry crons
+	if isTruthy(getConfigValue("SENTRY_K8S_MONITOR_CRONJOBS")) {
+		cronsInformerData := make(map[string]CronsMonitorData)
+		cronsCtx := context.WithValue(ctx, CronsInformerDataKey{}, &cronsInformerData)
+		logger.Info().Msgf("Enabling CronJob monitoring")
+
+		if _, err := createCronjobInformer(cronsCtx, factory, namespace); err != nil {
+			return err
+		}
+		if _, err := createJobInformer(cronsCtx, factory, namespace); err != nil {
+			return err
+		}
+	} else {
+		logger.Info().Msgf("CronJob monitoring is disabled")
+	}
+
+	factory.Start(ctx.Done())
+
+	for informerType, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("informer for %v failed to sync", informerType)
+		}
+	}
+	logger.Info().Msgf("Informers are synced")
+
+	return nil
+}
+
+// Starts the informers for cluster-scoped objects, and returns the context
+// with their listers attached. For dynamic namespace selections, the
+// namespace informer keeps track of the watched namespaces, which is attached
+// to the context as well.
+func startClusterInformers(ctx context.Context, config *rest.Config, selection *namespaceSelection) (context.Context, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return ctx, err
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+
+	// The namespaces are only cached if the agent lists them anyway,
+	// otherwise they are fetched from the API
+	listers := &objectListers{}
+	if selection.all || !selection.isStatic() {
+		listers.namespaces = factory.Core().V1().Namespaces().Lister()
+	}
+
+	switch {
+	case !isTruthy(getConfigValue("SENTRY_K8S_WATCH_NODES")):
+		globalLogger.Info().Msgf("Node watcher is disabled")
+	case !ownsClusterObjects():
+		globalLogger.Info().Msgf("Node watcher only runs on the first shard")
+	case !selection.watchesAllNamespaces():
+		// No informer caches the pods of all namespaces, so the reports
+		// list the pods of the node from the API. Otherwise the node watcher
+		// runs with the informers of all namespaces.
+		listers.nodes = factory.Core().V1().Nodes().Lister()
+		nodesCtx := setClientsetOnContext(setListersOnContext(ctx, listers), clientset)
+		if _, err := createNodeInformer(nodesCtx, factory); err != nil {
+			return ctx, err
+		}
+	}
+
+	if !selection.isStatic() {
+		watchers := newNamespaceWatchers(selection)
+		namespaceInformer, err := createNamespaceInformer(ctx, factory, watchers)
+		if err != nil {
+			return ctx, err
+		}
+		if selection.shard != nil {
+			selection.shard.onRebalance(func() {
+				for _, obj := range namespaceInformer.GetStore().List() {
+					if namespace, ok := obj.(*v1.Namespace); ok {
+						watchers.sync(ctx, namespace)
+					}
+				}
+			})
+		}
+		ctx = setNamespaceWatchersOnContext(ctx, watchers)
+	}
+
+	factory.Start(ctx.Done())
+
+	for informerType, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return ctx, fmt.Errorf("informer for %v failed to sync", informerType)
+		}
+	}
+
+	return setListersOnContext(ctx, listers), nil
+}
+
+// With sharding, every owned namespace gets its own informers, so a replica
+// only lists and watches the objects of its own namespaces. The informers are
+// started and stopped as the namespaces move between the replicas.
+func startShardInformers(ctx context.Context, config *rest.Config, watchers *namespaceWatchers) {
+	var mu sync.Mutex
+	running := map[string]context.CancelFunc{}
+
+	start := func(ctx context.Context, namespace string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := running[namespace]; ok || !watchers.isWatched(namespace) {
+			return
+		}
+		namespaceCtx, cancel := context.WithCancel(ctx)
+		running[namespace] = cancel
+		go func() {
+			if err := startInformersInNamespace(namespaceCtx, config, namespace); err != nil && namespaceCtx.Err() == nil {
+				_, logger := getLoggerWithTag(ctx, "namespace", namespace)
+				logger.Error().Msgf("Cannot start informers: %s", err)
+			}
+		}()
+	}
+	stop := func(ctx context.Context, namespace string, unselected bool) {
+		mu.Lock()
+		cancel, ok := running[namespace]
+		delete(running, namespace)
+		mu.Unlock()
+		if ok {
+			cancel()
+		}
+	}
+
+	watchers.subscribe(ctx, start, stop)
+	// The namespaces that were synced before
+	for _, namespace := range watchers.namespaces() {
+		start(withClonedHub(ctx), namespace)
+	}
+}
+
+// true -> the node watcher runs on this replica
+func runsNodeWatcher() bool {
+	return isTruthy(getConfigValue("SENTRY_K8S_WATCH_NODES")) && ownsClusterObjects()
+}
+
+func startInformers(ctx context.Context, config *rest.Config, selection *namespaceSelection) error {
+	ctx, err := startClusterInformers(ctx, config, selection)
+	if err != nil {
+		return err
+	}
+
+	if selection.shard != nil {
+		startShardInformers(ctx, config, getNamespaceWatchersFromContext(ctx))
+		return nil
+	}
+
+	namespaces := selection.names
+	if selection.watchesAllNamespaces() {
+		// Dynamic selections watch all namespaces, and skip the objects of
+		// the namespaces that are not selected
+		namespaces = []string{v1.NamespaceAll}
+	}
+
+	for _, namespace := range namespaces {
+		go func(namespace string) {
+			if err := startInformersInNamespace(ctx, config, namespace); err != nil {
+				_, logger := getLoggerWithTag(ctx, "namespace", namespace)
+				logger.Error().Msgf("Cannot start informers: %s", err)
+			}
+		}(namespace)
+	}
+	return nil
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog"
@@ -110,7 +109,7 @@ func readGoogleMetadata(url string, output interface{}) error {
 }
 
 func (igke *IntegrationGKE) IsEnabled() bool {
-	return isTruthy(os.Getenv("SENTRY_K8S_INTEGRATION_GKE_ENABLED"))
+	return isTruthy(getConfigValue("SENTRY_K8S_INTEGRATION_GKE_ENABLED"))
 }
 
 func (igke *IntegrationGKE) IsInitialized() bool {
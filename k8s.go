@@ -2,11 +2,12 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"path"
 	"strings"
 
 	globalLogger "github.com/rs/zerolog/log"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/validation"
 	k8sVersion "k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/discovery"
@@ -17,39 +18,131 @@ var defaultNamespacesToWatch = []string{v1.NamespaceDefault}
 
 const allNamespacesLabel = "__all__"
 
-func getNamespacesToWatch() (watchAll bool, namespaces []string, err error) {
-	watchNamespacesRaw := strings.TrimSpace(os.Getenv("SENTRY_K8S_WATCH_NAMESPACES"))
-
-	// Nothing in the env variable => use the default value
-	if watchNamespacesRaw == "" {
-		return false, defaultNamespacesToWatch, nil
+func getNamespaceLabel(namespace string) string {
+	if namespace == v1.NamespaceAll {
+		return allNamespacesLabel
 	}
+	return namespace
+}
 
-	// Special label => watch all namespaces
-	if watchNamespacesRaw == allNamespacesLabel {
-		return true, []string{}, nil
-	}
+// Namespaces are selected by names and globs, by a label selector, or both,
+// minus the excluded ones
+type namespaceSelection struct {
+	all      bool
+	names    []string
+	patterns []string
+	// nil if not set
+	selector labels.Selector
+	exclude  []string
+	// nil if sharding is disabled
+	shard *shardAssignment
+}
 
-	rawNamespaces := strings.Split(watchNamespacesRaw, ",")
-	namespaces = make([]string, 0, len(rawNamespaces))
-	for _, rawNamespace := range rawNamespaces {
+func isNamespacePattern(value string) bool {
+	return strings.ContainsAny(value, "*?[")
+}
+
+func parseNamespaceList(raw string, allowPatterns bool) ([]string, []string, error) {
+	names := []string{}
+	patterns := []string{}
+	for _, rawNamespace := range strings.Split(raw, ",") {
 		namespace := strings.TrimSpace(rawNamespace)
 		if namespace == "" {
 			continue
 		}
+		if allowPatterns && isNamespacePattern(namespace) {
+			if _, err := path.Match(namespace, ""); err != nil {
+				return nil, nil, fmt.Errorf("invalid namespace pattern %q: %v", namespace, err)
+			}
+			patterns = append(patterns, namespace)
+			continue
+		}
 		errors := validation.IsValidLabelValue(namespace)
 		if len(errors) != 0 {
 			// Not a valid namespace name
-			return false, []string{}, fmt.Errorf(errors[0])
+			return nil, nil, fmt.Errorf(errors[0])
+		}
+		names = append(names, namespace)
+	}
+	return removeDuplicates(names), removeDuplicates(patterns), nil
+}
+
+func getNamespaceSelection() (*namespaceSelection, error) {
+	selection := &namespaceSelection{}
+
+	if rawSelector := strings.TrimSpace(getConfigValue("SENTRY_K8S_WATCH_NAMESPACES_SELECTOR")); rawSelector != "" {
+		selector, err := labels.Parse(rawSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %v", err)
+		}
+		selection.selector = selector
+	}
+
+	excludeNames, excludePatterns, err := parseNamespaceList(getConfigValue("SENTRY_K8S_EXCLUDE_NAMESPACES"), true)
+	if err != nil {
+		return nil, err
+	}
+	selection.exclude = append(excludeNames, excludePatterns...)
+
+	watchNamespacesRaw := strings.TrimSpace(getConfigValue("SENTRY_K8S_WATCH_NAMESPACES"))
+	switch {
+	case watchNamespacesRaw == allNamespacesLabel:
+		// Special label => watch all namespaces
+		selection.all = true
+	case watchNamespacesRaw == "" && selection.selector != nil:
+		// Only the selector => all namespaces it matches
+		selection.all = true
+	case watchNamespacesRaw == "":
+		// Nothing in the env variable => use the default value
+		selection.names = defaultNamespacesToWatch
+	default:
+		selection.names, selection.patterns, err = parseNamespaceList(watchNamespacesRaw, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(selection.names) == 0 && len(selection.patterns) == 0 {
+			return nil, fmt.Errorf("no namespaces specified")
 		}
-		namespaces = append(namespaces, namespace)
 	}
-	namespaces = removeDuplicates(namespaces)
-	if len(namespaces) == 0 {
-		return false, namespaces, fmt.Errorf("no namespaces specified")
+	return selection, nil
+}
+
+// Static selections are watched with a fixed set of informers, all others
+// follow the namespaces as they are created, relabelled and deleted
+func (s *namespaceSelection) isStatic() bool {
+	return len(s.patterns) == 0 && s.selector == nil && len(s.exclude) == 0 && s.shard == nil
+}
+
+// true -> a single set of informers watches all namespaces
+func (s *namespaceSelection) watchesAllNamespaces() bool {
+	return s.shard == nil && (s.all || !s.isStatic())
+}
+
+// true -> the namespace is watched by this replica
+func (s *namespaceSelection) matches(namespace *v1.Namespace) bool {
+	if s.shard != nil && !s.shard.owns(namespace.Name) {
+		return false
 	}
+	return s.selects(namespace)
+}
 
-	return false, namespaces, nil
+// true -> the namespace is watched by one of the replicas
+func (s *namespaceSelection) selects(namespace *v1.Namespace) bool {
+	if matchesAnyPattern(s.exclude, namespace.Name) {
+		return false
+	}
+	if s.selector != nil && !s.selector.Matches(labels.Set(namespace.Labels)) {
+		return false
+	}
+	if s.all {
+		return true
+	}
+	for _, name := range s.names {
+		if name == namespace.Name {
+			return true
+		}
+	}
+	return matchesAnyPattern(s.patterns, namespace.Name)
 }
 
 func getClusterVersion(config *rest.Config) (*k8sVersion.Info, error) {
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const defaultLeaseName = "sentry-kubernetes"
+
+const defaultLeaseDuration = 15 * time.Second
+const minLeaseDuration = 2 * time.Second
+
+type leaderElectionConfig struct {
+	leaseName      string
+	leaseNamespace string
+	identity       string
+	// How long the followers wait before taking over an expired lease
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+func newLeaderElectionConfig() (*leaderElectionConfig, error) {
+	config := &leaderElectionConfig{
+		leaseName:      strings.TrimSpace(getConfigValue("SENTRY_K8S_LEADER_ELECTION_LEASE_NAME")),
+		leaseNamespace: strings.TrimSpace(getConfigValue("SENTRY_K8S_LEADER_ELECTION_NAMESPACE")),
+		leaseDuration:  defaultLeaseDuration,
+	}
+	if config.leaseName == "" {
+		config.leaseName = defaultLeaseName
+	}
+	if config.leaseNamespace == "" {
+		config.leaseNamespace = getAgentNamespace()
+	}
+
+	leaseDuration, err := parseDurationSetting("SENTRY_K8S_LEADER_ELECTION_LEASE_DURATION", defaultLeaseDuration, minLeaseDuration)
+	if err != nil {
+		return nil, err
+	}
+	config.leaseDuration = leaseDuration
+	// Same ratios as the defaults of Kubernetes controllers (15s/10s/2s)
+	config.renewDeadline = config.leaseDuration * 2 / 3
+	config.retryPeriod = config.leaseDuration / 7
+
+	// The hostname is the pod name
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	config.identity = hostname
+	return config, nil
+}
+
+type leaderCallback struct {
+	ctx context.Context
+	fn  func(ctx context.Context, since time.Time)
+}
+
+// Remembers the last renewal of the lease by other replicas, i.e. the last
+// moment the previous leader was known to report
+type observingLeaseLock struct {
+	resourcelock.Interface
+
+	mu                sync.Mutex
+	lastOtherRenewing time.Time
+}
+
+func (l *observingLeaseLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	record, raw, err := l.Interface.Get(ctx)
+	if err == nil && record != nil && record.HolderIdentity != l.Identity() {
+		l.mu.Lock()
+		l.lastOtherRenewing = record.RenewTime.Time
+		l.mu.Unlock()
+	}
+	return record, raw, err
+}
+
+func (l *observingLeaseLock) lastOtherRenewTime() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastOtherRenewing
+}
+
+// Runs the election, and keeps track of whether this replica is the leader
+type leaderElector struct {
+	config    *leaderElectionConfig
+	clientset kubernetes.Interface
+	leading   atomic.Bool
+
+	mu sync.Mutex
+	// Called every time the leadership is acquired
+	callbacks []leaderCallback
+	// When this replica lost the leadership the last time
+	stoppedLeadingAt time.Time
+
+	// Closed when the election is stopped and the lease is released
+	stopped chan struct{}
+}
+
+// nil if leader election is disabled
+var agentLeaderElector *leaderElector
+
+func newLeaderElector(config *leaderElectionConfig, clientset kubernetes.Interface) *leaderElector {
+	return &leaderElector{config: config, clientset: clientset, stopped: make(chan struct{})}
+}
+
+// Returns false if the election is still running after the timeout
+func (e *leaderElector) waitStopped(timeout time.Duration) bool {
+	select {
+	case <-e.stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (e *leaderElector) isLeading() bool {
+	return e.leading.Load()
+}
+
+func (e *leaderElector) onStartedLeading(ctx context.Context, fn func(ctx context.Context, since time.Time)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.callbacks = append(e.callbacks, leaderCallback{ctx: ctx, fn: fn})
+}
+
+// since is the moment nobody might have reported anymore: the last renewal
+// of the lease by the previous leader, or the moment this replica lost the
+// leadership
+func (e *leaderElector) runCallbacks(since time.Time) {
+	e.mu.Lock()
+	if e.stoppedLeadingAt.After(since) {
+		since = e.stoppedLeadingAt
+	}
+	// Drop the callbacks of stopped watchers
+	callbacks := make([]leaderCallback, 0, len(e.callbacks))
+	for _, callback := range e.callbacks {
+		if callback.ctx.Err() == nil {
+			callbacks = append(callbacks, callback)
+		}
+	}
+	e.callbacks = callbacks
+	e.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback.fn(callback.ctx, since)
+	}
+}
+
+// Takes part in the election until the context is cancelled. A replica that
+// loses the leadership becomes a follower and keeps running.
+func (e *leaderElector) run(ctx context.Context) error {
+	ctx, logger := getLoggerWithTag(ctx, "leader_election", e.config.identity)
+
+	lock := &observingLeaseLock{Interface: &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.config.leaseName,
+			Namespace: e.config.leaseNamespace,
+		},
+		Client: e.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: e.config.identity,
+		},
+	}}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   e.config.leaseDuration,
+		RenewDeadline:   e.config.renewDeadline,
+		RetryPeriod:     e.config.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            e.config.leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				logger.Info().Msgf("Became the leader, starting to report")
+				e.leading.Store(true)
+				e.runCallbacks(lock.lastOtherRenewTime())
+			},
+			OnStoppedLeading: func() {
+				if e.leading.Swap(false) {
+					logger.Warn().Msgf("Lost the leadership, stopping to report")
+					e.mu.Lock()
+					e.stoppedLeadingAt = time.Now()
+					e.mu.Unlock()
+				}
+			},
+			OnNewLeader: func(identity string) {
+				if identity != e.config.identity {
+					logger.Info().Msgf("The current leader is %q", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	defer close(e.stopped)
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// true -> this replica reports events. Always true if leader election is
+// disabled.
+func isLeader() bool {
+	return agentLeaderElector == nil || agentLeaderElector.isLeading()
+}
+
+// Registers a function that is called when this replica becomes the leader,
+// until the context is cancelled. The function should report what changed
+// since the given time, when the previous leader might have stopped reporting.
+func onLeadershipAcquired(ctx context.Context, fn func(ctx context.Context, since time.Time)) {
+	if agentLeaderElector == nil {
+		return
+	}
+	agentLeaderElector.onStartedLeading(ctx, fn)
+}
+
+// Must be called before the informers are started, so followers never report
+func startLeaderElection(ctx context.Context, config *rest.Config) error {
+	if !isTruthy(getConfigValue("SENTRY_K8S_LEADER_ELECTION")) {
+		globalLogger.Info().Msgf("Leader election is disabled")
+		return nil
+	}
+
+	electionConfig, err := newLeaderElectionConfig()
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	agentLeaderElector = newLeaderElector(electionConfig, clientset)
+	globalLogger.Info().Msgf(
+		"Leader election is enabled, lease: %s/%s, identity: %q",
+		electionConfig.leaseNamespace, electionConfig.leaseName, electionConfig.identity,
+	)
+	go func() {
+		if err := agentLeaderElector.run(ctx); err != nil {
+			zerolog.Ctx(ctx).Fatal().Msgf("Cannot run leader election: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLeaderElector(clientset *fake.Clientset, identity string) *leaderElector {
+	return newLeaderElector(&leaderElectionConfig{
+		leaseName:      "TestLeaderElectionLease",
+		leaseNamespace: "TestLeaderElectionNamespace",
+		identity:       identity,
+		leaseDuration:  2 * time.Second,
+		renewDeadline:  time.Second,
+		retryPeriod:    100 * time.Millisecond,
+	}, clientset)
+}
+
+func waitForLeader(t *testing.T, elector *leaderElector) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !elector.isLeading() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not become the leader", elector.config.identity)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// test that only one replica leads, and the follower takes over when the
+// leader stops
+func TestLeaderElection(t *testing.T) {
+
+	clientset := fake.NewSimpleClientset()
+	first := newTestLeaderElector(clientset, "first")
+	second := newTestLeaderElector(clientset, "second")
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	defer stopFirst()
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+
+	firstStopped := make(chan struct{})
+	go func() {
+		first.run(firstCtx)
+		close(firstStopped)
+	}()
+	waitForLeader(t, first)
+
+	acquired := make(chan time.Time, 1)
+	second.onStartedLeading(secondCtx, func(ctx context.Context, since time.Time) {
+		acquired <- since
+	})
+	go second.run(secondCtx)
+
+	// The lease is held by the first replica
+	time.Sleep(300 * time.Millisecond)
+	if second.isLeading() {
+		t.Fatalf("both replicas are leading")
+	}
+	if len(acquired) != 0 {
+		t.Fatalf("callback was called for a follower")
+	}
+
+	// The lease is released on shutdown
+	beforeRelease := time.Now().Truncate(time.Second)
+	stopFirst()
+	<-firstStopped
+	if first.isLeading() {
+		t.Errorf("stopped replica is still leading")
+	}
+	waitForLeader(t, second)
+	select {
+	case since := <-acquired:
+		// Nobody reported since the first replica released the lease
+		if since.Before(beforeRelease) || since.After(time.Now()) {
+			t.Errorf("received since %s, wanted the release time of the lease", since)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("callback was not called after taking over")
+	}
+
+	lease, err := clientset.CoordinationV1().Leases("TestLeaderElectionNamespace").Get(context.Background(), "TestLeaderElectionLease", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "second" {
+		t.Errorf("lease is held by %v, wanted %q", lease.Spec.HolderIdentity, "second")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	batchv1listers "k8s.io/client-go/listers/batch/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const podNodeNameIndex = "spec.nodeName"
+
+func indexPodByNodeName(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Spec.NodeName == "" {
+		return nil, nil
+	}
+	return []string{pod.Spec.NodeName}, nil
+}
+
+// Listers backed by the shared informer caches.
+// Note: only the listers of informers that were registered before the
+// factory was started can be used here, otherwise their caches stay empty.
+type objectListers struct {
+	// Cluster-scoped
+	namespaces corev1listers.NamespaceLister
+	nodes      corev1listers.NodeLister
+	// The pods of all namespaces, indexed by node name. Only set if the
+	// node watcher is running.
+	podsByNode cache.Indexer
+
+	// Namespace-scoped
+	pods         corev1listers.PodLister
+	replicaSets  appsv1listers.ReplicaSetLister
+	deployments  appsv1listers.DeploymentLister
+	statefulSets appsv1listers.StatefulSetLister
+	daemonSets   appsv1listers.DaemonSetLister
+	jobs         batchv1listers.JobLister
+	cronJobs     batchv1listers.CronJobLister
+}
+
+// Returned by the cache lookups if the lister is not available
+var errNoLister = errors.New("no lister available")
+
+// Fetches an object from the informer cache if its lister is available, and
+// from the API otherwise. The informer knows about every existing object, so
+// a NotFound from the cache is returned as is. Objects returned from the
+// cache must not be modified.
+func getObject[T any](
+	ctx context.Context,
+	fromCache func(listers *objectListers) (T, error),
+	fromAPI func(clientset kubernetes.Interface) (T, error),
+) (T, error) {
+	if listers := getListersFromContext(ctx); listers != nil {
+		object, err := fromCache(listers)
+		if !errors.Is(err, errNoLister) {
+			return object, err
+		}
+	}
+
+	clientset, err := getClientsetFromContext(ctx)
+	if err != nil {
+		var empty T
+		return empty, err
+	}
+	return fromAPI(clientset)
+}
+
+func getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	return getObject(ctx, func(listers *objectListers) (*v1.Namespace, error) {
+		if listers.namespaces == nil {
+			return nil, errNoLister
+		}
+		return listers.namespaces.Get(name)
+	}, func(clientset kubernetes.Interface) (*v1.Namespace, error) {
+		return clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getNode(ctx context.Context, name string) (*v1.Node, error) {
+	return getObject(ctx, func(listers *objectListers) (*v1.Node, error) {
+		if listers.nodes == nil {
+			return nil, errNoLister
+		}
+		return listers.nodes.Get(name)
+	}, func(clientset kubernetes.Interface) (*v1.Node, error) {
+		return clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getPod(ctx context.Context, namespace string, name string) (*v1.Pod, error) {
+	return getObject(ctx, func(listers *objectListers) (*v1.Pod, error) {
+		if listers.pods == nil {
+			return nil, errNoLister
+		}
+		return listers.pods.Pods(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*v1.Pod, error) {
+		return clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getReplicaSet(ctx context.Context, namespace string, name string) (*appsv1.ReplicaSet, error) {
+	return getObject(ctx, func(listers *objectListers) (*appsv1.ReplicaSet, error) {
+		if listers.replicaSets == nil {
+			return nil, errNoLister
+		}
+		return listers.replicaSets.ReplicaSets(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*appsv1.ReplicaSet, error) {
+		return clientset.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getDeployment(ctx context.Context, namespace string, name string) (*appsv1.Deployment, error) {
+	return getObject(ctx, func(listers *objectListers) (*appsv1.Deployment, error) {
+		if listers.deployments == nil {
+			return nil, errNoLister
+		}
+		return listers.deployments.Deployments(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*appsv1.Deployment, error) {
+		return clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getStatefulSet(ctx context.Context, namespace string, name string) (*appsv1.StatefulSet, error) {
+	return getObject(ctx, func(listers *objectListers) (*appsv1.StatefulSet, error) {
+		if listers.statefulSets == nil {
+			return nil, errNoLister
+		}
+		return listers.statefulSets.StatefulSets(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*appsv1.StatefulSet, error) {
+		return clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getDaemonSet(ctx context.Context, namespace string, name string) (*appsv1.DaemonSet, error) {
+	return getObject(ctx, func(listers *objectListers) (*appsv1.DaemonSet, error) {
+		if listers.daemonSets == nil {
+			return nil, errNoLister
+		}
+		return listers.daemonSets.DaemonSets(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*appsv1.DaemonSet, error) {
+		return clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getJob(ctx context.Context, namespace string, name string) (*batchv1.Job, error) {
+	return getObject(ctx, func(listers *objectListers) (*batchv1.Job, error) {
+		if listers.jobs == nil {
+			return nil, errNoLister
+		}
+		return listers.jobs.Jobs(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*batchv1.Job, error) {
+		return clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+func getCronJob(ctx context.Context, namespace string, name string) (*batchv1.CronJob, error) {
+	return getObject(ctx, func(listers *objectListers) (*batchv1.CronJob, error) {
+		if listers.cronJobs == nil {
+			return nil, errNoLister
+		}
+		return listers.cronJobs.CronJobs(namespace).Get(name)
+	}, func(clientset kubernetes.Interface) (*batchv1.CronJob, error) {
+		return clientset.BatchV1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	})
+}
+
+// The pods scheduled on the node, in all namespaces
+func getPodsOnNode(ctx context.Context, nodeName string) ([]*v1.Pod, error) {
+	return getObject(ctx, func(listers *objectListers) ([]*v1.Pod, error) {
+		if listers.podsByNode == nil {
+			return nil, errNoLister
+		}
+		objects, err := listers.podsByNode.ByIndex(podNodeNameIndex, nodeName)
+		if err != nil {
+			return nil, err
+		}
+		pods := make([]*v1.Pod, 0, len(objects))
+		for _, obj := range objects {
+			if pod, ok := obj.(*v1.Pod); ok {
+				pods = append(pods, pod)
+			}
+		}
+		return pods, nil
+	}, func(clientset kubernetes.Interface) ([]*v1.Pod, error) {
+		podList, err := clientset.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		pods := make([]*v1.Pod, 0, len(podList.Items))
+		for i := range podList.Items {
+			pods = append(pods, &podList.Items[i])
+		}
+		return pods, nil
+	})
+}
@@ -3,44 +3,66 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog"
 	globalLogger "github.com/rs/zerolog/log"
-	v1 "k8s.io/api/core/v1"
 )
 
-func configureLogging() {
-	levelMap := map[string]zerolog.Level{
-		"trace":    zerolog.TraceLevel,
-		"debug":    zerolog.DebugLevel,
-		"info":     zerolog.InfoLevel,
-		"warn":     zerolog.WarnLevel,
-		"error":    zerolog.ErrorLevel,
-		"fatal":    zerolog.FatalLevel,
-		"panic":    zerolog.PanicLevel,
-		"disabled": zerolog.Disabled,
-	}
-	logLevelRaw := strings.ToLower(os.Getenv("SENTRY_K8S_LOG_LEVEL"))
+var logLevels = map[string]zerolog.Level{
+	"trace":    zerolog.TraceLevel,
+	"debug":    zerolog.DebugLevel,
+	"info":     zerolog.InfoLevel,
+	"warn":     zerolog.WarnLevel,
+	"error":    zerolog.ErrorLevel,
+	"fatal":    zerolog.FatalLevel,
+	"panic":    zerolog.PanicLevel,
+	"disabled": zerolog.Disabled,
+}
+
+func configureLogLevel() {
+	logLevelRaw := strings.ToLower(getConfigValue("SENTRY_K8S_LOG_LEVEL"))
 
 	var logLevel zerolog.Level
-	logLevel, ok := levelMap[logLevelRaw]
+	logLevel, ok := logLevels[logLevelRaw]
 	if !ok {
 		logLevel = zerolog.InfoLevel
 	}
 
 	zerolog.SetGlobalLevel(logLevel)
+}
+
+func configureLogging() {
+	configureLogLevel()
 	globalLogger.Logger = globalLogger.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 }
 
 func main() {
 	configureLogging()
+	rawConfig, err := loadConfigFile()
+	if err != nil {
+		globalLogger.Fatal().Msgf("Cannot load the configuration file: %s", err)
+	}
+	if err := validateConfig(); err != nil {
+		globalLogger.Fatal().Msgf("Invalid configuration: %s", err)
+	}
 	initSentrySDK()
-	defer sentry.Flush(time.Second)
 	checkCommonEnhancerPatterns()
-	prepareEventFilters()
+	prepareContainerTracker()
+	// Filters, rules, routes and release settings are reloaded when the
+	// configuration file changes
+	if err := prepareReloadableConfig(); err != nil {
+		globalLogger.Fatal().Msgf("Invalid configuration: %s", err)
+	}
+
+	apiClient, err := newSentryAPIClientFromEnv()
+	if err != nil {
+		globalLogger.Fatal().Msgf("Cannot configure the Sentry API client: %s", err)
+	}
 
 	config, err := getClusterConfig()
 	if err != nil {
@@ -51,19 +73,101 @@ func main() {
 	setGlobalSentryTags()
 	runIntegrations()
 
-	watchAllNamespaces, namespaces, err := getNamespacesToWatch()
+	namespaceSelection, err := getNamespaceSelection()
 	if err != nil {
 		globalLogger.Fatal().Msgf("Cannot parse namespaces to watch: %s", err)
 	}
 
-	if watchAllNamespaces {
-		namespaces = []string{v1.NamespaceAll}
+	// Cancelled on SIGTERM/SIGINT, stops all watchers and informers
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx = globalLogger.Logger.WithContext(ctx)
+	ctx = setSentryAPIClientOnContext(ctx, apiClient)
+	startStatusServer(ctx)
+	if err := startLeaderElection(ctx, config); err != nil {
+		globalLogger.Fatal().Msgf("Cannot start leader election: %s", err)
 	}
+	namespaceSelection.shard, err = startSharding(ctx, config)
+	if err != nil {
+		globalLogger.Fatal().Msgf("Cannot start sharding: %s", err)
+	}
+	if err := startInformers(ctx, config, namespaceSelection); err != nil {
+		globalLogger.Fatal().Msgf("Cannot start informers: %s", err)
+	}
+	go watchConfigFile(ctx, rawConfig)
+
+	<-ctx.Done()
+	stop()
+	shutdown()
+}
 
-	ctx := globalLogger.Logger.WithContext(context.Background())
-	startEventWatchers(ctx, config, namespaces)
-	startPodWatchers(ctx, config, namespaces)
+func shutdown() {
+	globalLogger.Info().Msgf("Shutting down")
+	timeout := getFlushTimeout()
+	deadline := time.Now().Add(timeout)
+	// The flush gets at least half of the timeout
+	flushStart := time.Now().Add(timeout / 2)
 
-	// Sleep forever
-	select {}
+	// Wait for the events that are being processed, new ones are dropped
+	inFlightEvents.stop()
+	if !inFlightEvents.wait(time.Until(flushStart)) {
+		globalLogger.Warn().Msgf("Timed out waiting for the events that are being processed")
+	}
+
+	// Followers can take over right away
+	if agentLeaderElector != nil && !agentLeaderElector.waitStopped(time.Until(flushStart)) {
+		globalLogger.Warn().Msgf("Timed out waiting for the leader lease to be released")
+	}
+
+	if !flushSentry(time.Until(deadline)) {
+		globalLogger.Warn().Msgf("Timed out flushing the events to Sentry")
+	}
+	globalLogger.Info().Msgf("Stopped")
+}
+
+// Counts the events that are being processed, so the shutdown can wait for
+// them before flushing
+type inFlightTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+var inFlightEvents = &inFlightTracker{}
+
+// Returns false once the shutdown started, the event should be dropped then.
+// Otherwise, done has to be called when the event is processed.
+func (t *inFlightTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *inFlightTracker) done() {
+	t.wg.Done()
+}
+
+func (t *inFlightTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+}
+
+// Returns false if the events are not processed within the timeout
+func (t *inFlightTracker) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotations that let workload owners control the reporting. They can be
+// set on pods, their top-level owner (e.g. a Deployment) and namespaces;
+// the most specific annotation wins.
+const (
+	ignoreAnnotation        = "sentry.io/ignore"
+	levelAnnotation         = "sentry.io/level"
+	fingerprintAnnotation   = "sentry.io/fingerprint"
+	tagsAnnotation          = "sentry.io/tags"
+	ignoreReasonsAnnotation = "sentry.io/ignore-reasons"
+)
+
+type annotationOverrides struct {
+	ignore        bool
+	level         sentry.Level
+	fingerprint   []string
+	tags          map[string]string
+	ignoreReasons []string
+	// See podLogsAnnotation
+	attachLogs bool
+}
+
+func splitAnnotationList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Parses "key1=value1,key2=value2"
+func parseTagsAnnotation(value string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, item := range splitAnnotationList(value) {
+		key, tagValue, found := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid tag %q", item)
+		}
+		tags[key] = strings.TrimSpace(tagValue)
+	}
+	return tags, nil
+}
+
+// The annotations are ordered from the least to the most specific object.
+// Invalid values are logged and ignored, so a typo doesn't stop the reporting.
+func parseAnnotationOverrides(ctx context.Context, annotationSets ...map[string]string) *annotationOverrides {
+	logger := zerolog.Ctx(ctx)
+
+	overrides := &annotationOverrides{tags: map[string]string{}}
+	for _, annotations := range annotationSets {
+		if value, found := annotations[ignoreAnnotation]; found {
+			ignore, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				logger.Warn().Msgf("Invalid %s annotation: %q", ignoreAnnotation, value)
+			} else {
+				overrides.ignore = ignore
+			}
+		}
+		if value, found := annotations[levelAnnotation]; found {
+			level, err := parseLevel(value)
+			if err != nil {
+				logger.Warn().Msgf("Invalid %s annotation: %v", levelAnnotation, err)
+			} else {
+				overrides.level = level
+			}
+		}
+		if value, found := annotations[fingerprintAnnotation]; found {
+			overrides.fingerprint = splitAnnotationList(value)
+		}
+		if value, found := annotations[tagsAnnotation]; found {
+			tags, err := parseTagsAnnotation(value)
+			if err != nil {
+				logger.Warn().Msgf("Invalid %s annotation: %v", tagsAnnotation, err)
+			}
+			for key, tagValue := range tags {
+				overrides.tags[key] = tagValue
+			}
+		}
+		if value, found := annotations[ignoreReasonsAnnotation]; found {
+			overrides.ignoreReasons = splitAnnotationList(value)
+		}
+		if value, found := annotations[podLogsAnnotation]; found {
+			overrides.attachLogs = isTruthy(value)
+		}
+	}
+	return overrides
+}
+
+func (o *annotationOverrides) isReasonIgnored(reason string) bool {
+	for _, ignoredReason := range o.ignoreReasons {
+		if strings.EqualFold(ignoredReason, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if events with the given reason shouldn't be reported
+func (o *annotationOverrides) isIgnored(reason string) bool {
+	return o.ignore || (reason != "" && o.isReasonIgnored(reason))
+}
+
+// Fetches the object at most once, so the filter rules, the annotation
+// overrides and the enhancers of an event share one lookup
+type objectLookup struct {
+	ctx       context.Context
+	objectRef *v1.ObjectReference
+	object    metav1.Object
+	fetched   bool
+}
+
+func newObjectLookup(ctx context.Context, objectRef *v1.ObjectReference) *objectLookup {
+	return &objectLookup{ctx: ctx, objectRef: objectRef}
+}
+
+// Returns nil if the object cannot be fetched
+func (l *objectLookup) get() metav1.Object {
+	if !l.fetched {
+		l.fetched = true
+		object, err := getAnnotatedObject(l.ctx, l.objectRef.Kind, l.objectRef.Namespace, l.objectRef.Name, nil)
+		if err != nil {
+			zerolog.Ctx(l.ctx).Debug().Msgf("Cannot fetch %s %q: %v", l.objectRef.Kind, l.objectRef.Name, err)
+		}
+		l.object = object
+	}
+	return l.object
+}
+
+// Fetches the metadata of objects that can carry the annotations. The cached
+// object can also be an objectLookup.
+func getAnnotatedObject(ctx context.Context, kind string, namespace string, name string, cachedObject interface{}) (metav1.Object, error) {
+	if lookup, ok := cachedObject.(*objectLookup); ok {
+		return lookup.get(), nil
+	}
+	if object, ok := cachedObject.(metav1.Object); ok && object != nil {
+		return object, nil
+	}
+	var object metav1.Object
+	var err error
+	switch kind {
+	case "Pod":
+		object, err = getPod(ctx, namespace, name)
+	case "ReplicaSet":
+		object, err = getReplicaSet(ctx, namespace, name)
+	case "Deployment":
+		object, err = getDeployment(ctx, namespace, name)
+	case "StatefulSet":
+		object, err = getStatefulSet(ctx, namespace, name)
+	case "DaemonSet":
+		object, err = getDaemonSet(ctx, namespace, name)
+	case "Job":
+		object, err = getJob(ctx, namespace, name)
+	case "CronJob":
+		object, err = getCronJob(ctx, namespace, name)
+	default:
+		return nil, nil
+	}
+	// Don't return typed nil pointers
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// Collects the overrides of the object, its top-level owner and its
+// namespace. Objects that cannot be fetched are skipped.
+func getAnnotationOverrides(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}) *annotationOverrides {
+	logger := zerolog.Ctx(ctx)
+
+	annotationSets := []map[string]string{}
+
+	if objectRef.Namespace != "" {
+		namespace, err := getNamespace(ctx, objectRef.Namespace)
+		if err != nil {
+			logger.Debug().Msgf("Cannot fetch namespace %q: %v", objectRef.Namespace, err)
+		} else {
+			annotationSets = append(annotationSets, namespace.Annotations)
+		}
+	}
+
+	object, err := getAnnotatedObject(ctx, objectRef.Kind, objectRef.Namespace, objectRef.Name, cachedObject)
+	if err != nil {
+		logger.Debug().Msgf("Cannot fetch the object for annotation overrides: %v", err)
+	}
+	if object != nil {
+		workload, err := podOwnerResolver.resolve(ctx, object)
+		if err != nil {
+			logger.Debug().Msgf("Cannot resolve the owner for annotation overrides: %v", err)
+		}
+		if workload != nil {
+			owner, err := getAnnotatedObject(ctx, workload.Kind, object.GetNamespace(), workload.Name, nil)
+			if err != nil {
+				logger.Debug().Msgf("Cannot fetch the owner for annotation overrides: %v", err)
+			}
+			if owner != nil {
+				annotationSets = append(annotationSets, owner.GetAnnotations())
+			}
+		}
+		annotationSets = append(annotationSets, object.GetAnnotations())
+	}
+
+	return parseAnnotationOverrides(ctx, annotationSets...)
+}
+
+// Applies the level, fingerprint and tags overrides; runs after the
+// built-in enhancers, so the annotations have the last word
+func runOverridesEnhancer(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+	overrides := getAnnotationOverrides(ctx, objectRef, cachedObject)
+
+	if overrides.level != "" {
+		sentryEvent.Level = overrides.level
+	}
+	if len(overrides.fingerprint) > 0 {
+		sentryEvent.Fingerprint = overrides.fingerprint
+	}
+	for key, value := range overrides.tags {
+		setTagIfNotEmpty(scope, key, value)
+	}
+	return nil
+}
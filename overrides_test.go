@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// test that the annotations of the pod, its top-level owner and its
+// namespace are merged, and the most specific one wins
+func TestRunOverridesEnhancer(t *testing.T) {
+
+	isController := true
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "TestOverridesNamespace",
+			Annotations: map[string]string{
+				levelAnnotation: "warning",
+				tagsAnnotation:  "team=payments, tier=backend",
+			},
+		},
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: namespace.Name,
+			UID:       "TestOverridesDeploymentUID",
+			Annotations: map[string]string{
+				fingerprintAnnotation: "web, {{ default }}",
+				tagsAnnotation:        "tier=frontend",
+			},
+		},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d4f8",
+			Namespace: namespace.Name,
+			UID:       "TestOverridesReplicaSetUID",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Deployment", Name: deployment.Name, UID: deployment.UID, Controller: &isController},
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-5d4f8-x2k9q",
+			Namespace: namespace.Name,
+			Annotations: map[string]string{
+				levelAnnotation:         "info",
+				ignoreReasonsAnnotation: "OOMKilled",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: replicaSet.Name, UID: replicaSet.UID, Controller: &isController},
+			},
+		},
+	}
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(namespace, deployment, replicaSet, pod))
+
+	objectRef := &corev1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: pod.Namespace}
+	scope := sentry.NewScope()
+	sentryEvent := &sentry.Event{Level: sentry.LevelError, Fingerprint: []string{"original"}}
+	if err := runOverridesEnhancer(ctx, objectRef, nil, scope, sentryEvent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if sentryEvent.Level != sentry.LevelInfo {
+		t.Errorf("received level %q, wanted %q", sentryEvent.Level, sentry.LevelInfo)
+	}
+	expectedFingerprint := []string{"web", "{{ default }}"}
+	if !reflect.DeepEqual(sentryEvent.Fingerprint, expectedFingerprint) {
+		t.Errorf("received fingerprint %v, wanted %v", sentryEvent.Fingerprint, expectedFingerprint)
+	}
+	scope.ApplyToEvent(sentryEvent, nil)
+	expectedTags := map[string]string{"team": "payments", "tier": "frontend"}
+	if !reflect.DeepEqual(sentryEvent.Tags, expectedTags) {
+		t.Errorf("received tags %v, wanted %v", sentryEvent.Tags, expectedTags)
+	}
+
+	overrides := getAnnotationOverrides(ctx, objectRef, nil)
+	if overrides.isIgnored("Error") || !overrides.isIgnored("OOMKilled") {
+		t.Errorf("wrong ignored reasons: %v", overrides.ignoreReasons)
+	}
+
+	// The namespace-wide ignore is overridden by the pod
+	namespace.Annotations[ignoreAnnotation] = "true"
+	pod.Annotations[ignoreAnnotation] = "false"
+	overrides = parseAnnotationOverrides(ctx, namespace.Annotations, pod.Annotations)
+	if overrides.isIgnored("") {
+		t.Errorf("pod is ignored, but the pod annotation should win")
+	}
+}
+
+// test that the filter rules and the annotation overrides of an event share
+// one lookup of the involved object
+func TestObjectLookup(t *testing.T) {
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "TestObjectLookupPod",
+			Namespace:   "TestObjectLookupNamespace",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{ignoreReasonsAnnotation: "BackOff"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(pod)
+	ctx := setClientsetOnContext(context.Background(), clientset)
+
+	event := &corev1.Event{
+		Reason:         "BackOff",
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: pod.Namespace},
+	}
+	lookup := newObjectLookup(ctx, &event.InvolvedObject)
+	if labels := newFilterInputFromEvent(event, lookup).getLabels(); labels["app"] != "web" {
+		t.Errorf("received labels %v, wanted the pod labels", labels)
+	}
+	if !getAnnotationOverrides(ctx, &event.InvolvedObject, lookup).isIgnored(event.Reason) {
+		t.Errorf("event is not ignored by the pod annotation")
+	}
+
+	podGets := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "pods" {
+			podGets++
+		}
+	}
+	if podGets != 1 {
+		t.Errorf("fetched the pod %d times, wanted once", podGets)
+	}
+}
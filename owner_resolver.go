@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The maximum number of cached owners, the cache is reset when it is full
+const ownerCacheLimit = 10000
+
+// The top-level controller of a pod, e.g. a Deployment
+type workloadRef struct {
+	Kind       string
+	Name       string
+	APIVersion string
+	UID        types.UID
+}
+
+func newWorkloadRef(ownerRef *metav1.OwnerReference) *workloadRef {
+	return &workloadRef{
+		Kind:       ownerRef.Kind,
+		Name:       ownerRef.Name,
+		APIVersion: ownerRef.APIVersion,
+		UID:        ownerRef.UID,
+	}
+}
+
+// Resolves the chain of controllers of a pod, e.g.
+// Pod -> ReplicaSet -> Deployment, or Pod -> Job -> CronJob.
+// The ownership of intermediate objects practically never changes, so the
+// results are cached by the UID of the direct owner.
+type ownerResolver struct {
+	mu    sync.Mutex
+	cache map[types.UID]*workloadRef
+}
+
+var podOwnerResolver = &ownerResolver{cache: map[types.UID]*workloadRef{}}
+
+// The controller of the object, or the first owner if there's no controller
+func getControllerOrFirstOwner(object metav1.Object) *metav1.OwnerReference {
+	if controllerRef := metav1.GetControllerOf(object); controllerRef != nil {
+		return controllerRef
+	}
+	ownerRefs := object.GetOwnerReferences()
+	if len(ownerRefs) == 0 {
+		return nil
+	}
+	return &ownerRefs[0]
+}
+
+// Returns nil if the object is not owned by anything
+func (r *ownerResolver) resolve(ctx context.Context, object metav1.Object) (*workloadRef, error) {
+	ownerRef := getControllerOrFirstOwner(object)
+	if ownerRef == nil {
+		return nil, nil
+	}
+
+	r.mu.Lock()
+	cached, found := r.cache[ownerRef.UID]
+	r.mu.Unlock()
+	if found {
+		return cached, nil
+	}
+
+	workload, err := r.resolveOwner(ctx, object.GetNamespace(), ownerRef)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= ownerCacheLimit {
+		r.cache = map[types.UID]*workloadRef{}
+	}
+	r.cache[ownerRef.UID] = workload
+	return workload, nil
+}
+
+// Walks up from the direct owner; StatefulSets, DaemonSets and other kinds
+// are considered top-level
+func (r *ownerResolver) resolveOwner(ctx context.Context, namespace string, ownerRef *metav1.OwnerReference) (*workloadRef, error) {
+	var parent metav1.Object
+
+	switch ownerRef.Kind {
+	case "ReplicaSet":
+		replicaSet, err := getReplicaSet(ctx, namespace, ownerRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		parent = replicaSet
+	case "Job":
+		job, err := getJob(ctx, namespace, ownerRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		parent = job
+	default:
+		return newWorkloadRef(ownerRef), nil
+	}
+
+	// Standalone ReplicaSets and Jobs are top-level themselves
+	parentOwnerRef := getControllerOrFirstOwner(parent)
+	if parentOwnerRef == nil {
+		return newWorkloadRef(ownerRef), nil
+	}
+	return newWorkloadRef(parentOwnerRef), nil
+}
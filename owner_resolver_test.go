@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newOwnerRef(kind string, name string) metav1.OwnerReference {
+	isController := true
+	return metav1.OwnerReference{
+		Kind:       kind,
+		Name:       name,
+		UID:        types.UID("uid-" + kind + "-" + name),
+		Controller: &isController,
+	}
+}
+
+// test that pods are resolved to their top-level workloads
+// through the whole chain of controllers
+func TestOwnerResolver(t *testing.T) {
+
+	namespace := "TestOwnerResolverNamespace"
+
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-5d8f7c",
+			Namespace:       namespace,
+			OwnerReferences: []metav1.OwnerReference{newOwnerRef("Deployment", "web")},
+		},
+	}
+	standaloneReplicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "standalone",
+			Namespace: namespace,
+		},
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "backup-28312345",
+			Namespace:       namespace,
+			OwnerReferences: []metav1.OwnerReference{newOwnerRef("CronJob", "backup")},
+		},
+	}
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(replicaSet, standaloneReplicaSet, job))
+
+	testCases := map[string]struct {
+		ownerRef     metav1.OwnerReference
+		expectedKind string
+		expectedName string
+	}{
+		"deployment":  {newOwnerRef("ReplicaSet", "web-5d8f7c"), "Deployment", "web"},
+		"replicaset":  {newOwnerRef("ReplicaSet", "standalone"), "ReplicaSet", "standalone"},
+		"cronjob":     {newOwnerRef("Job", "backup-28312345"), "CronJob", "backup"},
+		"statefulset": {newOwnerRef("StatefulSet", "db"), "StatefulSet", "db"},
+		"daemonset":   {newOwnerRef("DaemonSet", "agent"), "DaemonSet", "agent"},
+	}
+
+	resolver := &ownerResolver{cache: map[types.UID]*workloadRef{}}
+	for name, testCase := range testCases {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "TestOwnerResolverPod",
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{testCase.ownerRef},
+			},
+		}
+
+		// The second lookup is served from the cache
+		for i := 0; i < 2; i++ {
+			workload, err := resolver.resolve(ctx, pod)
+			if err != nil {
+				t.Fatalf("[%s] unexpected error: %v", name, err)
+			}
+			if workload == nil || workload.Kind != testCase.expectedKind || workload.Name != testCase.expectedName {
+				t.Errorf("[%s] received workload %+v, wanted %s/%s", name, workload, testCase.expectedKind, testCase.expectedName)
+			}
+		}
+	}
+
+	// Pods without owners have no workload
+	workload, err := resolver.resolve(ctx, &corev1.Pod{})
+	if workload != nil || err != nil {
+		t.Errorf("received workload %+v and error %v for a standalone pod", workload, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Pods (or their owners, or namespaces) have to opt in to log fetching with
+// this annotation, so logs of sensitive workloads are never sent to Sentry.
+// It's resolved with the other annotation overrides.
+const podLogsAnnotation = "sentry.io/attach-logs"
+
+// How long fetching the logs of a container may take
+const podLogsFetchTimeout = 10 * time.Second
+
+const defaultPodLogsTailLines = 50
+const defaultPodLogsLimitBytes = 16 * 1024
+
+var podLogsTailLines int64 = defaultPodLogsTailLines
+var podLogsLimitBytes int64 = defaultPodLogsLimitBytes
+
+// Returns the number of lines and the number of bytes
+func parsePodLogsOptions() (int64, int64, error) {
+	tailLines, err := parsePositiveIntSetting("SENTRY_K8S_POD_LOGS_TAIL_LINES", defaultPodLogsTailLines)
+	if err != nil {
+		return 0, 0, err
+	}
+	limitBytes, err := parsePositiveIntSetting("SENTRY_K8S_POD_LOGS_LIMIT_BYTES", defaultPodLogsLimitBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+	return tailLines, limitBytes, nil
+}
+
+func preparePodLogsOptions() error {
+	tailLines, limitBytes, err := parsePodLogsOptions()
+	if err != nil {
+		return err
+	}
+	podLogsTailLines, podLogsLimitBytes = tailLines, limitBytes
+	globalLogger.Debug().Msgf("Prepared the pod logs options: %d lines, %d bytes", podLogsTailLines, podLogsLimitBytes)
+	return nil
+}
+
+func fetchContainerLogTail(ctx context.Context, pod *v1.Pod, containerName string, previous bool) ([]byte, error) {
+	clientset, err := getClientsetFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The byte limit is applied to the tail afterwards: the API server
+	// applies it from the start of the tail, which would cut off the last
+	// lines
+	tailLines := podLogsTailLines
+	opts := &v1.PodLogOptions{
+		Container:  containerName,
+		Previous:   previous,
+		Timestamps: true,
+		TailLines:  &tailLines,
+	}
+	rawLogs, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Do(ctx).Raw()
+	if err != nil {
+		return nil, err
+	}
+	return trimLogsFront(rawLogs, podLogsLimitBytes), nil
+}
+
+// Keeps the last whole lines that fit into the limit
+func trimLogsFront(rawLogs []byte, limitBytes int64) []byte {
+	if int64(len(rawLogs)) <= limitBytes {
+		return rawLogs
+	}
+	trimmed := rawLogs[int64(len(rawLogs))-limitBytes:]
+	if i := bytes.IndexByte(trimmed, '\n'); i >= 0 && i < len(trimmed)-1 {
+		trimmed = trimmed[i+1:]
+	}
+	return trimmed
+}
+
+// Splits the "<timestamp> <message>" log line
+func parseLogLine(line string) (time.Time, string) {
+	rawTs, message, found := strings.Cut(line, " ")
+	if !found {
+		return time.Time{}, line
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rawTs)
+	if err != nil {
+		return time.Time{}, line
+	}
+	return ts, message
+}
+
+// The fetched tail of the container logs
+type containerLogs struct {
+	containerName string
+	raw           []byte
+	lines         []string
+	timestamps    []time.Time
+}
+
+// Fetches the tail of the container logs, returns nil if the logs are not
+// available
+func fetchContainerLogs(ctx context.Context, pod *v1.Pod, containerName string, previous bool) *containerLogs {
+	logger := zerolog.Ctx(ctx)
+
+	// "Previous" only works if the container was already restarted
+	rawLogs, err := fetchContainerLogTail(ctx, pod, containerName, previous)
+	if err != nil {
+		logger.Warn().Msgf("Cannot fetch logs of container %q: %v", containerName, err)
+		return nil
+	}
+
+	logs := &containerLogs{containerName: containerName, raw: rawLogs}
+	for _, rawLine := range strings.Split(strings.TrimRight(string(rawLogs), "\n"), "\n") {
+		if rawLine == "" {
+			continue
+		}
+		ts, message := parseLogLine(rawLine)
+		logs.lines = append(logs.lines, message)
+		logs.timestamps = append(logs.timestamps, ts)
+	}
+	return logs
+}
+
+// Attaches the logs to the scope as breadcrumbs and as a text attachment.
+// Should be called after the enhancers, which add their own breadcrumbs
+// with a lower limit.
+func addContainerLogsToScope(scope *sentry.Scope, pod *v1.Pod, logs *containerLogs) {
+	if logs == nil {
+		return
+	}
+
+	for i, line := range logs.lines {
+		scope.AddBreadcrumb(&sentry.Breadcrumb{
+			Category:  "log",
+			Message:   line,
+			Level:     sentry.LevelInfo,
+			Timestamp: logs.timestamps[i],
+		}, breadcrumbLimit+int(podLogsTailLines))
+	}
+
+	scope.AddAttachment(&sentry.Attachment{
+		Filename:    fmt.Sprintf("%s.%s.log", pod.Name, logs.containerName),
+		ContentType: "text/plain",
+		Payload:     logs.raw,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// test that the logs of a terminated container are attached as breadcrumbs
+// only if the pod or its top-level owner opted in via the annotation
+func TestAttachContainerLogs(t *testing.T) {
+
+	isController := true
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "TestAttachContainerLogsReplicaSet",
+			Namespace: "TestAttachContainerLogsNamespace",
+			UID:       "TestAttachContainerLogsReplicaSetUID",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Deployment", Name: "TestAttachContainerLogsDeployment", Controller: &isController},
+			},
+		},
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "TestAttachContainerLogsDeployment",
+			Namespace:   "TestAttachContainerLogsNamespace",
+			Annotations: map[string]string{podLogsAnnotation: "true"},
+		},
+	}
+
+	for podName, optIn := range map[string]bool{
+		"TestAttachContainerLogsPodOptIn":      true,
+		"TestAttachContainerLogsPodNotOptIn":   false,
+		"TestAttachContainerLogsOwnerOptIn":    true,
+		"TestAttachContainerLogsOwnerOptedOut": false,
+	} {
+		// Define an SDK transport that only captures events but not send them
+		transport := &TransportMock{}
+		client, err := sentry.NewClient(sentry.ClientOptions{
+			Transport: transport,
+			Integrations: func([]sentry.Integration) []sentry.Integration {
+				return []sentry.Integration{}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        podName,
+				Namespace:   "TestAttachContainerLogsNamespace",
+				Annotations: map[string]string{},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name: "fake_DNS_Label",
+						State: corev1.ContainerState{
+							Terminated: &corev1.ContainerStateTerminated{
+								ExitCode: 1,
+								Reason:   "Error",
+							},
+						},
+					},
+				},
+			},
+		}
+		switch podName {
+		case "TestAttachContainerLogsPodOptIn":
+			pod.Annotations[podLogsAnnotation] = "true"
+		case "TestAttachContainerLogsOwnerOptIn", "TestAttachContainerLogsOwnerOptedOut":
+			pod.OwnerReferences = []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: replicaSet.Name, UID: replicaSet.UID, Controller: &isController},
+			}
+			if !optIn {
+				// The pod annotation has priority
+				pod.Annotations[podLogsAnnotation] = "false"
+			}
+		}
+
+		// The fake clientset returns "fake logs" for every container
+		ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(pod, replicaSet, deployment))
+		ctx = sentry.SetHubOnContext(ctx, sentry.NewHub(client, sentry.NewScope()))
+
+		handlePodWatchEvent(ctx, &watch.Event{Type: watch.Modified, Object: pod})
+		if !inFlightEvents.wait(5 * time.Second) {
+			t.Fatalf("timed out waiting for the logs")
+		}
+
+		events := transport.Events()
+		if len(events) != 1 {
+			t.Fatalf("received %d events, expected %d event", len(events), 1)
+		}
+
+		logBreadcrumbs := 0
+		for _, breadcrumb := range events[0].Breadcrumbs {
+			if breadcrumb.Category == "log" && breadcrumb.Message == "fake logs" {
+				logBreadcrumbs++
+			}
+		}
+		if optIn && logBreadcrumbs != 1 {
+			t.Errorf("%s: received %d log breadcrumbs, expected 1", podName, logBreadcrumbs)
+		}
+		if !optIn && logBreadcrumbs != 0 {
+			t.Errorf("%s: received %d log breadcrumbs for a pod that did not opt in", podName, logBreadcrumbs)
+		}
+	}
+}
+
+// test that the byte limit keeps the last whole lines of the tail
+func TestTrimLogsFront(t *testing.T) {
+	rawLogs := []byte("first line\nsecond line\nthird line\n")
+
+	cases := map[int64]string{
+		100: "first line\nsecond line\nthird line\n",
+		25:  "second line\nthird line\n",
+		16:  "third line\n",
+		// A single line longer than the limit is cut
+		5: "line\n",
+	}
+	for limitBytes, expected := range cases {
+		if trimmed := string(trimLogsFront(rawLogs, limitBytes)); trimmed != expected {
+			t.Errorf("limit %d: received %q, wanted %q", limitBytes, trimmed, expected)
+		}
+	}
+}
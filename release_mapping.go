@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Sources of metadata values, e.g. "label:app.kubernetes.io/version"
+const (
+	metadataSourceLabel               = "label"
+	metadataSourceAnnotation          = "annotation"
+	metadataSourceNamespaceLabel      = "namespace-label"
+	metadataSourceNamespaceAnnotation = "namespace-annotation"
+	metadataSourceImageTag            = "image-tag"
+	metadataSourceNamespace           = "namespace"
+)
+
+// The maximum length of an environment name accepted by Sentry
+const environmentNameLimit = 64
+
+type metadataSource struct {
+	kind string
+	key  string
+}
+
+// Ordered lists of sources, the first non-empty value wins
+var releaseSources []metadataSource
+var environmentSources []metadataSource
+
+func parseMetadataSources(raw string) ([]metadataSource, error) {
+	sources := []metadataSource{}
+	for _, rawSource := range strings.Split(raw, ",") {
+		rawSource = strings.TrimSpace(rawSource)
+		if rawSource == "" {
+			continue
+		}
+		kind, key, _ := strings.Cut(rawSource, ":")
+		source := metadataSource{kind: strings.TrimSpace(kind), key: strings.TrimSpace(key)}
+
+		switch source.kind {
+		case metadataSourceLabel, metadataSourceAnnotation, metadataSourceNamespaceLabel, metadataSourceNamespaceAnnotation:
+			if source.key == "" {
+				return nil, fmt.Errorf("missing key in source %q", rawSource)
+			}
+		case metadataSourceImageTag, metadataSourceNamespace:
+			if source.key != "" {
+				return nil, fmt.Errorf("unexpected key in source %q", rawSource)
+			}
+		default:
+			return nil, fmt.Errorf("unknown source %q", rawSource)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func prepareReleaseMapping() error {
+	var err error
+	releaseSources, err = parseMetadataSources(getConfigValue("SENTRY_K8S_RELEASE_SOURCES"))
+	if err != nil {
+		return fmt.Errorf("invalid SENTRY_K8S_RELEASE_SOURCES: %v", err)
+	}
+	environmentSources, err = parseMetadataSources(getConfigValue("SENTRY_K8S_ENVIRONMENT_SOURCES"))
+	if err != nil {
+		return fmt.Errorf("invalid SENTRY_K8S_ENVIRONMENT_SOURCES: %v", err)
+	}
+	globalLogger.Debug().Msgf("Prepared release sources: %v, environment sources: %v", releaseSources, environmentSources)
+	return nil
+}
+
+func sanitizeEnvironmentName(environment string) string {
+	environment = strings.TrimSpace(environment)
+	environment = strings.NewReplacer("/", "-", "\n", "", "\t", "", " ", "-").Replace(environment)
+	if len(environment) > environmentNameLimit {
+		environment = environment[:environmentNameLimit]
+	}
+	return environment
+}
+
+// The objects the metadata is taken from. The namespace is only fetched
+// if a rule needs it.
+type metadataSourceObjects struct {
+	namespaceName string
+	object        metav1.Object
+	podSpec       *v1.PodSpec
+
+	namespace        *v1.Namespace
+	namespaceFetched bool
+}
+
+func (o *metadataSourceObjects) getNamespace(ctx context.Context) *v1.Namespace {
+	if !o.namespaceFetched {
+		o.namespaceFetched = true
+		if o.namespaceName == "" {
+			return nil
+		}
+		namespace, err := getNamespace(ctx, o.namespaceName)
+		if err != nil {
+			zerolog.Ctx(ctx).Debug().Msgf("Cannot fetch namespace %q: %v", o.namespaceName, err)
+			return nil
+		}
+		o.namespace = namespace
+	}
+	return o.namespace
+}
+
+// Labels and annotations are only supported for pods and workloads,
+// namespace sources work for all namespaced objects
+func getMetadataSourceObjects(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}) (*metadataSourceObjects, error) {
+	objects := &metadataSourceObjects{namespaceName: objectRef.Namespace}
+
+	switch objectRef.Kind {
+	case "Pod":
+		pod, _ := cachedObject.(*v1.Pod)
+		if pod == nil {
+			var err error
+			if pod, err = getPod(ctx, objectRef.Namespace, objectRef.Name); err != nil {
+				return nil, err
+			}
+		}
+		objects.object = pod
+		objects.podSpec = &pod.Spec
+	case "Deployment", "StatefulSet", "DaemonSet":
+		state, err := getWorkloadState(ctx, objectRef, cachedObject)
+		if err != nil {
+			return nil, err
+		}
+		objects.object = &state.objectMeta
+		objects.podSpec = &state.podTemplate.Spec
+	}
+	return objects, nil
+}
+
+func (source metadataSource) getValue(ctx context.Context, objects *metadataSourceObjects) string {
+	switch source.kind {
+	case metadataSourceLabel:
+		if objects.object != nil {
+			return objects.object.GetLabels()[source.key]
+		}
+	case metadataSourceAnnotation:
+		if objects.object != nil {
+			return objects.object.GetAnnotations()[source.key]
+		}
+	case metadataSourceNamespaceLabel:
+		if namespace := objects.getNamespace(ctx); namespace != nil {
+			return namespace.Labels[source.key]
+		}
+	case metadataSourceNamespaceAnnotation:
+		if namespace := objects.getNamespace(ctx); namespace != nil {
+			return namespace.Annotations[source.key]
+		}
+	case metadataSourceImageTag:
+		if objects.podSpec != nil && len(objects.podSpec.Containers) > 0 {
+			_, tag, _ := parseImageReference(objects.podSpec.Containers[0].Image)
+			return tag
+		}
+	case metadataSourceNamespace:
+		return objects.namespaceName
+	}
+	return ""
+}
+
+func getFirstMetadataValue(ctx context.Context, sources []metadataSource, objects *metadataSourceObjects) string {
+	for _, source := range sources {
+		if value := strings.TrimSpace(source.getValue(ctx, objects)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Sets the release and the environment of the event from the metadata of
+// the involved object, according to the configured rules
+func runReleaseMappingEnhancer(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+	logger := zerolog.Ctx(ctx)
+
+	if len(releaseSources) == 0 && len(environmentSources) == 0 {
+		return nil
+	}
+
+	objects, err := getMetadataSourceObjects(ctx, objectRef, cachedObject)
+	if err != nil {
+		return err
+	}
+
+	if sentryEvent.Release == "" {
+		if release := sanitizeReleaseName(getFirstMetadataValue(ctx, releaseSources, objects)); release != "" {
+			logger.Debug().Msgf("Setting release %q", release)
+			sentryEvent.Release = release
+		}
+	}
+	if sentryEvent.Environment == "" {
+		if environment := sanitizeEnvironmentName(getFirstMetadataValue(ctx, environmentSources, objects)); environment != "" {
+			logger.Debug().Msgf("Setting environment %q", environment)
+			sentryEvent.Environment = environment
+		}
+	}
+	return nil
+}
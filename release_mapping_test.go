@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// test that the release and the environment are taken from the first
+// source that has a value
+func TestRunReleaseMappingEnhancer(t *testing.T) {
+
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "TestReleaseMappingNamespace",
+			Labels: map[string]string{"environment": "staging"},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "TestReleaseMappingPod",
+			Namespace: namespace.Name,
+			Labels:    map[string]string{"app.kubernetes.io/version": ""},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "web", Image: "example.com:5000/web:2.3.4"}},
+		},
+	}
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(namespace, pod))
+
+	var err error
+	releaseSources, err = parseMetadataSources("label:app.kubernetes.io/version, image-tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	environmentSources, err = parseMetadataSources("namespace-annotation:environment,namespace-label:environment,namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		releaseSources = nil
+		environmentSources = nil
+	}()
+
+	sentryEvent := &sentry.Event{}
+	objectRef := &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Name: pod.Name, Namespace: pod.Namespace}
+	if err := runReleaseMappingEnhancer(ctx, objectRef, nil, sentry.NewScope(), sentryEvent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if sentryEvent.Release != "2.3.4" {
+		t.Errorf("received release %q, wanted %q", sentryEvent.Release, "2.3.4")
+	}
+	if sentryEvent.Environment != "staging" {
+		t.Errorf("received environment %q, wanted %q", sentryEvent.Environment, "staging")
+	}
+
+	for _, invalidSources := range []string{"label", "image-tag:foo", "unknown:foo"} {
+		if _, err := parseMetadataSources(invalidSources); err == nil {
+			t.Errorf("no error for invalid sources %q", invalidSources)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultReleaseTemplate = `{{ .Name }}@{{ or .Tag .ShortDigest .Revision }}`
+
+// Set by the DaemonSet controller on its pods, matches daemonSetGenerationAnnotation
+const daemonSetPodGenerationLabel = "pod-template-generation"
+
+// The maximum length of a release name accepted by Sentry
+const releaseNameLimit = 200
+
+var releaseTemplate = template.Must(parseReleaseTemplate(defaultReleaseTemplate))
+
+// The data available in SENTRY_K8S_RELEASE_TEMPLATE
+type releaseTemplateData struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Revision  string
+	// The image of the first container
+	Image       string
+	ImageName   string
+	Tag         string
+	Digest      string
+	ShortDigest string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func parseReleaseTemplate(rawTemplate string) (*template.Template, error) {
+	// Missing labels are rendered as empty strings
+	return template.New("release").Option("missingkey=zero").Parse(rawTemplate)
+}
+
+func prepareReleaseTemplate() error {
+	rawTemplate := strings.TrimSpace(getConfigValue("SENTRY_K8S_RELEASE_TEMPLATE"))
+	if rawTemplate == "" {
+		return nil
+	}
+	parsed, err := parseReleaseTemplate(rawTemplate)
+	if err != nil {
+		return fmt.Errorf("cannot parse SENTRY_K8S_RELEASE_TEMPLATE: %v", err)
+	}
+	releaseTemplate = parsed
+	globalLogger.Debug().Msgf("Using release template: %q", rawTemplate)
+	return nil
+}
+
+// "registry:5000/org/app:1.2.3@sha256:abc" -> "registry:5000/org/app", "1.2.3", "sha256:abc"
+func parseImageReference(image string) (name string, tag string, digest string) {
+	name, digest, _ = strings.Cut(image, "@")
+	// The registry may have a port, so the tag is only after the last slash
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	return name, tag, digest
+}
+
+func getShortDigest(digest string) string {
+	_, hash, found := strings.Cut(digest, ":")
+	if !found {
+		hash = digest
+	}
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return hash
+}
+
+// Sentry does not allow slashes, whitespace and a few reserved names
+func sanitizeReleaseName(release string) string {
+	release = strings.TrimSpace(release)
+	release = strings.NewReplacer("/", "-", "\\", "-", "\n", "", "\t", "", " ", "-").Replace(release)
+	if release == "." || release == ".." || strings.EqualFold(release, "latest") {
+		return ""
+	}
+	if len(release) > releaseNameLimit {
+		release = release[:releaseNameLimit]
+	}
+	return release
+}
+
+func newReleaseTemplateData(kind string, state *workloadState) *releaseTemplateData {
+	data := &releaseTemplateData{
+		Kind:        kind,
+		Name:        state.objectMeta.Name,
+		Namespace:   state.objectMeta.Namespace,
+		Revision:    state.revision,
+		Labels:      state.objectMeta.Labels,
+		Annotations: state.objectMeta.Annotations,
+	}
+	if containers := state.podTemplate.Spec.Containers; len(containers) > 0 {
+		data.Image = containers[0].Image
+		data.ImageName, data.Tag, data.Digest = parseImageReference(data.Image)
+		data.ShortDigest = getShortDigest(data.Digest)
+	}
+	return data
+}
+
+// Returns an empty string if no release name can be built
+func renderReleaseName(data *releaseTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := releaseTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	release := sanitizeReleaseName(buf.String())
+	// e.g. "app@" when nothing is known about the version
+	if strings.HasSuffix(release, "@") {
+		return "", nil
+	}
+	return release, nil
+}
+
+// Builds the release of a pod from the pod itself, on top of the data of its
+// workload. During a rollout, the pods of the previous revision keep the
+// release of that revision.
+func newPodReleaseTemplateData(ctx context.Context, workloadData *releaseTemplateData, pod *v1.Pod) *releaseTemplateData {
+	data := *workloadData
+	data.Image, data.ImageName, data.Tag, data.Digest, data.ShortDigest = "", "", "", "", ""
+	if containers := pod.Spec.Containers; len(containers) > 0 {
+		data.Image = containers[0].Image
+		data.ImageName, data.Tag, data.Digest = parseImageReference(data.Image)
+		data.ShortDigest = getShortDigest(data.Digest)
+	}
+	data.Revision = getPodRevision(ctx, data.Kind, pod)
+	// The labels and annotations of the pod win, they come from the template
+	// of its revision
+	data.Labels = mergeStringMaps(workloadData.Labels, pod.Labels)
+	data.Annotations = mergeStringMaps(workloadData.Annotations, pod.Annotations)
+	return &data
+}
+
+// The revision of the workload the pod was created from, empty if unknown
+func getPodRevision(ctx context.Context, kind string, pod *v1.Pod) string {
+	switch kind {
+	case "Deployment":
+		ownerRef := metav1.GetControllerOf(pod)
+		if ownerRef == nil || ownerRef.Kind != "ReplicaSet" {
+			return ""
+		}
+		replicaSet, err := getReplicaSet(ctx, pod.Namespace, ownerRef.Name)
+		if err != nil {
+			zerolog.Ctx(ctx).Debug().Msgf("Cannot fetch the ReplicaSet of the pod: %v", err)
+			return ""
+		}
+		return replicaSet.Annotations[deploymentRevisionAnnotation]
+	case "StatefulSet":
+		return pod.Labels[appsv1.StatefulSetRevisionLabel]
+	case "DaemonSet":
+		return pod.Labels[daemonSetPodGenerationLabel]
+	default:
+		return ""
+	}
+}
+
+func mergeStringMaps(base map[string]string, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	return merged
+}
+
+// / Release registry
+
+// The current release of a tracked workload, and the data it was rendered
+// from
+type workloadRelease struct {
+	name string
+	data *releaseTemplateData
+}
+
+// The current release of every tracked workload, so events about the
+// workload (and its pods) can carry it
+type releaseRegistry struct {
+	mu       sync.RWMutex
+	releases map[string]*workloadRelease
+}
+
+var workloadReleases = &releaseRegistry{releases: map[string]*workloadRelease{}}
+
+func getWorkloadKey(namespace string, kind string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", namespace, kind, name)
+}
+
+func (r *releaseRegistry) set(key string, release string, data *releaseTemplateData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releases[key] = &workloadRelease{name: release, data: data}
+}
+
+func (r *releaseRegistry) get(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if release := r.releases[key]; release != nil {
+		return release.name
+	}
+	return ""
+}
+
+// Returns nil if the workload is not tracked
+func (r *releaseRegistry) getTemplateData(key string) *releaseTemplateData {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if release := r.releases[key]; release != nil {
+		return release.data
+	}
+	return nil
+}
+
+func (r *releaseRegistry) isEmpty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.releases) == 0
+}
+
+func (r *releaseRegistry) forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.releases, key)
+}
+
+// Renders the release of a pod of a tracked workload, returns an empty
+// string if the pod doesn't belong to one
+func getPodRelease(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}) (string, error) {
+	pod, _ := cachedObject.(*v1.Pod)
+	if pod == nil {
+		var err error
+		if pod, err = getPod(ctx, objectRef.Namespace, objectRef.Name); err != nil {
+			return "", err
+		}
+	}
+	workload, err := podOwnerResolver.resolve(ctx, pod)
+	if err != nil || workload == nil {
+		return "", err
+	}
+	workloadData := workloadReleases.getTemplateData(getWorkloadKey(pod.Namespace, workload.Kind, workload.Name))
+	if workloadData == nil {
+		return "", nil
+	}
+	return renderReleaseName(newPodReleaseTemplateData(ctx, workloadData, pod))
+}
+
+func runReleaseEnhancer(ctx context.Context, objectRef *v1.ObjectReference, cachedObject interface{}, scope *sentry.Scope, sentryEvent *sentry.Event) error {
+	logger := zerolog.Ctx(ctx)
+
+	if sentryEvent.Release != "" || workloadReleases.isEmpty() {
+		return nil
+	}
+
+	var release string
+	switch objectRef.Kind {
+	case "Deployment", "StatefulSet", "DaemonSet":
+		release = workloadReleases.get(getWorkloadKey(objectRef.Namespace, objectRef.Kind, objectRef.Name))
+	case "Pod":
+		var err error
+		if release, err = getPodRelease(ctx, objectRef, cachedObject); err != nil {
+			return err
+		}
+	}
+	if release != "" {
+		logger.Debug().Msgf("Setting release %q", release)
+		sentryEvent.Release = release
+	}
+	return nil
+}
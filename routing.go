@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Namespaces can pick their own DSN, either directly, or through a Secret
+// (with the DSN under the "dsn" key) in the same namespace
+const dsnAnnotation = "sentry.io/dsn"
+const dsnSecretAnnotation = "sentry.io/dsn-secret"
+const dsnSecretKey = "dsn"
+
+// How long DSNs read from Secrets are cached
+const dsnSecretCacheTTL = 5 * time.Minute
+
+// How long errors of reading a Secret are cached, so a missing Secret is not
+// fetched for every event
+const dsnSecretErrorCacheTTL = 30 * time.Second
+
+// A single entry of SENTRY_K8S_ROUTES. All the specified conditions have
+// to match.
+type routeConfig struct {
+	// Glob patterns, e.g. "team-a-*"
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Label selectors, e.g. "team=a,tier!=dev"
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	ObjectSelector    string `json:"objectSelector,omitempty"`
+	DSN               string `json:"dsn"`
+}
+
+type route struct {
+	config            routeConfig
+	namespaceSelector labels.Selector
+	objectSelector    labels.Selector
+}
+
+// The routing table, the first matching route wins
+var routes []*route
+
+func parseRoutes(raw string) ([]*route, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	configs := []routeConfig{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&configs); err != nil {
+		return nil, err
+	}
+
+	parsedRoutes := make([]*route, 0, len(configs))
+	for i, config := range configs {
+		if _, err := sentry.NewDsn(config.DSN); err != nil {
+			return nil, fmt.Errorf("route %d: invalid DSN: %v", i, err)
+		}
+		for _, pattern := range config.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("route %d: invalid namespace pattern %q: %v", i, pattern, err)
+			}
+		}
+		parsedRoute := &route{config: config}
+		if config.NamespaceSelector != "" {
+			selector, err := labels.Parse(config.NamespaceSelector)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid namespace selector: %v", i, err)
+			}
+			parsedRoute.namespaceSelector = selector
+		}
+		if config.ObjectSelector != "" {
+			selector, err := labels.Parse(config.ObjectSelector)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid object selector: %v", i, err)
+			}
+			parsedRoute.objectSelector = selector
+		}
+		parsedRoutes = append(parsedRoutes, parsedRoute)
+	}
+	return parsedRoutes, nil
+}
+
+func prepareRoutes() error {
+	parsedRoutes, err := parseRoutes(getConfigValue("SENTRY_K8S_ROUTES"))
+	if err != nil {
+		return fmt.Errorf("invalid SENTRY_K8S_ROUTES: %v", err)
+	}
+	routes = parsedRoutes
+	globalLogger.Debug().Msgf("Prepared %d route(s)", len(routes))
+	return nil
+}
+
+// The object an event is about
+type routingTarget struct {
+	namespace string
+	// Returns the labels of the object, only called if a route needs them
+	getLabels func() map[string]string
+}
+
+func newRoutingTargetForObject(object metav1.Object) *routingTarget {
+	return &routingTarget{
+		namespace: object.GetNamespace(),
+		getLabels: object.GetLabels,
+	}
+}
+
+func newRoutingTargetForRef(ctx context.Context, objectRef *v1.ObjectReference) *routingTarget {
+	return &routingTarget{
+		namespace: objectRef.Namespace,
+		getLabels: func() map[string]string {
+			objects, err := getMetadataSourceObjects(ctx, objectRef, nil)
+			if err != nil || objects.object == nil {
+				return nil
+			}
+			return objects.object.GetLabels()
+		},
+	}
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *route) matches(target *routingTarget, namespace *v1.Namespace) bool {
+	if len(r.config.Namespaces) > 0 && !matchesAnyPattern(r.config.Namespaces, target.namespace) {
+		return false
+	}
+	if r.namespaceSelector != nil {
+		if namespace == nil || !r.namespaceSelector.Matches(labels.Set(namespace.Labels)) {
+			return false
+		}
+	}
+	if r.objectSelector != nil && (target.getLabels == nil || !r.objectSelector.Matches(labels.Set(target.getLabels()))) {
+		return false
+	}
+	return true
+}
+
+// / DSNs from Secrets
+
+type cachedSecretDSN struct {
+	dsn       string
+	err       error
+	fetchedAt time.Time
+}
+
+func (c *cachedSecretDSN) isExpired() bool {
+	ttl := dsnSecretCacheTTL
+	if c.err != nil {
+		ttl = dsnSecretErrorCacheTTL
+	}
+	return time.Since(c.fetchedAt) >= ttl
+}
+
+var secretDSNs = struct {
+	mu    sync.Mutex
+	cache map[string]*cachedSecretDSN
+}{cache: map[string]*cachedSecretDSN{}}
+
+func getDSNFromSecret(ctx context.Context, namespace string, secretName string) (string, error) {
+	key := namespace + "/" + secretName
+
+	secretDSNs.mu.Lock()
+	cached, found := secretDSNs.cache[key]
+	secretDSNs.mu.Unlock()
+	if found && !cached.isExpired() {
+		return cached.dsn, cached.err
+	}
+
+	clientset, err := getClientsetFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	dsn, err := readDSNFromSecret(ctx, clientset, namespace, secretName)
+
+	secretDSNs.mu.Lock()
+	secretDSNs.cache[key] = &cachedSecretDSN{dsn: dsn, err: err, fetchedAt: time.Now()}
+	secretDSNs.mu.Unlock()
+	return dsn, err
+}
+
+func readDSNFromSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, secretName string) (string, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	dsn := strings.TrimSpace(string(secret.Data[dsnSecretKey]))
+	if dsn == "" {
+		return "", fmt.Errorf("no %q key in secret %q", dsnSecretKey, namespace+"/"+secretName)
+	}
+	return dsn, nil
+}
+
+// Returns the DSN for the target, or an empty string for the default DSN.
+// The namespace annotations have priority over the routing table.
+func resolveDSN(ctx context.Context, target *routingTarget) string {
+	logger := zerolog.Ctx(ctx)
+
+	var namespace *v1.Namespace
+	if target.namespace != "" {
+		var err error
+		namespace, err = getNamespace(ctx, target.namespace)
+		if err != nil {
+			logger.Debug().Msgf("Cannot fetch namespace %q: %v", target.namespace, err)
+			namespace = nil
+		}
+	}
+
+	if namespace != nil {
+		if dsn := strings.TrimSpace(namespace.Annotations[dsnAnnotation]); dsn != "" {
+			return dsn
+		}
+		if secretName := strings.TrimSpace(namespace.Annotations[dsnSecretAnnotation]); secretName != "" {
+			dsn, err := getDSNFromSecret(ctx, namespace.Name, secretName)
+			if err == nil {
+				return dsn
+			}
+			logger.Warn().Msgf("Cannot read the DSN from secret %q: %v", secretName, err)
+		}
+	}
+
+	for _, r := range routes {
+		if r.matches(target, namespace) {
+			return r.config.DSN
+		}
+	}
+	return ""
+}
+
+// / Client cache
+
+// Clients for non-default DSNs, they share the options of the default client.
+// There's one client per DSN for the lifetime of the agent: the transport of
+// a client cannot be closed, so dropping clients would leak their workers
+// and connections. The number of DSNs is small, even with rotated DSNs.
+type routedClientCache struct {
+	mu      sync.Mutex
+	clients map[string]*sentry.Client
+}
+
+var routedClients = &routedClientCache{clients: map[string]*sentry.Client{}}
+
+func (c *routedClientCache) get(dsn string, defaultClient *sentry.Client) (*sentry.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, found := c.clients[dsn]; found {
+		return client, nil
+	}
+
+	options := defaultClient.Options()
+	options.Dsn = dsn
+	client, err := sentry.NewClient(options)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[dsn] = client
+	return client, nil
+}
+
+// Flushes all clients in parallel, returns false if the timeout is reached
+func (c *routedClientCache) flush(timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var timedOut atomic.Bool
+	for _, client := range c.clients {
+		wg.Add(1)
+		go func(client *sentry.Client) {
+			defer wg.Done()
+			if !client.Flush(timeout) {
+				timedOut.Store(true)
+			}
+		}(client)
+	}
+	wg.Wait()
+	return !timedOut.Load()
+}
+
+// Returns the client for the target, falls back to the default client
+func getRoutedClient(ctx context.Context, hub *sentry.Hub, target *routingTarget) *sentry.Client {
+	logger := zerolog.Ctx(ctx)
+
+	defaultClient := hub.Client()
+	if target == nil || defaultClient == nil {
+		return defaultClient
+	}
+	dsn := resolveDSN(ctx, target)
+	if dsn == "" || dsn == defaultClient.Options().Dsn {
+		return defaultClient
+	}
+
+	client, err := routedClients.get(dsn, defaultClient)
+	if err != nil {
+		logger.Error().Msgf("Cannot create a client for the routed DSN, using the default one: %v", err)
+		return defaultClient
+	}
+	return client
+}
+
+// Captures the event with the client of the matching route. Has to be
+// called inside hub.WithScope(), with the scope of the event.
+func captureRoutedEvent(ctx context.Context, hub *sentry.Hub, scope *sentry.Scope, target *routingTarget, sentryEvent *sentry.Event) {
+	client := getRoutedClient(ctx, hub, target)
+	if client == nil || client == hub.Client() {
+		hub.CaptureEvent(sentryEvent)
+		return
+	}
+	client.CaptureEvent(sentryEvent, nil, scope)
+}
+
+// Sends the check-in with the client of the matching route
+func captureRoutedCheckIn(ctx context.Context, target *routingTarget, checkIn *sentry.CheckIn, monitorConfig *sentry.MonitorConfig) *sentry.EventID {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	client := getRoutedClient(ctx, hub, target)
+	if client == nil || client == hub.Client() {
+		return hub.CaptureCheckIn(checkIn, monitorConfig)
+	}
+	return client.CaptureCheckIn(checkIn, monitorConfig, hub.Scope())
+}
+
+// Flushes the clients of all routes, the default client is flushed
+// separately
+func flushRoutedClients(timeout time.Duration) bool {
+	return routedClients.flush(timeout)
+}
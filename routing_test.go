@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// test that the namespace annotations have priority over the routing
+// table, and the default DSN is used if nothing matches
+func TestResolveDSN(t *testing.T) {
+
+	annotatedNamespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "payments-annotated",
+			Annotations: map[string]string{dsnAnnotation: "https://annotation@example.com/1"},
+		},
+	}
+	secretNamespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "TestSecretNamespace",
+			Annotations: map[string]string{dsnSecretAnnotation: "sentry-dsn"},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sentry-dsn", Namespace: secretNamespace.Name},
+		Data:       map[string][]byte{dsnSecretKey: []byte("https://secret@example.com/2\n")},
+	}
+	labelledNamespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "TestLabelledNamespace",
+			Labels: map[string]string{"team": "search"},
+		},
+	}
+	otherNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "TestOtherNamespace"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "TestRoutingPod",
+			Namespace: otherNamespace.Name,
+			Labels:    map[string]string{"app": "checkout"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(annotatedNamespace, secretNamespace, secret, labelledNamespace, otherNamespace, pod)
+	ctx := setClientsetOnContext(context.Background(), clientset)
+
+	var err error
+	routes, err = parseRoutes(`[
+		{"namespaces": ["payments-*"], "dsn": "https://payments@example.com/3"},
+		{"namespaceSelector": "team=search", "dsn": "https://search@example.com/4"},
+		{"objectSelector": "app=checkout", "dsn": "https://checkout@example.com/5"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		routes = nil
+	}()
+
+	cases := []struct {
+		name   string
+		target *routingTarget
+		dsn    string
+	}{
+		{"annotation", &routingTarget{namespace: annotatedNamespace.Name}, "https://annotation@example.com/1"},
+		{"secret", &routingTarget{namespace: secretNamespace.Name}, "https://secret@example.com/2"},
+		{"namespace pattern", &routingTarget{namespace: "payments-eu"}, "https://payments@example.com/3"},
+		{"namespace selector", &routingTarget{namespace: labelledNamespace.Name}, "https://search@example.com/4"},
+		{"object selector", newRoutingTargetForRef(ctx, &corev1.ObjectReference{Kind: "Pod", Name: pod.Name, Namespace: pod.Namespace}), "https://checkout@example.com/5"},
+		{"default", &routingTarget{namespace: otherNamespace.Name}, ""},
+	}
+	for _, c := range cases {
+		if dsn := resolveDSN(ctx, c.target); dsn != c.dsn {
+			t.Errorf("%s: received DSN %q, wanted %q", c.name, dsn, c.dsn)
+		}
+	}
+
+	invalidRoutes := []string{
+		`[{"dsn": "invalid"}]`,
+		`[{"namespaces": ["["], "dsn": "https://key@example.com/1"}]`,
+		`[{"namespaceSelector": "team in", "dsn": "https://key@example.com/1"}]`,
+		`[{"unknown": "field", "dsn": "https://key@example.com/1"}]`,
+	}
+	for _, raw := range invalidRoutes {
+		if _, err := parseRoutes(raw); err == nil {
+			t.Errorf("no error for invalid routes %s", raw)
+		}
+	}
+}
+
+// test that errors of reading a DSN Secret are cached as well, so a missing
+// Secret is not fetched for every event
+func TestGetDSNFromSecretCachesErrors(t *testing.T) {
+
+	clientset := fake.NewSimpleClientset()
+	ctx := setClientsetOnContext(context.Background(), clientset)
+
+	for i := 0; i < 3; i++ {
+		if _, err := getDSNFromSecret(ctx, "TestMissingSecretNamespace", "sentry-dsn"); err == nil {
+			t.Fatalf("no error for a missing secret")
+		}
+	}
+	if actions := clientset.Actions(); len(actions) != 1 {
+		t.Errorf("secret was fetched %d times, wanted %d", len(actions), 1)
+	}
+
+	// The error expires sooner than a DSN
+	secretDSNs.mu.Lock()
+	secretDSNs.cache["TestMissingSecretNamespace/sentry-dsn"].fetchedAt = time.Now().Add(-dsnSecretErrorCacheTTL)
+	secretDSNs.mu.Unlock()
+	if _, err := getDSNFromSecret(ctx, "TestMissingSecretNamespace", "sentry-dsn"); err == nil {
+		t.Fatalf("no error for a missing secret")
+	}
+	if actions := clientset.Actions(); len(actions) != 2 {
+		t.Errorf("secret was fetched %d times after the error expired, wanted %d", len(actions), 2)
+	}
+}
+
+// test that the routed clients are reused per DSN, and not created again
+func TestRoutedClientCache(t *testing.T) {
+	defaultClient, err := sentry.NewClient(sentry.ClientOptions{Transport: &TransportMock{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &routedClientCache{clients: map[string]*sentry.Client{}}
+
+	first, err := cache.get("https://key@sentry.example.com/2", defaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other, err := cache.get("https://key@sentry.example.com/3", defaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	again, err := cache.get("https://key@sentry.example.com/2", defaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != again {
+		t.Errorf("a new client was created for the same DSN")
+	}
+	if first == other {
+		t.Errorf("the same client was used for different DSNs")
+	}
+	if len(cache.clients) != 2 {
+		t.Errorf("cached %d clients, wanted %d", len(cache.clients), 2)
+	}
+}
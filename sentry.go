@@ -3,12 +3,18 @@ package main
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	globalLogger "github.com/rs/zerolog/log"
 	"k8s.io/client-go/rest"
 )
 
+const defaultFlushTimeout = 5 * time.Second
+
+// The release the SDK detects by itself (e.g. from SENTRY_RELEASE)
+var defaultClientRelease string
+
 func beforeSend(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
 	// Update SDK info
 	event.Sdk.Name = "tonyo.sentry-kubernetes"
@@ -17,8 +23,11 @@ func beforeSend(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
 	// Clear modules/packages
 	event.Modules = map[string]string{}
 
-	// We don't need these for now
-	event.Release = ""
+	// The release of the agent itself is meaningless for cluster events,
+	// releases of workloads are set by the enhancers
+	if event.Release == defaultClientRelease {
+		event.Release = ""
+	}
 	event.ServerName = ""
 
 	return event
@@ -26,7 +35,11 @@ func beforeSend(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
 
 func initSentrySDK() {
 	globalLogger.Debug().Msg("Initializing Sentry SDK...")
+	// Empty values fall back to the SDK defaults (e.g. SENTRY_DSN)
 	err := sentry.Init(sentry.ClientOptions{
+		Dsn:           getConfigValue("SENTRY_DSN"),
+		Environment:   getConfigValue("SENTRY_ENVIRONMENT"),
+		Release:       getConfigValue("SENTRY_RELEASE"),
 		Debug:         true,
 		EnableTracing: false,
 		BeforeSend:    beforeSend,
@@ -37,6 +50,8 @@ func initSentrySDK() {
 		globalLogger.Fatal().Msgf("sentry.Init: %s", err)
 	}
 
+	defaultClientRelease = sentry.CurrentHub().Client().Options().Release
+
 	if sentry.CurrentHub().Client().Options().Dsn == "" {
 		globalLogger.Warn().Msg("No Sentry DSN specified, events will not be sent.")
 	}
@@ -44,6 +59,23 @@ func initSentrySDK() {
 	globalLogger.Debug().Msg("Sentry SDK initialized")
 }
 
+func getFlushTimeout() time.Duration {
+	timeout, err := parseDurationSetting("SENTRY_K8S_FLUSH_TIMEOUT", defaultFlushTimeout, 0)
+	if err != nil {
+		globalLogger.Warn().Msgf("%v, using the default: %s", err, defaultFlushTimeout)
+		return defaultFlushTimeout
+	}
+	return timeout
+}
+
+// Sends the buffered events of the default and the routed clients, returns
+// false if the timeout is reached
+func flushSentry(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	flushed := sentry.Flush(timeout)
+	return flushRoutedClients(time.Until(deadline)) && flushed
+}
+
 func setKubernetesSentryContext(config *rest.Config) {
 	kubernetesContext := map[string]interface{}{
 		"API endpoint": config.Host,
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultSentryURL = "https://sentry.io/"
+const sentryAPITimeout = 10 * time.Second
+
+// A minimal client for the Sentry web API, only supports what the agent
+// needs: releases and deploys
+type sentryAPIClient struct {
+	baseURL    string
+	token      string
+	org        string
+	projects   []string
+	httpClient *http.Client
+}
+
+// Returns nil if the API is not configured
+func newSentryAPIClientFromEnv() (*sentryAPIClient, error) {
+	token := strings.TrimSpace(getConfigValue("SENTRY_AUTH_TOKEN"))
+	org := strings.TrimSpace(getConfigValue("SENTRY_ORG"))
+	if token == "" && org == "" {
+		return nil, nil
+	}
+	if token == "" || org == "" {
+		return nil, fmt.Errorf("both SENTRY_AUTH_TOKEN and SENTRY_ORG have to be set")
+	}
+
+	projects := []string{}
+	for _, project := range strings.Split(getConfigValue("SENTRY_PROJECT"), ",") {
+		if project = strings.TrimSpace(project); project != "" {
+			projects = append(projects, project)
+		}
+	}
+	if len(projects) == 0 {
+		return nil, fmt.Errorf("SENTRY_PROJECT is not set")
+	}
+
+	baseURL := strings.TrimSpace(getConfigValue("SENTRY_URL"))
+	if baseURL == "" {
+		baseURL = defaultSentryURL
+	}
+	return newSentryAPIClient(baseURL, token, org, projects), nil
+}
+
+func newSentryAPIClient(baseURL string, token string, org string, projects []string) *sentryAPIClient {
+	return &sentryAPIClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		org:        org,
+		projects:   projects,
+		httpClient: &http.Client{Timeout: sentryAPITimeout},
+	}
+}
+
+type sentryAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *sentryAPIError) Error() string {
+	return fmt.Sprintf("sentry API error: status %d: %s", e.StatusCode, e.Body)
+}
+
+func (c *sentryAPIClient) post(ctx context.Context, path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// 208: the release already exists
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return &sentryAPIError{StatusCode: response.StatusCode, Body: strings.TrimSpace(string(responseBody))}
+}
+
+type sentryReleaseRequest struct {
+	Version  string   `json:"version"`
+	Projects []string `json:"projects"`
+}
+
+// Creates the release, does nothing if it already exists
+func (c *sentryAPIClient) createRelease(ctx context.Context, version string) error {
+	path := fmt.Sprintf("/api/0/organizations/%s/releases/", url.PathEscape(c.org))
+	return c.post(ctx, path, &sentryReleaseRequest{
+		Version:  version,
+		Projects: c.projects,
+	})
+}
+
+type sentryDeployRequest struct {
+	Environment  string     `json:"environment"`
+	Name         string     `json:"name,omitempty"`
+	Projects     []string   `json:"projects"`
+	DateStarted  *time.Time `json:"dateStarted,omitempty"`
+	DateFinished *time.Time `json:"dateFinished,omitempty"`
+}
+
+func (c *sentryAPIClient) createDeploy(ctx context.Context, version string, environment string, name string, started time.Time, finished time.Time) error {
+	path := fmt.Sprintf(
+		"/api/0/organizations/%s/releases/%s/deploys/",
+		url.PathEscape(c.org),
+		url.PathEscape(version),
+	)
+	deploy := &sentryDeployRequest{
+		Environment: environment,
+		Name:        name,
+		Projects:    c.projects,
+	}
+	if !started.IsZero() {
+		deploy.DateStarted = &started
+	}
+	if !finished.IsZero() {
+		deploy.DateFinished = &finished
+	}
+	return c.post(ctx, path, deploy)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type sentryAPIRequestMock struct {
+	path string
+	body map[string]interface{}
+}
+
+// A fake Sentry API that records all requests
+type sentryAPIServerMock struct {
+	mu       sync.Mutex
+	requests []sentryAPIRequestMock
+}
+
+func (s *sentryAPIServerMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer TestToken" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, sentryAPIRequestMock{path: r.URL.Path, body: body})
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *sentryAPIServerMock) Requests() []sentryAPIRequestMock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newRolloutTestDeployment(image string, revision string, updatedReplicas int32) *appsv1.Deployment {
+	replicas := int32(2)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web",
+			Namespace:       "TestRolloutNamespace",
+			ResourceVersion: revision,
+			Annotations:     map[string]string{deploymentRevisionAnnotation: revision},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "web", Image: image}},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			Replicas:          2,
+			UpdatedReplicas:   updatedReplicas,
+			AvailableReplicas: 2,
+		},
+	}
+}
+
+// test that a new revision of a deployment creates a release, and the
+// completed rollout creates a deploy of that release
+func TestHandleRolloutWatchEvent(t *testing.T) {
+
+	server := &sentryAPIServerMock{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	apiClient := newSentryAPIClient(httpServer.URL, "TestToken", "test-org", []string{"test-project"})
+	ctx := setSentryAPIClientOnContext(context.Background(), apiClient)
+
+	// The existing deployment is only recorded
+	handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Added, Object: newRolloutTestDeployment("example.com:5000/web:1.0.0", "1", 2)})
+	if len(server.Requests()) != 0 {
+		t.Fatalf("received %d requests for an existing deployment", len(server.Requests()))
+	}
+
+	// The new revision is being rolled out
+	handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Modified, Object: newRolloutTestDeployment("example.com:5000/web:1.1.0", "2", 1)})
+	// The rollout is complete
+	handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Modified, Object: newRolloutTestDeployment("example.com:5000/web:1.1.0", "2", 2)})
+
+	requests := server.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("received %d requests, expected %d requests", len(requests), 2)
+	}
+
+	expectedPaths := []string{
+		"/api/0/organizations/test-org/releases/",
+		"/api/0/organizations/test-org/releases/web@1.1.0/deploys/",
+	}
+	for i, expectedPath := range expectedPaths {
+		if requests[i].path != expectedPath {
+			t.Errorf("received request to %q, wanted %q", requests[i].path, expectedPath)
+		}
+	}
+	if requests[0].body["version"] != "web@1.1.0" {
+		t.Errorf("received release version %v, wanted %q", requests[0].body["version"], "web@1.1.0")
+	}
+	if requests[1].body["environment"] != defaultDeployEnvironment {
+		t.Errorf("received deploy environment %v, wanted %q", requests[1].body["environment"], defaultDeployEnvironment)
+	}
+
+	// Events about the deployment carry the new release
+	key := getWorkloadKey("TestRolloutNamespace", "Deployment", "web")
+	if release := workloadReleases.get(key); release != "web@1.1.0" {
+		t.Errorf("received release %q, wanted %q", release, "web@1.1.0")
+	}
+
+	handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Deleted, Object: newRolloutTestDeployment("example.com:5000/web:1.1.0", "2", 2)})
+	if release := workloadReleases.get(key); release != "" {
+		t.Errorf("received release %q for a deleted deployment", release)
+	}
+}
+
+// test that pods carry the release of the revision they were created from,
+// not the current release of their deployment
+func TestRunReleaseEnhancerForPods(t *testing.T) {
+
+	isController := true
+	newReplicaSet := func(name string, revision string) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "TestRolloutNamespace",
+				UID:         types.UID("uid-" + name),
+				Annotations: map[string]string{deploymentRevisionAnnotation: revision},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "Deployment", Name: "web", Controller: &isController},
+				},
+			},
+		}
+	}
+	newPod := func(name string, replicaSet string, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "TestRolloutNamespace",
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "ReplicaSet", Name: replicaSet, UID: types.UID("uid-" + replicaSet), Controller: &isController},
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "web", Image: image}},
+			},
+		}
+	}
+	oldPod := newPod("web-old", "web-1", "example.com:5000/web:1.0.0")
+	newRevisionPod := newPod("web-new", "web-2", "example.com:5000/web:1.1.0")
+	clientset := fake.NewSimpleClientset(newReplicaSet("web-1", "1"), newReplicaSet("web-2", "2"), oldPod, newRevisionPod)
+	ctx := setClientsetOnContext(context.Background(), clientset)
+
+	// The rollout of the new revision is in progress
+	handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Added, Object: newRolloutTestDeployment("example.com:5000/web:1.1.0", "2", 1)})
+	defer handleRolloutWatchEvent(ctx, &watch.Event{Type: watch.Deleted, Object: newRolloutTestDeployment("example.com:5000/web:1.1.0", "2", 1)})
+
+	expected := map[*corev1.Pod]string{
+		oldPod:         "web@1.0.0",
+		newRevisionPod: "web@1.1.0",
+	}
+	for pod, wanted := range expected {
+		sentryEvent := &sentry.Event{}
+		objectRef := &corev1.ObjectReference{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name}
+		if err := runReleaseEnhancer(ctx, objectRef, nil, sentry.NewScope(), sentryEvent); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if sentryEvent.Release != wanted {
+			t.Errorf("pod %s: received release %q, wanted %q", pod.Name, sentryEvent.Release, wanted)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// A single entry of SENTRY_K8S_SEVERITY_RULES. All the specified
+// conditions have to match.
+type severityRuleConfig struct {
+	Reason    string `json:"reason,omitempty"`
+	Component string `json:"component,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	ExitCode  *int32 `json:"exitCode,omitempty"`
+	// A regular expression
+	Message string `json:"message,omitempty"`
+	Level   string `json:"level"`
+}
+
+type severityRule struct {
+	config       severityRuleConfig
+	messageRegex *regexp.Regexp
+	level        sentry.Level
+}
+
+// What the rules are matched against
+type severityInput struct {
+	eventType string
+	reason    string
+	component string
+	kind      string
+	// nil if the event is not about a container termination
+	exitCode *int32
+	message  string
+}
+
+// Used if no rule matches
+const defaultSeverityLevel = sentry.LevelError
+const defaultNormalEventSeverityLevel = sentry.LevelInfo
+
+// The built-in rules go after the configured ones
+var defaultSeverityRules = []severityRuleConfig{
+	{Reason: "OOMKilled", Level: "fatal"},
+	{Reason: "Unhealthy", Message: "^Readiness probe failed", Level: "warning"},
+	{Reason: "BackOff", Level: "error"},
+	{Reason: "CrashLoopBackOff", Level: "error"},
+	{Reason: "FailedScheduling", Level: "warning"},
+	{Reason: "Evicted", Level: "warning"},
+}
+
+// Only the built-in rules are active until prepareSeverityRules() is called
+var severityRules []*severityRule
+
+func init() {
+	rules, err := parseSeverityRules("")
+	if err != nil {
+		panic(err)
+	}
+	severityRules = rules
+}
+
+func parseLevel(value string) (sentry.Level, error) {
+	level := sentry.Level(strings.ToLower(strings.TrimSpace(value)))
+	switch level {
+	case sentry.LevelDebug, sentry.LevelInfo, sentry.LevelWarning, sentry.LevelError, sentry.LevelFatal:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown level %q", value)
+}
+
+func newSeverityRule(config severityRuleConfig) (*severityRule, error) {
+	level, err := parseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	rule := &severityRule{config: config, level: level}
+	if config.Message != "" {
+		if rule.messageRegex, err = regexp.Compile(config.Message); err != nil {
+			return nil, fmt.Errorf("invalid message pattern: %v", err)
+		}
+	}
+	return rule, nil
+}
+
+func parseSeverityRules(raw string) ([]*severityRule, error) {
+	configs := []severityRuleConfig{}
+	if raw = strings.TrimSpace(raw); raw != "" {
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&configs); err != nil {
+			return nil, err
+		}
+	}
+
+	rules := []*severityRule{}
+	for i, config := range append(configs, defaultSeverityRules...) {
+		rule, err := newSeverityRule(config)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func prepareSeverityRules() error {
+	rules, err := parseSeverityRules(getConfigValue("SENTRY_K8S_SEVERITY_RULES"))
+	if err != nil {
+		return fmt.Errorf("invalid SENTRY_K8S_SEVERITY_RULES: %v", err)
+	}
+	severityRules = rules
+	globalLogger.Debug().Msgf("Prepared %d severity rule(s)", len(severityRules))
+	return nil
+}
+
+func (r *severityRule) matches(input *severityInput) bool {
+	if r.config.Reason != "" && !strings.EqualFold(r.config.Reason, input.reason) {
+		return false
+	}
+	if r.config.Component != "" && !strings.EqualFold(r.config.Component, input.component) {
+		return false
+	}
+	if r.config.Kind != "" && !strings.EqualFold(r.config.Kind, input.kind) {
+		return false
+	}
+	if r.config.ExitCode != nil && (input.exitCode == nil || *r.config.ExitCode != *input.exitCode) {
+		return false
+	}
+	if r.messageRegex != nil && !r.messageRegex.MatchString(input.message) {
+		return false
+	}
+	return true
+}
+
+// Returns the level of the first matching rule
+func getSeverityLevel(input *severityInput) sentry.Level {
+	for _, rule := range severityRules {
+		if rule.matches(input) {
+			return rule.level
+		}
+	}
+	if input.eventType == v1.EventTypeNormal {
+		return defaultNormalEventSeverityLevel
+	}
+	return defaultSeverityLevel
+}
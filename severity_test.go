@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// test that the configured rules go before the built-in ones, and the
+// first matching rule wins
+func TestGetSeverityLevel(t *testing.T) {
+
+	rules, err := parseSeverityRules(`[
+		{"reason": "BackOff", "kind": "Pod", "message": "pulling image", "level": "warning"},
+		{"exitCode": 143, "level": "info"},
+		{"component": "cluster-autoscaler", "level": "debug"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultRules := severityRules
+	severityRules = rules
+	defer func() {
+		severityRules = defaultRules
+	}()
+
+	exitCode := int32(143)
+	cases := []struct {
+		name  string
+		input *severityInput
+		level sentry.Level
+	}{
+		{"OOMKilled", &severityInput{reason: "OOMKilled", kind: "Pod"}, sentry.LevelFatal},
+		{"readiness probe", &severityInput{reason: "Unhealthy", message: "Readiness probe failed: HTTP probe failed with statuscode: 503"}, sentry.LevelWarning},
+		{"liveness probe", &severityInput{reason: "Unhealthy", message: "Liveness probe failed: connection refused"}, sentry.LevelError},
+		{"image pull back-off", &severityInput{reason: "BackOff", kind: "Pod", message: "Back-off pulling image \"web:1.0\""}, sentry.LevelWarning},
+		{"back-off", &severityInput{reason: "BackOff", kind: "Pod", message: "Back-off restarting failed container"}, sentry.LevelError},
+		{"exit code", &severityInput{reason: "Error", kind: "Pod", exitCode: &exitCode}, sentry.LevelInfo},
+		{"component", &severityInput{reason: "ScaleDown", component: "cluster-autoscaler"}, sentry.LevelDebug},
+		{"component case", &severityInput{reason: "ScaleDown", component: "Cluster-Autoscaler"}, sentry.LevelDebug},
+		{"no match", &severityInput{reason: "FailedMount", kind: "Pod"}, defaultSeverityLevel},
+	}
+	for _, c := range cases {
+		if level := getSeverityLevel(c.input); level != c.level {
+			t.Errorf("%s: received level %q, wanted %q", c.name, level, c.level)
+		}
+	}
+
+	invalidRules := []string{
+		`[{"reason": "BackOff", "level": "critical"}]`,
+		`[{"message": "(", "level": "error"}]`,
+		`[{"unknown": "field", "level": "error"}]`,
+	}
+	for _, raw := range invalidRules {
+		if _, err := parseSeverityRules(raw); err == nil {
+			t.Errorf("no error for invalid rules %s", raw)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	globalLogger "github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The namespaces of a single replica of a sharded agent. Every namespace is
+// owned by exactly one ready replica, so its events and crons are reported
+// once.
+type shardAssignment struct {
+	ordinal int
+
+	mu sync.Mutex
+	// The ordinals of the ready replicas of the StatefulSet, sorted
+	ready []int
+	// Called when the ready replicas change
+	rebalanceCallbacks []func()
+}
+
+// nil if sharding is disabled
+var agentShard *shardAssignment
+
+func newShardAssignment(ordinal int, ready []int) *shardAssignment {
+	shard := &shardAssignment{ordinal: ordinal}
+	shard.ready = normalizeOrdinals(ready)
+	return shard
+}
+
+func normalizeOrdinals(ordinals []int) []int {
+	sorted := append([]int{}, ordinals...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+// Rendezvous hashing: every shard scores the namespace, the highest score
+// wins. When a shard is added or removed, only the namespaces of that shard
+// move. Returns -1 if there are no shards.
+func getNamespaceShard(namespace string, shards []int) int {
+	owner := -1
+	var ownerScore uint64
+	for _, shard := range shards {
+		hash := fnv.New64a()
+		hash.Write([]byte(namespace))
+		hash.Write([]byte{0})
+		hash.Write([]byte(strconv.Itoa(shard)))
+		if score := hash.Sum64(); owner == -1 || score > ownerScore {
+			owner, ownerScore = shard, score
+		}
+	}
+	return owner
+}
+
+func (s *shardAssignment) readyOrdinals() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// A replica that is not ready owns nothing, its namespaces are owned by the
+// ready replicas meanwhile
+func (s *shardAssignment) owns(namespace string) bool {
+	return getNamespaceShard(namespace, s.readyOrdinals()) == s.ordinal
+}
+
+// The first replica watches the cluster-scoped objects, like nodes
+func (s *shardAssignment) ownsClusterObjects() bool {
+	return s.ordinal == 0
+}
+
+func (s *shardAssignment) onRebalance(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rebalanceCallbacks = append(s.rebalanceCallbacks, fn)
+}
+
+func (s *shardAssignment) setReadyOrdinals(ordinals []int) {
+	ordinals = normalizeOrdinals(ordinals)
+	s.mu.Lock()
+	if reflect.DeepEqual(s.ready, ordinals) {
+		s.mu.Unlock()
+		return
+	}
+	s.ready = ordinals
+	callbacks := append([]func(){}, s.rebalanceCallbacks...)
+	s.mu.Unlock()
+
+	globalLogger.Info().Msgf("Ready shards changed to %v, rebalancing namespaces", ordinals)
+	for _, callback := range callbacks {
+		callback()
+	}
+}
+
+// true -> this replica watches the cluster-scoped objects
+func ownsClusterObjects() bool {
+	return agentShard == nil || agentShard.ownsClusterObjects()
+}
+
+// StatefulSet pods are named "<statefulset>-<ordinal>"
+func parseStatefulSetPodName(podName string) (statefulSetName string, ordinal int, err error) {
+	separator := strings.LastIndex(podName, "-")
+	if separator <= 0 {
+		return "", 0, fmt.Errorf("%q is not a StatefulSet pod name", podName)
+	}
+	ordinal, err = strconv.Atoi(podName[separator+1:])
+	if err != nil || ordinal < 0 {
+		return "", 0, fmt.Errorf("%q is not a StatefulSet pod name", podName)
+	}
+	return podName[:separator], ordinal, nil
+}
+
+// The number of shards is the number of ready replicas, so a replica only
+// gets namespaces once it runs, and its namespaces are taken over by the
+// others when it stops. Never more than the desired replicas, a scaled down
+// replica might still be ready while it shuts down.
+// The ordinals of the pods of the StatefulSet that are ready and not being
+// deleted
+func getReadyOrdinals(statefulSetName string, pods []interface{}) []int {
+	ordinals := []int{}
+	for _, obj := range pods {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
+		}
+		name, ordinal, err := parseStatefulSetPodName(pod.Name)
+		if err != nil || name != statefulSetName {
+			continue
+		}
+		ordinals = append(ordinals, ordinal)
+	}
+	return normalizeOrdinals(ordinals)
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Must be called before the informers are started. The namespaces are
+// distributed between the ready pods of the agent's StatefulSet.
+func startSharding(ctx context.Context, config *rest.Config) (*shardAssignment, error) {
+	if !isTruthy(getConfigValue("SENTRY_K8S_SHARDING")) {
+		return nil, nil
+	}
+
+	// The hostname is the pod name
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	statefulSetName, ordinal, err := parseStatefulSetPodName(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if name := strings.TrimSpace(getConfigValue("SENTRY_K8S_SHARDING_STATEFULSET")); name != "" {
+		statefulSetName = name
+	}
+	namespace := getAgentNamespace()
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, statefulSetName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the StatefulSet of the agent: %v", err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(statefulSet.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector of the StatefulSet of the agent: %v", err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		clientset,
+		0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector.String()
+		}),
+	)
+	podInformer := factory.Core().V1().Pods().Informer()
+
+	// The initial assignment must be known before the namespaces are watched
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), podInformer.HasSynced) {
+		return nil, fmt.Errorf("cannot list the pods of the StatefulSet of the agent")
+	}
+	shard := newShardAssignment(ordinal, getReadyOrdinals(statefulSetName, podInformer.GetStore().List()))
+	agentShard = shard
+	globalLogger.Info().Msgf(
+		"Sharding is enabled, StatefulSet: %s/%s, shard: %d, ready shards: %v",
+		namespace, statefulSetName, ordinal, shard.readyOrdinals(),
+	)
+
+	rebalance := func() {
+		shard.setReadyOrdinals(getReadyOrdinals(statefulSetName, podInformer.GetStore().List()))
+	}
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { rebalance() },
+		UpdateFunc: func(oldObj, newObj interface{}) { rebalance() },
+		DeleteFunc: func(obj interface{}) { rebalance() },
+	})
+
+	return shard, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// test that every namespace is owned by exactly one shard, and that adding
+// a shard only moves namespaces to the new shard
+func TestGetNamespaceShard(t *testing.T) {
+
+	namespaces := make([]string, 1000)
+	for i := range namespaces {
+		namespaces[i] = fmt.Sprintf("namespace-%d", i)
+	}
+
+	owned := make([]int, 4)
+	for _, namespace := range namespaces {
+		owners := 0
+		for ordinal := range owned {
+			if newShardAssignment(ordinal, []int{0, 1, 2, 3}).owns(namespace) {
+				owners++
+				owned[ordinal]++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("namespace %s is owned by %d shards", namespace, owners)
+		}
+
+		before := getNamespaceShard(namespace, []int{0, 1, 2, 3})
+		if after := getNamespaceShard(namespace, []int{0, 1, 2, 3, 4}); after != before && after != 4 {
+			t.Errorf("namespace %s moved from shard %d to shard %d", namespace, before, after)
+		}
+	}
+	for ordinal, count := range owned {
+		if count < 150 {
+			t.Errorf("shard %d owns only %d of %d namespaces", ordinal, count, len(namespaces))
+		}
+	}
+
+	// Replicas that are not ready own nothing
+	if newShardAssignment(4, []int{0, 1, 2, 3}).owns("namespace-0") {
+		t.Errorf("namespace is owned by a shard that is not ready")
+	}
+	if getNamespaceShard("namespace-0", nil) != -1 {
+		t.Errorf("namespace is owned without ready shards")
+	}
+
+	if name, ordinal, err := parseStatefulSetPodName("sentry-kubernetes-12"); err != nil || name != "sentry-kubernetes" || ordinal != 12 {
+		t.Errorf("wrong StatefulSet pod name parsing: %q, %d, %v", name, ordinal, err)
+	}
+	if _, _, err := parseStatefulSetPodName("sentry-kubernetes-5d4f8"); err == nil {
+		t.Errorf("no error for a Deployment pod name")
+	}
+}
+
+// test that the namespaces are rebalanced when the ready shards change
+func TestShardRebalance(t *testing.T) {
+
+	shard := newShardAssignment(0, []int{0})
+	selection := &namespaceSelection{all: true, shard: shard}
+	if selection.isStatic() {
+		t.Fatalf("sharded selection is static")
+	}
+	if selection.watchesAllNamespaces() {
+		t.Fatalf("sharded selection watches all namespaces with one set of informers")
+	}
+
+	watchers := newNamespaceWatchers(selection)
+	stopped := map[string]bool{}
+	watchers.subscribe(context.Background(), nil, func(ctx context.Context, namespace string, unselected bool) {
+		stopped[namespace] = unselected
+	})
+
+	namespaces := []*corev1.Namespace{}
+	for i := 0; i < 20; i++ {
+		namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("namespace-%d", i)}})
+	}
+	shard.onRebalance(func() {
+		for _, namespace := range namespaces {
+			watchers.sync(context.Background(), namespace)
+		}
+	})
+	for _, namespace := range namespaces {
+		watchers.sync(context.Background(), namespace)
+	}
+	if len(watchers.namespaces()) != len(namespaces) {
+		t.Fatalf("watching %d namespaces, wanted %d", len(watchers.namespaces()), len(namespaces))
+	}
+
+	shard.setReadyOrdinals([]int{1, 0})
+	for _, namespace := range namespaces {
+		watched := watchers.isWatched(namespace.Name)
+		if owned := getNamespaceShard(namespace.Name, []int{0, 1}) == 0; watched != owned {
+			t.Errorf("namespace %s: watched %v, owned %v", namespace.Name, watched, owned)
+		}
+	}
+	if len(watchers.namespaces()) == len(namespaces) {
+		t.Errorf("no namespaces were moved to the new shard")
+	}
+	// The namespaces moved to the other shard are still selected, so their
+	// checkpoints are kept
+	for namespace, unselected := range stopped {
+		if unselected {
+			t.Errorf("namespace %s was unselected by the rebalance", namespace)
+		}
+	}
+}
+
+// test that the namespaces of a replica that is not ready are taken over by
+// the ready ones, whatever its ordinal
+func TestGetReadyOrdinals(t *testing.T) {
+
+	newPod := func(name string, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: corev1.PodStatus{
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			},
+		}
+	}
+	deleted := newPod("sentry-kubernetes-3", corev1.ConditionTrue)
+	deleted.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	pods := []interface{}{
+		newPod("sentry-kubernetes-2", corev1.ConditionTrue),
+		newPod("sentry-kubernetes-1", corev1.ConditionFalse),
+		newPod("sentry-kubernetes-0", corev1.ConditionTrue),
+		newPod("other-0", corev1.ConditionTrue),
+		deleted,
+	}
+	ready := getReadyOrdinals("sentry-kubernetes", pods)
+	if !reflect.DeepEqual(ready, []int{0, 2}) {
+		t.Fatalf("received ready ordinals %v, wanted %v", ready, []int{0, 2})
+	}
+
+	for i := 0; i < 100; i++ {
+		namespace := fmt.Sprintf("namespace-%d", i)
+		owners := 0
+		for ordinal := 0; ordinal < 3; ordinal++ {
+			if newShardAssignment(ordinal, ready).owns(namespace) {
+				owners++
+				if ordinal == 1 {
+					t.Errorf("namespace %s is owned by the replica that is not ready", namespace)
+				}
+			}
+		}
+		if owners != 1 {
+			t.Errorf("namespace %s is owned by %d shards", namespace, owners)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Each parser recognizes stack traces of a single language/runtime, and
+// returns the exceptions ordered from the oldest (root cause) to the newest,
+// as Sentry expects them, or nil if nothing was found.
+// The order matters: parsers with more specific headers go first.
+var stackTraceParsers = []func(lines []string) []sentry.Exception{
+	parseGoPanic,
+	parsePythonTraceback,
+	parseJavaStackTrace,
+	parseNodeStackTrace,
+}
+
+// Tries to find a stack trace in the given text (termination message, logs),
+// returns nil if nothing is found
+func extractExceptions(text string) []sentry.Exception {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	for _, parse := range stackTraceParsers {
+		exceptions := parse(lines)
+		if len(exceptions) > 0 {
+			return exceptions
+		}
+	}
+	return nil
+}
+
+func newStacktrace(frames []sentry.Frame) *sentry.Stacktrace {
+	if len(frames) == 0 {
+		return nil
+	}
+	return &sentry.Stacktrace{Frames: frames}
+}
+
+// Most runtimes print the innermost frame first, Sentry wants it last
+func reverseFrames(frames []sentry.Frame) []sentry.Frame {
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+func reverseExceptions(exceptions []sentry.Exception) []sentry.Exception {
+	for i, j := 0, len(exceptions)-1; i < j; i, j = i+1, j-1 {
+		exceptions[i], exceptions[j] = exceptions[j], exceptions[i]
+	}
+	return exceptions
+}
+
+// / Go
+
+var goPanicRegex = regexp.MustCompile(`^(panic|fatal error): (.*)$`)
+var goGoroutineRegex = regexp.MustCompile(`^goroutine \d+ \[[^\]]*\]:$`)
+var goFileRegex = regexp.MustCompile(`^\s+(.+\.go):(\d+)(?: \+0x[0-9a-f]+)?$`)
+
+// "github.com/org/app/server.(*Server).handle(0xc000010000)" ->
+// "github.com/org/app/server", "(*Server).handle"
+func splitGoFunction(line string) (module string, function string) {
+	// The goroutine creator: "created by main.main in goroutine 1"
+	line = strings.TrimPrefix(line, "created by ")
+	if i := strings.Index(line, " in goroutine "); i > 0 {
+		line = line[:i]
+	}
+	// Strip the arguments
+	if strings.HasSuffix(line, ")") {
+		if i := strings.LastIndex(line, "("); i > 0 {
+			line = line[:i]
+		}
+	}
+	// The package path has dots in the domain part, so look after the last slash
+	lastSlash := strings.LastIndex(line, "/")
+	dot := strings.Index(line[lastSlash+1:], ".")
+	if dot < 0 {
+		return "", line
+	}
+	dot += lastSlash + 1
+	return line[:dot], line[dot+1:]
+}
+
+func isGoFrameInApp(module string, path string) bool {
+	if module == "runtime" || strings.HasPrefix(module, "runtime/") {
+		return false
+	}
+	// Dependencies and the standard library (of the official images)
+	return !strings.Contains(path, "/pkg/mod/") && !strings.HasPrefix(path, "/usr/local/go/src/")
+}
+
+func parseGoPanic(lines []string) []sentry.Exception {
+	for i, line := range lines {
+		match := goPanicRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		exception := sentry.Exception{Type: match[1], Value: match[2]}
+
+		// Only the first goroutine (the one that panicked) is interesting
+		j := i + 1
+		for ; j < len(lines) && !goGoroutineRegex.MatchString(strings.TrimSpace(lines[j])); j++ {
+		}
+		frames := []sentry.Frame{}
+		for j++; j+1 < len(lines); j += 2 {
+			functionLine := strings.TrimSpace(lines[j])
+			fileMatch := goFileRegex.FindStringSubmatch(lines[j+1])
+			if functionLine == "" || fileMatch == nil {
+				break
+			}
+			module, function := splitGoFunction(functionLine)
+			lineno, _ := strconv.Atoi(fileMatch[2])
+			frames = append(frames, sentry.Frame{
+				Function: function,
+				Module:   module,
+				AbsPath:  fileMatch[1],
+				Filename: filepath.Base(fileMatch[1]),
+				Lineno:   lineno,
+				InApp:    isGoFrameInApp(module, fileMatch[1]),
+				Platform: "go",
+			})
+		}
+
+		exception.Stacktrace = newStacktrace(reverseFrames(frames))
+		return []sentry.Exception{exception}
+	}
+	return nil
+}
+
+// / Python
+
+const pythonTracebackHeader = "Traceback (most recent call last):"
+
+var pythonFrameRegex = regexp.MustCompile(`^\s+File "([^"]+)", line (\d+)(?:, in (.+))?$`)
+var pythonExceptionRegex = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?:: (.*))?$`)
+
+func isPythonFrameInApp(path string) bool {
+	return !strings.Contains(path, "site-packages") &&
+		!strings.Contains(path, "dist-packages") &&
+		!strings.HasPrefix(path, "/usr/lib/python") &&
+		!strings.HasPrefix(path, "/usr/local/lib/python") &&
+		!strings.HasPrefix(path, "<frozen")
+}
+
+// Lines between the tracebacks of chained exceptions
+var pythonChainMarkers = []string{
+	"During handling of the above exception, another exception occurred:",
+	"The above exception was the direct cause of the following exception:",
+}
+
+func isPythonChainMarker(line string) bool {
+	for _, marker := range pythonChainMarkers {
+		if line == marker {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePythonTraceback(lines []string) []sentry.Exception {
+	exceptions := []sentry.Exception{}
+	chained := false
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		if isPythonChainMarker(line) {
+			chained = true
+			continue
+		}
+		if line != pythonTracebackHeader {
+			chained = false
+			continue
+		}
+		// Logs may contain several unrelated tracebacks, the last one is
+		// the most relevant for a crash
+		if !chained {
+			exceptions = []sentry.Exception{}
+		}
+		chained = false
+
+		frames := []sentry.Frame{}
+		j := i + 1
+		for ; j < len(lines); j++ {
+			match := pythonFrameRegex.FindStringSubmatch(lines[j])
+			if match != nil {
+				lineno, _ := strconv.Atoi(match[2])
+				frames = append(frames, sentry.Frame{
+					Function: match[3],
+					AbsPath:  match[1],
+					Filename: filepath.Base(match[1]),
+					Lineno:   lineno,
+					InApp:    isPythonFrameInApp(match[1]),
+					Platform: "python",
+				})
+				continue
+			}
+			if strings.HasPrefix(lines[j], " ") {
+				// The source code line of the previous frame
+				if len(frames) > 0 && frames[len(frames)-1].ContextLine == "" {
+					frames[len(frames)-1].ContextLine = strings.TrimSpace(lines[j])
+				}
+				continue
+			}
+			break
+		}
+		if j >= len(lines) {
+			break
+		}
+
+		// The exception line follows the frames
+		match := pythonExceptionRegex.FindStringSubmatch(strings.TrimSpace(lines[j]))
+		if match == nil {
+			continue
+		}
+		exception := sentry.Exception{Type: match[1], Value: match[2]}
+		if dot := strings.LastIndex(match[1], "."); dot > 0 {
+			exception.Module = match[1][:dot]
+			exception.Type = match[1][dot+1:]
+		}
+		// Python prints the innermost frame last already
+		exception.Stacktrace = newStacktrace(frames)
+		// Chained exceptions are printed from the oldest to the newest
+		exceptions = append(exceptions, exception)
+		i = j
+	}
+
+	if len(exceptions) == 0 {
+		return nil
+	}
+	return exceptions
+}
+
+// / Java (and other JVM languages)
+
+var javaExceptionRegex = regexp.MustCompile(`^(?:Exception in thread "[^"]*" |Caused by: )?((?:[a-zA-Z_$][\w$]*\.)+[A-Z][\w$]*(?:Exception|Error|Throwable)[\w$]*)(?:: (.*))?$`)
+var javaFrameRegex = regexp.MustCompile(`^\s+at (?:[\w.$-]+/)*([\w$.<>]+)\.([\w$<>-]+)\(([^)]*)\)$`)
+
+func isJavaFrameInApp(module string) bool {
+	for _, prefix := range []string{"java.", "javax.", "jdk.", "sun.", "com.sun.", "kotlin.", "kotlinx.", "scala.", "org.springframework.", "org.apache."} {
+		if strings.HasPrefix(module, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseJavaStackTrace(lines []string) []sentry.Exception {
+	exceptions := []sentry.Exception{}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		match := javaExceptionRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		// The "Caused by" chain only continues an already found exception
+		isCause := strings.HasPrefix(line, "Caused by: ")
+		if isCause && len(exceptions) == 0 {
+			continue
+		}
+
+		exception := sentry.Exception{Type: match[1], Value: match[2]}
+		if dot := strings.LastIndex(match[1], "."); dot > 0 {
+			exception.Module = match[1][:dot]
+			exception.Type = match[1][dot+1:]
+		}
+
+		frames := []sentry.Frame{}
+		j := i + 1
+		for ; j < len(lines); j++ {
+			frameMatch := javaFrameRegex.FindStringSubmatch(lines[j])
+			if frameMatch == nil {
+				if strings.HasPrefix(strings.TrimSpace(lines[j]), "... ") {
+					// "... 3 more": the frames are shared with the enclosing exception
+					continue
+				}
+				break
+			}
+			frame := sentry.Frame{
+				Module:   frameMatch[1],
+				Function: frameMatch[2],
+				InApp:    isJavaFrameInApp(frameMatch[1]),
+				Platform: "java",
+			}
+			// "App.java:25", "Native Method", "Unknown Source"
+			if filename, rawLineno, found := strings.Cut(frameMatch[3], ":"); found {
+				frame.Filename = filename
+				frame.Lineno, _ = strconv.Atoi(rawLineno)
+			} else {
+				frame.Filename = frameMatch[3]
+			}
+			frames = append(frames, frame)
+		}
+		if len(frames) == 0 {
+			// Just a log line that mentions an exception
+			continue
+		}
+		// Logs may contain several unrelated stack traces, the last one is
+		// the most relevant for a crash
+		if !isCause {
+			exceptions = []sentry.Exception{}
+		}
+
+		exception.Stacktrace = newStacktrace(reverseFrames(frames))
+		exceptions = append(exceptions, exception)
+		i = j - 1
+	}
+
+	if len(exceptions) == 0 {
+		return nil
+	}
+	// Java prints the outermost exception first, and its causes after it
+	return reverseExceptions(exceptions)
+}
+
+// / Node.js
+
+var nodeExceptionRegex = regexp.MustCompile(`^(?:Uncaught )?([A-Z][\w$]*(?:Error|Exception)|Error)(?: \[[\w_]+\])?: (.*)$`)
+var nodeFrameRegex = regexp.MustCompile(`^\s+at (?:(.+?) \()?(.+?):(\d+):(\d+)\)?$`)
+
+func isNodeFrameInApp(path string) bool {
+	return !strings.HasPrefix(path, "node:") &&
+		!strings.HasPrefix(path, "internal/") &&
+		!strings.Contains(path, "node_modules")
+}
+
+func parseNodeStackTrace(lines []string) []sentry.Exception {
+	var exceptions []sentry.Exception
+
+	for i := 0; i < len(lines); i++ {
+		match := nodeExceptionRegex.FindStringSubmatch(strings.TrimSpace(lines[i]))
+		if match == nil {
+			continue
+		}
+
+		frames := []sentry.Frame{}
+		j := i + 1
+		for ; j < len(lines); j++ {
+			frameMatch := nodeFrameRegex.FindStringSubmatch(lines[j])
+			if frameMatch == nil {
+				break
+			}
+			path := strings.TrimPrefix(frameMatch[2], "file://")
+			lineno, _ := strconv.Atoi(frameMatch[3])
+			colno, _ := strconv.Atoi(frameMatch[4])
+			frames = append(frames, sentry.Frame{
+				Function: frameMatch[1],
+				AbsPath:  path,
+				Filename: filepath.Base(path),
+				Lineno:   lineno,
+				Colno:    colno,
+				InApp:    isNodeFrameInApp(path),
+				Platform: "node",
+			})
+		}
+		if len(frames) == 0 {
+			// Just a log line that mentions an error
+			continue
+		}
+
+		// The last error is the most relevant for a crash
+		exceptions = []sentry.Exception{{
+			Type:       match[1],
+			Value:      match[2],
+			Stacktrace: newStacktrace(reverseFrames(frames)),
+		}}
+		i = j - 1
+	}
+	return exceptions
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const goPanicSample = `starting server
+panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4553d0]
+
+goroutine 1 [running]:
+github.com/example/app/server.(*Server).handle(0x0, {0x4c2a80, 0xc000012345})
+	/src/server/server.go:42 +0x10
+main.main()
+	/src/main.go:17 +0x25
+
+goroutine 6 [chan receive]:
+main.worker()
+	/src/worker.go:10 +0x30
+`
+
+const pythonTracebackSample = `INFO starting
+Traceback (most recent call last):
+  File "/app/db.py", line 10, in connect
+    raise ConnectionError("refused")
+ConnectionError: refused
+
+During handling of the above exception, another exception occurred:
+
+Traceback (most recent call last):
+  File "/app/main.py", line 25, in <module>
+    main()
+  File "/usr/local/lib/python3.11/site-packages/click/core.py", line 1130, in __call__
+    return self.main(*args, **kwargs)
+  File "/app/main.py", line 20, in main
+    connect()
+app.errors.StartupError: cannot start
+`
+
+const javaStackTraceSample = `Exception in thread "main" java.lang.IllegalStateException: cannot start
+	at com.example.app.Main.start(Main.java:30)
+	at com.example.app.Main.main(Main.java:12)
+Caused by: java.io.FileNotFoundException: /etc/app.conf (No such file or directory)
+	at java.base/java.io.FileInputStream.open0(Native Method)
+	at com.example.app.Config.load(Config.java:8)
+	... 2 more
+`
+
+const nodeStackTraceSample = `listening on 8080
+/app/index.js:5
+    throw new TypeError("bad input");
+    ^
+
+TypeError: bad input
+    at parse (/app/lib/parser.js:5:11)
+    at Object.<anonymous> (/app/index.js:3:1)
+    at node:internal/main/run_main_module:23:47
+`
+
+// test that stack traces of all supported runtimes are turned into
+// exceptions, ordered the way Sentry expects them: causes first,
+// the innermost frame last
+func TestExtractExceptions(t *testing.T) {
+
+	type expectedException struct {
+		Type       string
+		Value      string
+		NumFrames  int
+		LastFrame  sentry.Frame
+		FirstInApp bool
+	}
+
+	testCases := map[string]struct {
+		text     string
+		expected []expectedException
+	}{
+		"go": {
+			text: goPanicSample,
+			expected: []expectedException{
+				{
+					Type:       "panic",
+					Value:      "runtime error: invalid memory address or nil pointer dereference",
+					NumFrames:  2,
+					LastFrame:  sentry.Frame{Module: "github.com/example/app/server", Function: "(*Server).handle", Filename: "server.go", Lineno: 42},
+					FirstInApp: true,
+				},
+			},
+		},
+		"python": {
+			text: pythonTracebackSample,
+			expected: []expectedException{
+				{
+					Type:       "ConnectionError",
+					Value:      "refused",
+					NumFrames:  1,
+					LastFrame:  sentry.Frame{Function: "connect", Filename: "db.py", Lineno: 10},
+					FirstInApp: true,
+				},
+				{
+					Type:       "StartupError",
+					Value:      "cannot start",
+					NumFrames:  3,
+					LastFrame:  sentry.Frame{Function: "main", Filename: "main.py", Lineno: 20},
+					FirstInApp: true,
+				},
+			},
+		},
+		"java": {
+			text: javaStackTraceSample,
+			expected: []expectedException{
+				{
+					Type:       "FileNotFoundException",
+					Value:      "/etc/app.conf (No such file or directory)",
+					NumFrames:  2,
+					LastFrame:  sentry.Frame{Module: "java.io.FileInputStream", Function: "open0", Filename: "Native Method"},
+					FirstInApp: true,
+				},
+				{
+					Type:       "IllegalStateException",
+					Value:      "cannot start",
+					NumFrames:  2,
+					LastFrame:  sentry.Frame{Module: "com.example.app.Main", Function: "start", Filename: "Main.java", Lineno: 30},
+					FirstInApp: true,
+				},
+			},
+		},
+		"node": {
+			text: nodeStackTraceSample,
+			expected: []expectedException{
+				{
+					Type:       "TypeError",
+					Value:      "bad input",
+					NumFrames:  3,
+					LastFrame:  sentry.Frame{Function: "parse", Filename: "parser.js", Lineno: 5},
+					FirstInApp: false,
+				},
+			},
+		},
+		"no stack trace": {
+			text:     "Error: something went wrong\nexiting",
+			expected: nil,
+		},
+	}
+
+	for name, testCase := range testCases {
+		exceptions := extractExceptions(testCase.text)
+		if len(exceptions) != len(testCase.expected) {
+			t.Errorf("[%s] received %d exceptions, wanted %d", name, len(exceptions), len(testCase.expected))
+			continue
+		}
+
+		for i, expected := range testCase.expected {
+			exception := exceptions[i]
+			if exception.Type != expected.Type || exception.Value != expected.Value {
+				t.Errorf("[%s] received exception %q: %q, wanted %q: %q", name, exception.Type, exception.Value, expected.Type, expected.Value)
+			}
+			if exception.Stacktrace == nil || len(exception.Stacktrace.Frames) != expected.NumFrames {
+				t.Errorf("[%s] exception %q: unexpected number of frames, wanted %d", name, exception.Type, expected.NumFrames)
+				continue
+			}
+
+			frames := exception.Stacktrace.Frames
+			lastFrame := frames[len(frames)-1]
+			if lastFrame.Module != expected.LastFrame.Module ||
+				lastFrame.Function != expected.LastFrame.Function ||
+				lastFrame.Filename != expected.LastFrame.Filename ||
+				lastFrame.Lineno != expected.LastFrame.Lineno {
+				t.Errorf("[%s] received last frame %s.%s (%s:%d), wanted %s.%s (%s:%d)", name,
+					lastFrame.Module, lastFrame.Function, lastFrame.Filename, lastFrame.Lineno,
+					expected.LastFrame.Module, expected.LastFrame.Function, expected.LastFrame.Filename, expected.LastFrame.Lineno)
+			}
+			if frames[0].InApp != expected.FirstInApp {
+				t.Errorf("[%s] exception %q: received InApp=%v for the first frame, wanted %v", name, exception.Type, frames[0].InApp, expected.FirstInApp)
+			}
+		}
+	}
+}
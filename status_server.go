@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	globalLogger "github.com/rs/zerolog/log"
+)
+
+const defaultStatusAddress = ":8080"
+
+// Set when the agent starts shutting down, so it's not ready anymore
+var shuttingDown atomic.Bool
+
+type agentStatus struct {
+	Version  string                  `json:"version"`
+	Ready    bool                    `json:"ready"`
+	Healthy  bool                    `json:"healthy"`
+	Leader   bool                    `json:"leader"`
+	Watchers []watcherStatusSnapshot `json:"watchers"`
+}
+
+func getAgentStatus() *agentStatus {
+	status := &agentStatus{
+		Version:  version,
+		Ready:    !shuttingDown.Load(),
+		Healthy:  true,
+		Leader:   isLeader(),
+		Watchers: watcherStatuses.snapshot(),
+	}
+	if len(status.Watchers) == 0 {
+		// Nothing is watched yet
+		status.Ready = false
+	}
+	for _, watcher := range status.Watchers {
+		status.Ready = status.Ready && watcher.Synced
+		status.Healthy = status.Healthy && watcher.Healthy
+	}
+	return status
+}
+
+func writeProbeResponse(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ok\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func newStatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	// Only checks that the process serves requests. The informers retry on
+	// their own, restarting the agent doesn't fix e.g. missing permissions.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeResponse(w, true)
+	})
+	// Ready once all informers have synced and are watching, and none of them
+	// keeps failing
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := getAgentStatus()
+		writeProbeResponse(w, status.Ready && status.Healthy)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(getAgentStatus()); err != nil {
+			globalLogger.Error().Msgf("Cannot encode the agent status: %v", err)
+		}
+	})
+	return mux
+}
+
+// Serves the health, readiness and status endpoints until the context is
+// cancelled
+func startStatusServer(ctx context.Context) {
+	address := strings.TrimSpace(getConfigValue("SENTRY_K8S_STATUS_ADDRESS"))
+	if address == "" {
+		address = defaultStatusAddress
+	}
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           newStatusHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		globalLogger.Info().Msgf("Serving the status endpoints on %s", address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			globalLogger.Error().Msgf("Status server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shuttingDown.Store(true)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// test that the agent is ready once the informers are synced, and that the
+// status page lists the watchers with their events and errors
+func TestStatusServer(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "TestStatusServerPod", Namespace: "TestStatusServerNamespace"}}
+	factory := informers.NewSharedInformerFactoryWithOptions(fake.NewSimpleClientset(pod), 0, informers.WithNamespace(pod.Namespace))
+	podInformer := factory.Core().V1().Pods().Informer()
+	status := registerWatcher(ctx, podsWatcherName, pod.Namespace, podInformer)
+	podInformer.AddEventHandler(status.wrapHandler(cache.ResourceEventHandlerFuncs{}))
+
+	server := httptest.NewServer(newStatusHandler())
+	defer server.Close()
+	getStatusCode := func(path string) int {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if code := getStatusCode("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("received %d from /readyz before the informers are synced, wanted %d", code, http.StatusServiceUnavailable)
+	}
+
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	// The handlers are notified asynchronously
+	deadline := time.Now().Add(time.Second)
+	for status.snapshot(time.Now()).LastEventTime == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code := getStatusCode("/readyz"); code != http.StatusOK {
+		t.Errorf("received %d from /readyz, wanted %d", code, http.StatusOK)
+	}
+	if code := getStatusCode("/healthz"); code != http.StatusOK {
+		t.Errorf("received %d from /healthz, wanted %d", code, http.StatusOK)
+	}
+
+	status.recordError(errors.New("watch failed"))
+	response, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	agentStatus := &agentStatus{}
+	if err := json.NewDecoder(response.Body).Decode(agentStatus); err != nil {
+		t.Fatal(err)
+	}
+	if len(agentStatus.Watchers) != 1 {
+		t.Fatalf("received %d watchers, wanted %d", len(agentStatus.Watchers), 1)
+	}
+	watcher := agentStatus.Watchers[0]
+	if watcher.Name != podsWatcherName || watcher.Namespace != pod.Namespace || !watcher.Synced {
+		t.Errorf("wrong watcher status: %+v", watcher)
+	}
+	if watcher.LastEventTime == nil || watcher.ErrorCount != 1 || watcher.LastError != "watch failed" {
+		t.Errorf("events and errors are not recorded: %+v", watcher)
+	}
+
+	// Keeps failing
+	status.mu.Lock()
+	status.failingSince = time.Now().Add(-watcherUnhealthyAfter)
+	status.mu.Unlock()
+	if code := getStatusCode("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("received %d from /readyz for a failing watcher, wanted %d", code, http.StatusServiceUnavailable)
+	}
+	// The process itself is fine
+	if code := getStatusCode("/healthz"); code != http.StatusOK {
+		t.Errorf("received %d from /healthz for a failing watcher, wanted %d", code, http.StatusOK)
+	}
+
+	// Stopped watchers are removed
+	cancel()
+	deadline = time.Now().Add(time.Second)
+	for len(watcherStatuses.snapshot()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if watchers := watcherStatuses.snapshot(); len(watchers) != 0 {
+		t.Errorf("received %d watchers after stopping, wanted none", len(watchers))
+	}
+}
@@ -15,6 +15,20 @@ var truthyStrings map[string]struct{} = map[string]struct{}{
 	"1":    {},
 }
 
+var falsyStrings map[string]struct{} = map[string]struct{}{
+	"no":    {},
+	"false": {},
+	"0":     {},
+}
+
+// true -> the value is empty, truthy or falsy
+func isValidBool(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	_, truthy := truthyStrings[s]
+	_, falsy := falsyStrings[s]
+	return s == "" || truthy || falsy
+}
+
 func isTruthy(s string) bool {
 	s = strings.ToLower(strings.TrimSpace(s))
 	_, found := truthyStrings[s]
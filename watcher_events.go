@@ -2,24 +2,22 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"time"
+	"sort"
+	"sync"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
-	toolsWatch "k8s.io/client-go/tools/watch"
 )
 
 const eventsWatcherName = "events"
 
-func handleGeneralEvent(ctx context.Context, eventObject *v1.Event, scope *sentry.Scope) *sentry.Event {
+// cachedObject is the involved object if it's already available
+func handleGeneralEvent(ctx context.Context, eventObject *v1.Event, cachedObject interface{}, scope *sentry.Scope) *sentry.Event {
 	logger := zerolog.Ctx(ctx)
 
 	logger.Debug().Msgf("EventObject: %#v", eventObject)
@@ -43,9 +41,33 @@ func handleGeneralEvent(ctx context.Context, eventObject *v1.Event, scope *sentr
 			"Source": source,
 		})
 	}
-	setTagIfNotEmpty(scope, "event_source_component", eventObject.Source.Component)
+	setTagIfNotEmpty(scope, "event_source_component", getEventSourceComponent(eventObject))
 	eventObject.Source = v1.EventSource{}
 
+	// Fields that are mostly set by newer controllers (events.k8s.io/v1)
+	setTagIfNotEmpty(scope, "reporting_controller", eventObject.ReportingController)
+	setTagIfNotEmpty(scope, "action", eventObject.Action)
+
+	if eventObject.Related != nil {
+		related := eventObject.Related
+		setTagIfNotEmpty(scope, "related_kind", related.Kind)
+		setTagIfNotEmpty(scope, "related_name", related.Name)
+		if relatedObject, err := prettyJson(related); err == nil {
+			scope.SetContext("RelatedObject", sentry.Context{
+				"Object": relatedObject,
+			})
+		}
+		eventObject.Related = nil
+	}
+
+	if eventObject.Series != nil {
+		scope.SetContext("Series", sentry.Context{
+			"Count":              eventObject.Series.Count,
+			"Last observed time": eventObject.Series.LastObservedTime.String(),
+		})
+		eventObject.Series = nil
+	}
+
 	if involvedObject, err := prettyJson(eventObject.InvolvedObject); err == nil {
 		scope.SetContext("InvolvedObject", sentry.Context{
 			"Object": involvedObject,
@@ -69,39 +91,57 @@ func handleGeneralEvent(ctx context.Context, eventObject *v1.Event, scope *sentr
 		})
 	}
 
-	sentryEvent := buildSentryEventFromGeneralEvent(ctx, originalEvent, scope)
+	sentryEvent := buildSentryEventFromGeneralEvent(ctx, originalEvent, cachedObject, scope)
 	return sentryEvent
 }
 
-func buildSentryEventFromGeneralEvent(ctx context.Context, event *v1.Event, scope *sentry.Scope) *sentry.Event {
-	sentryEvent := &sentry.Event{Message: event.Message, Level: sentry.LevelError}
+func buildSentryEventFromGeneralEvent(ctx context.Context, event *v1.Event, cachedObject interface{}, scope *sentry.Scope) *sentry.Event {
+	level := getSeverityLevel(&severityInput{
+		eventType: event.Type,
+		reason:    event.Reason,
+		component: getEventSourceComponent(event),
+		kind:      event.InvolvedObject.Kind,
+		message:   event.Message,
+	})
+	sentryEvent := &sentry.Event{Message: event.Message, Level: level}
 	objectRef := &v1.ObjectReference{
-		Kind:      event.InvolvedObject.Kind,
-		Name:      event.InvolvedObject.Name,
-		Namespace: event.InvolvedObject.Namespace,
+		Kind:       event.InvolvedObject.Kind,
+		APIVersion: event.InvolvedObject.APIVersion,
+		Name:       event.InvolvedObject.Name,
+		Namespace:  event.InvolvedObject.Namespace,
+		UID:        event.InvolvedObject.UID,
 	}
-	runEnhancers(ctx, objectRef, nil, scope, sentryEvent)
+	runEnhancers(ctx, objectRef, cachedObject, scope, sentryEvent)
 	return sentryEvent
 }
 
-func handleWatchEvent(ctx context.Context, event *watch.Event, cutoffTime metav1.Time) {
+func handleWatchEvent(ctx context.Context, event *watch.Event, cutoffTime metav1.Time) (reported bool) {
+	if !inFlightEvents.start() {
+		return false
+	}
+	defer inFlightEvents.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+
 	logger := zerolog.Ctx(ctx)
 
 	eventObjectRaw := event.Object
 	// Watch event type: Added, Delete, Bookmark...
 	if (event.Type != watch.Added) && (event.Type != watch.Modified) {
 		logger.Debug().Msgf("Skipping a watch event of type %s", event.Type)
-		return
+		return false
 	}
 
 	objectKind := eventObjectRaw.GetObjectKind()
-	eventObject, ok := eventObjectRaw.(*v1.Event)
+	eventObject, ok := getCoreEvent(eventObjectRaw)
 	if !ok {
 		logger.Warn().Msgf("Skipping an event of kind '%v' because it cannot be casted", objectKind)
-		return
+		return false
 	}
 
-	defer addEventToBuffer(eventObject)
+	if isBufferedEvent(eventObject) {
+		defer addEventToBuffer(eventObject)
+	}
 
 	namespace := eventObject.Namespace
 	if namespace != "" {
@@ -109,126 +149,284 @@ func handleWatchEvent(ctx context.Context, event *watch.Event, cutoffTime metav1
 	}
 
 	// Get event timestamp
-	eventTs := eventObject.LastTimestamp
-	if eventTs.IsZero() {
-		eventTs = metav1.Time(eventObject.EventTime)
-	}
+	eventTs := getEventTimestamp(eventObject)
 
 	if !cutoffTime.IsZero() && !eventTs.IsZero() && eventTs.Before(&cutoffTime) {
 		logger.Debug().Msgf("Ignoring an event because it is too old")
-		return
+		return false
 	}
 
-	if eventObject.Type == v1.EventTypeNormal {
+	// In the breadcrumb mode, the allowed Normal events are only used as
+	// breadcrumbs of other events
+	if eventObject.Type == v1.EventTypeNormal && (!isAllowedNormalEvent(eventObject) || normalEventsMode == normalEventsModeBreadcrumb) {
 		logger.Debug().Msgf("Skipping an event of type %s", eventObject.Type)
-		return
+		return false
 	}
 
 	if isFilteredByReason(eventObject) {
 		logger.Debug().Msgf("Skipping an event with reason: %q", eventObject.Reason)
-		return
+		return false
 	}
 
 	if isFilteredByEventSource(eventObject) {
-		logger.Debug().Msgf("Skipping an event with event source: %q", eventObject.Source.Component)
-		return
+		logger.Debug().Msgf("Skipping an event with event source: %q", getEventSourceComponent(eventObject))
+		return false
+	}
+
+	// The involved object is fetched once for the filter rules, the
+	// annotation overrides and the enhancers
+	involvedObject := newObjectLookup(ctx, &eventObject.InvolvedObject)
+
+	if isFilteredByRules(ctx, newFilterInputFromEvent(eventObject, involvedObject)) {
+		logger.Debug().Msgf("Skipping an event dropped by a filter rule")
+		return false
+	}
+
+	if getAnnotationOverrides(ctx, &eventObject.InvolvedObject, involvedObject).isIgnored(eventObject.Reason) {
+		logger.Debug().Msgf("Skipping an event ignored by annotations, reason: %q", eventObject.Reason)
+		return false
 	}
 
 	hub := sentry.GetHubFromContext(ctx)
 	if hub == nil {
 		logger.Error().Msgf("Cannot get Sentry hub from context")
-		return
+		return false
 	}
 	hub.WithScope(func(scope *sentry.Scope) {
 		setWatcherTag(scope, eventsWatcherName)
-		sentryEvent := handleGeneralEvent(ctx, eventObject, scope)
+		sentryEvent := handleGeneralEvent(ctx, eventObject, involvedObject.get(), scope)
 		if sentryEvent != nil {
-			hub.CaptureEvent(sentryEvent)
+			captureRoutedEvent(ctx, hub, scope, newRoutingTargetForRef(ctx, &eventObject.InvolvedObject), sentryEvent)
+			reported = true
 		}
 	})
+	return reported
 }
 
-func watchEventsInNamespace(ctx context.Context, namespace string, watchSince time.Time) (err error) {
+// Processes a single event and records it in the checkpoint (if enabled)
+func processEvent(ctx context.Context, event *watch.Event, cutoffTime metav1.Time, checkpointer *eventsCheckpointer) {
 	logger := zerolog.Ctx(ctx)
 
-	clientset, err := getClientsetFromContext(ctx)
-	if err != nil {
-		return err
+	eventObject, ok := getCoreEvent(event.Object)
+	if !isLeader() {
+		// Followers only keep the breadcrumbs, the checkpoint is kept by the leader
+		if ok && isBufferedEvent(eventObject) {
+			addEventToBuffer(eventObject)
+		}
+		return
+	}
+	if checkpointer != nil && ok && checkpointer.isProcessed(eventObject) {
+		logger.Debug().Msgf("Skipping an event that was already processed: %s", getEventKey(eventObject))
+		return
 	}
 
-	watchFunc := func(options metav1.ListOptions) (watch.Interface, error) {
-		opts := metav1.ListOptions{
-			Watch: true,
-		}
-		return clientset.CoreV1().Events(namespace).Watch(ctx, opts)
+	handleWatchEvent(ctx, event, cutoffTime)
+
+	// The checkpoint is saved in the background, see eventsCheckpointer.run
+	if checkpointer != nil && ok {
+		checkpointer.markProcessed(eventObject)
 	}
-	logger.Debug().Msg("Getting the event watcher")
-	retryWatcher, err := toolsWatch.NewRetryWatcher("1", &cache.ListWatch{WatchFunc: watchFunc})
-	if err != nil {
-		return err
+}
+
+// Serializes the informer notifications with the replays of the informer
+// store. The checkpoint assumes that events are processed from the oldest to
+// the newest, but neither the initial list nor the store are ordered.
+type eventsProcessor struct {
+	cutoffTime   metav1.Time
+	checkpointer *eventsCheckpointer
+	// nil if the namespace selection is static. Otherwise, the events of a
+	// namespace are only processed after it was replayed.
+	watchers *namespaceWatchers
+	// If true, the events of a namespace are only processed since it started
+	// being watched, unless its checkpoint knows where to resume
+	cutoffPerNamespace bool
+
+	mu sync.Mutex
+	// Notifications are ignored until the initial list is replayed
+	replayed           bool
+	replayedNamespaces map[string]bool
+	// Keys of the events processed by the replays, so their pending
+	// notifications are not processed twice. Cleared once the watch delivers
+	// an event after the newest replayed one.
+	replayedKeys map[string]struct{}
+	// The newest resource version of the replayed events
+	replayedUntil string
+}
+
+func newEventsProcessor(cutoffTime metav1.Time, checkpointer *eventsCheckpointer) *eventsProcessor {
+	return &eventsProcessor{
+		cutoffTime:         cutoffTime,
+		checkpointer:       checkpointer,
+		replayedNamespaces: map[string]bool{},
+	}
+}
+
+// Must be called with the lock held
+func (p *eventsProcessor) getCutoffTime(eventObject *v1.Event) metav1.Time {
+	if !p.cutoffPerNamespace || p.watchers == nil {
+		return p.cutoffTime
 	}
+	if p.checkpointer != nil && p.checkpointer.hasCheckpoint(eventObject.Namespace) {
+		return metav1.Time{}
+	}
+	if since, ok := p.watchers.watchedSince(eventObject.Namespace); ok && since.After(p.cutoffTime.Time) {
+		return metav1.Time{Time: since}
+	}
+	return p.cutoffTime
+}
 
-	watchCh := retryWatcher.ResultChan()
-	defer retryWatcher.Stop()
+func (p *eventsProcessor) handle(ctx context.Context, event *watch.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.replayed {
+		return
+	}
+	eventObject, ok := getCoreEvent(event.Object)
+	if !ok {
+		return
+	}
+	if p.watchers != nil && !p.replayedNamespaces[eventObject.Namespace] {
+		// Part of the replay of the namespace
+		return
+	}
+	key := getEventKey(eventObject)
+	if _, found := p.replayedKeys[key]; found {
+		delete(p.replayedKeys, key)
+		return
+	}
+	// The watch delivers the events in order, so the pending notifications
+	// of the replayed events came before this one
+	if len(p.replayedKeys) > 0 {
+		if cmp, ok := compareResourceVersions(eventObject.ResourceVersion, p.replayedUntil); ok && cmp > 0 {
+			p.replayedKeys = map[string]struct{}{}
+		}
+	}
+	processEvent(ctx, event, p.getCutoffTime(eventObject), p.checkpointer)
+}
 
-	watchSinceWrapped := metav1.Time{Time: watchSince}
+// Processes the initial list of the informer, once it is synced
+func (p *eventsProcessor) replayInitial(ctx context.Context, informer cache.SharedIndexInformer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	logger.Debug().Msg("Reading from the event channel (events)")
-	for event := range watchCh {
-		handleWatchEvent(ctx, &event, watchSinceWrapped)
+	p.replayed = true
+	p.replayedKeys = map[string]struct{}{}
+	p.replayedUntil = ""
+	if p.watchers == nil {
+		p.processInOrder(ctx, informer.GetStore().List())
+		return
 	}
+	objects := []interface{}{}
+	for _, namespace := range p.watchers.namespaces() {
+		p.replayedNamespaces[namespace] = true
+		namespaceObjects, err := informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Msgf("Cannot list the events of namespace %q: %s", namespace, err)
+			continue
+		}
+		objects = append(objects, namespaceObjects...)
+	}
+	p.processInOrder(ctx, objects)
+}
 
+// Processes the events again, e.g. after becoming the leader. If reload is
+// true, the checkpoint is loaded first. Nothing is replayed before the
+// initial list, which is replayed anyway.
+func (p *eventsProcessor) replay(ctx context.Context, objects []interface{}, reload bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if reload && p.checkpointer != nil {
+		if _, err := p.checkpointer.load(ctx); err != nil {
+			return err
+		}
+	}
+	if !p.replayed {
+		return nil
+	}
+	if p.watchers != nil {
+		// Namespaces that were not replayed yet follow on their own
+		filtered := make([]interface{}, 0, len(objects))
+		for _, obj := range objects {
+			if p.replayedNamespaces[getObjectNamespace(obj)] {
+				filtered = append(filtered, obj)
+			}
+		}
+		objects = filtered
+	}
+	p.replayedKeys = map[string]struct{}{}
+	p.replayedUntil = ""
+	p.processInOrder(ctx, objects)
 	return nil
 }
 
-func watchEventsInNamespaceForever(ctx context.Context, config *rest.Config, namespace string) error {
-	localHub := sentry.CurrentHub().Clone()
-	ctx = sentry.SetHubOnContext(ctx, localHub)
-
-	where := fmt.Sprintf("in namespace '%s'", namespace)
-	namespaceTag := namespace
-	if namespace == v1.NamespaceAll {
-		where = "in all namespaces"
-		namespaceTag = "__all__"
-	}
-
-	// Attach the "namespace" and "watcher" tags to logger
-	ctx, logger := getLoggerWithTags(
-		ctx,
-		map[string]string{
-			"namespace": namespaceTag,
-			"watcher":   eventsWatcherName,
-		},
-	)
-
-	watchFromBeginning := isTruthy(os.Getenv("SENTRY_K8S_WATCH_HISTORICAL"))
-	var watchSince time.Time
-	if watchFromBeginning {
-		watchSince = time.Time{}
-		logger.Info().Msgf("Watching all available events (no starting timestamp)")
-	} else {
-		watchSince = time.Now()
-		logger.Info().Msgf("Watching events starting from: %s", watchSince.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
+// Processes the events of a namespace that starts being watched. The events
+// are listed with the lock held, so notifications that are skipped until the
+// namespace is replayed are part of the list.
+func (p *eventsProcessor) replayNamespace(ctx context.Context, informer cache.SharedIndexInformer, namespace string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.checkpointer != nil {
+		if err := p.checkpointer.loadNamespace(ctx, namespace); err != nil {
+			return err
+		}
+	}
+	if !p.replayed {
+		// Part of the initial list
+		return nil
+	}
+	objects, err := informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
 	if err != nil {
 		return err
 	}
+	p.replayedNamespaces[namespace] = true
+	p.processInOrder(ctx, objects)
+	return nil
+}
 
-	ctx = setClientsetOnContext(ctx, clientset)
+// Called when a namespace is no longer watched. If unselected is false, the
+// namespace is watched by another replica now, which resumes after the
+// checkpoint of the namespace.
+func (p *eventsProcessor) forgetNamespace(ctx context.Context, namespace string, unselected bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	for {
-		if err := watchEventsInNamespace(ctx, namespace, watchSince); err != nil {
-			logger.Error().Msgf("Error while watching events %s: %s", where, err)
-		}
-		watchSince = time.Now()
-		time.Sleep(time.Second * 1)
+	delete(p.replayedNamespaces, namespace)
+	if p.checkpointer == nil {
+		return nil
 	}
+	return p.checkpointer.forgetNamespace(ctx, namespace, unselected)
 }
 
-func startEventWatchers(ctx context.Context, config *rest.Config, namespaces []string) {
-	for _, namespace := range namespaces {
-		go watchEventsInNamespaceForever(ctx, config, namespace)
+// Must be called with the lock held
+func (p *eventsProcessor) processInOrder(ctx context.Context, objects []interface{}) {
+	events := make([]*v1.Event, 0, len(objects))
+	for _, obj := range objects {
+		object, ok := obj.(runtime.Object)
+		if !ok {
+			continue
+		}
+		if eventObject, ok := getCoreEvent(object); ok {
+			events = append(events, eventObject)
+		}
+	}
+	// The checkpoint skips everything up to the last processed resource
+	// version, so the order of the resource versions is preferred
+	sort.SliceStable(events, func(i, j int) bool {
+		if cmp, ok := compareResourceVersions(events[i].ResourceVersion, events[j].ResourceVersion); ok {
+			return cmp < 0
+		}
+		iTs, jTs := getEventTimestamp(events[i]), getEventTimestamp(events[j])
+		return iTs.Before(&jTs)
+	})
+
+	for _, eventObject := range events {
+		processEvent(ctx, &watch.Event{Type: watch.Added, Object: eventObject}, p.getCutoffTime(eventObject), p.checkpointer)
+		p.replayedKeys[getEventKey(eventObject)] = struct{}{}
+		if cmp, ok := compareResourceVersions(eventObject.ResourceVersion, p.replayedUntil); !ok || cmp > 0 {
+			p.replayedUntil = eventObject.ResourceVersion
+		}
 	}
 }
@@ -7,8 +7,10 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 // Test the function handleWatchEvent
@@ -124,3 +126,206 @@ func TestHandleWatchEvent(t *testing.T) {
 		}
 	}
 }
+
+// Test the function handleWatchEvent
+// by giving it a mock events.k8s.io/v1 event
+// and checking that the new fields (series, related object, reporting
+// controller, note) end up in the Sentry event
+func TestHandleWatchEventEventsV1(t *testing.T) {
+
+	// Create empty context
+	ctx := context.Background()
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attach the hub with a new scope to the empty context
+	hub := sentry.NewHub(client, sentry.NewScope())
+	ctx = sentry.SetHubOnContext(ctx, hub)
+
+	eventTime, _ := time.Parse("2006-01-02 15:04:05", "2023-11-15 01:04:04")
+	lastObservedTime, _ := time.Parse("2006-01-02 15:04:05", "2023-11-15 18:42:00")
+
+	mockEvent := watch.Event{
+		Type: watch.Added,
+		Object: &eventsv1.Event{
+			ObjectMeta: v1.ObjectMeta{
+				Name:            "TestHandleWatchEventEventsV1Event",
+				Namespace:       "TestHandleWatchEventEventsV1Namespace",
+				ResourceVersion: "37478",
+			},
+			EventTime: v1.NewMicroTime(eventTime),
+			Series: &eventsv1.EventSeries{
+				Count:            5,
+				LastObservedTime: v1.NewMicroTime(lastObservedTime),
+			},
+			ReportingController: "example.com/fake-controller",
+			ReportingInstance:   "fake-controller-1",
+			Action:              "Binding",
+			Reason:              "FailedBinding",
+			Regarding: corev1.ObjectReference{
+				Kind:      "Pod",
+				Name:      "fake-pod",
+				Namespace: "TestHandleWatchEventEventsV1Namespace",
+			},
+			Related: &corev1.ObjectReference{
+				Kind: "Node",
+				Name: "fake-node",
+			},
+			Note: "Fake Note: TestHandleWatchEventEventsV1",
+			Type: "Warning",
+		},
+	}
+
+	// The series timestamp is after the cutoff time, so the event is captured
+	cutoffTime, _ := time.Parse("2006-01-02 15:04:05", "2023-11-15 10:00:00")
+	handleWatchEvent(ctx, &mockEvent, v1.NewTime(cutoffTime))
+
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("received %d events, expected %d event", len(events), 1)
+	}
+
+	// The Sentry event message should match the event note
+	expectedMsg := "Fake Note: TestHandleWatchEventEventsV1"
+	if events[0].Message != expectedMsg {
+		t.Errorf("received %s, wanted %s", events[0].Message, expectedMsg)
+	}
+
+	expectedTags := map[string]string{
+		"event_source_component": "example.com/fake-controller",
+		"reporting_controller":   "example.com/fake-controller",
+		"action":                 "Binding",
+		"reason":                 "FailedBinding",
+		"kind":                   "Pod",
+		"pod_name":               "fake-pod",
+		"related_kind":           "Node",
+		"related_name":           "fake-node",
+		"namespace":              "TestHandleWatchEventEventsV1Namespace",
+	}
+	for key, val := range expectedTags {
+		if events[0].Tags[key] != val {
+			t.Errorf("For Sentry tag with key [%s], received \"%s\", wanted \"%s\"", key, events[0].Tags[key], val)
+		}
+	}
+
+	if _, found := events[0].Contexts["Series"]; !found {
+		t.Errorf("The \"Series\" context is missing")
+	}
+}
+
+// Test that only the allowed Normal events are reported, as info events,
+// and that in the breadcrumb mode they are only attached as breadcrumbs to
+// other events about the same object
+func TestHandleWatchEventNormalEvents(t *testing.T) {
+
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "TestNormalEventsPod",
+			Namespace: "TestNormalEventsNamespace",
+		},
+	}
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(pod))
+	ctx = sentry.SetHubOnContext(ctx, sentry.NewHub(client, sentry.NewScope()))
+
+	t.Setenv("SENTRY_K8S_REPORT_NORMAL_EVENTS", "Preempted, ScalingReplicaSet:deployment-controller, Killing::due to eviction")
+	if err := prepareNormalEventAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		normalEventAllowlist = []normalEventRule{}
+		normalEventsMode = normalEventsModeEvent
+	}()
+
+	newEvent := func(name string, eventType string, reason string, component string, message string) *watch.Event {
+		return &watch.Event{
+			Type: watch.Added,
+			Object: &corev1.Event{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      name,
+					Namespace: "TestNormalEventsNamespace",
+				},
+				InvolvedObject: corev1.ObjectReference{
+					Kind:      "Pod",
+					Name:      "TestNormalEventsPod",
+					Namespace: "TestNormalEventsNamespace",
+				},
+				Reason:  reason,
+				Message: message,
+				Source:  corev1.EventSource{Component: component},
+				Type:    eventType,
+			},
+		}
+	}
+	newNormalEvent := func(name string, reason string, component string) *watch.Event {
+		return newEvent(name, corev1.EventTypeNormal, reason, component, "Fake Message: "+reason)
+	}
+
+	handleWatchEvent(ctx, newNormalEvent("preempted", "Preempted", "default-scheduler"), v1.Time{})
+	handleWatchEvent(ctx, newNormalEvent("scaling", "ScalingReplicaSet", "other-controller"), v1.Time{})
+	handleWatchEvent(ctx, newNormalEvent("scheduled", "Scheduled", "default-scheduler"), v1.Time{})
+	handleWatchEvent(ctx, newEvent("killing", corev1.EventTypeNormal, "Killing", "kubelet", "Stopping container app"), v1.Time{})
+	handleWatchEvent(ctx, newEvent("evicted", corev1.EventTypeNormal, "Killing", "kubelet", "Killing due to eviction"), v1.Time{})
+
+	events := transport.Events()
+	expectedMessages := []string{
+		"TestNormalEventsPod: Fake Message: Preempted",
+		"TestNormalEventsPod: Killing due to eviction",
+	}
+	if len(events) != len(expectedMessages) {
+		t.Fatalf("received %d events, expected %d events", len(events), len(expectedMessages))
+	}
+	for i, event := range events {
+		if event.Message != expectedMessages[i] {
+			t.Errorf("received %s, wanted %s", event.Message, expectedMessages[i])
+		}
+		if event.Level != sentry.LevelInfo {
+			t.Errorf("received level %q, wanted %q", event.Level, sentry.LevelInfo)
+		}
+	}
+
+	t.Setenv("SENTRY_K8S_NORMAL_EVENTS_MODE", "breadcrumb")
+	if err := prepareNormalEventAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+	handleWatchEvent(ctx, newNormalEvent("preempted-again", "Preempted", "default-scheduler"), v1.Time{})
+	handleWatchEvent(ctx, newNormalEvent("pulled", "Pulled", "kubelet"), v1.Time{})
+	if len(transport.Events()) != len(expectedMessages) {
+		t.Fatalf("received %d events in the breadcrumb mode, expected %d events", len(transport.Events()), len(expectedMessages))
+	}
+
+	handleWatchEvent(ctx, newEvent("backoff", corev1.EventTypeWarning, "BackOff", "kubelet", "Back-off restarting failed container"), v1.Time{})
+	events = transport.Events()
+	if len(events) != len(expectedMessages)+1 {
+		t.Fatalf("received %d events, expected %d events", len(events), len(expectedMessages)+1)
+	}
+	breadcrumbs := map[string]bool{}
+	for _, breadcrumb := range events[len(events)-1].Breadcrumbs {
+		breadcrumbs[breadcrumb.Message] = true
+	}
+	if !breadcrumbs["Fake Message: Preempted"] {
+		t.Errorf("the allowed Normal event is not a breadcrumb: %v", breadcrumbs)
+	}
+	if breadcrumbs["Fake Message: Pulled"] {
+		t.Errorf("the Normal event that is not allowed is a breadcrumb: %v", breadcrumbs)
+	}
+}
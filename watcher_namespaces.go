@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+const namespacesWatcherName = "namespaces"
+
+type namespaceCallback struct {
+	ctx     context.Context
+	onStart func(ctx context.Context, namespace string)
+	// unselected is false if the namespace still matches the selection, but
+	// is owned by another shard now
+	onStop func(ctx context.Context, namespace string, unselected bool)
+}
+
+// The namespaces of a dynamic selection that are currently watched. All
+// namespaces share a single set of cluster-wide informers, whose handlers
+// skip the objects of the namespaces that are not watched.
+type namespaceWatchers struct {
+	selection *namespaceSelection
+
+	mu sync.RWMutex
+	// Namespace name -> when it started being watched
+	watched   map[string]time.Time
+	callbacks []namespaceCallback
+}
+
+func newNamespaceWatchers(selection *namespaceSelection) *namespaceWatchers {
+	return &namespaceWatchers{
+		selection: selection,
+		watched:   make(map[string]time.Time),
+	}
+}
+
+// Registers the functions that are called when a namespace starts or stops
+// being watched, until the context is cancelled. Either can be nil.
+func (w *namespaceWatchers) subscribe(ctx context.Context, onStart func(ctx context.Context, namespace string), onStop func(ctx context.Context, namespace string, unselected bool)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.callbacks = append(w.callbacks, namespaceCallback{ctx: ctx, onStart: onStart, onStop: onStop})
+}
+
+// Must be called without the lock held
+func (w *namespaceWatchers) getCallbacks() []namespaceCallback {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Drop the callbacks of stopped watchers
+	callbacks := make([]namespaceCallback, 0, len(w.callbacks))
+	for _, callback := range w.callbacks {
+		if callback.ctx.Err() == nil {
+			callbacks = append(callbacks, callback)
+		}
+	}
+	w.callbacks = callbacks
+	return callbacks
+}
+
+// Starts or stops watching the namespace, depending on whether it matches
+// the selection
+func (w *namespaceWatchers) sync(ctx context.Context, namespace *v1.Namespace) {
+	if !w.selection.matches(namespace) {
+		w.stop(ctx, namespace.Name, !w.selection.selects(namespace))
+		return
+	}
+
+	w.mu.Lock()
+	if _, ok := w.watched[namespace.Name]; ok {
+		w.mu.Unlock()
+		return
+	}
+	w.watched[namespace.Name] = time.Now()
+	w.mu.Unlock()
+
+	_, logger := getLoggerWithTag(ctx, "namespace", namespace.Name)
+	logger.Info().Msgf("Namespace matches the selection, starting to watch it")
+
+	for _, callback := range w.getCallbacks() {
+		if callback.onStart != nil {
+			callback.onStart(withClonedHub(callback.ctx), namespace.Name)
+		}
+	}
+}
+
+// unselected is true if the namespace was deleted or no longer matches the
+// selection, and false if it is owned by another shard now
+func (w *namespaceWatchers) stop(ctx context.Context, name string, unselected bool) {
+	w.mu.Lock()
+	_, ok := w.watched[name]
+	delete(w.watched, name)
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	logger := zerolog.Ctx(ctx)
+	logger.Info().Msgf("Namespace %q no longer matches the selection, stopping to watch it", name)
+	containerTracker.forgetNamespace(name)
+
+	// In the reverse order of subscription, so the informers of the
+	// namespace stop after their watchers saved their state
+	callbacks := w.getCallbacks()
+	for i := len(callbacks) - 1; i >= 0; i-- {
+		if callbacks[i].onStop != nil {
+			callbacks[i].onStop(callbacks[i].ctx, name, unselected)
+		}
+	}
+}
+
+func (w *namespaceWatchers) isWatched(namespace string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	_, ok := w.watched[namespace]
+	return ok
+}
+
+// Returns false if the namespace is not watched
+func (w *namespaceWatchers) watchedSince(namespace string) (time.Time, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	since, ok := w.watched[namespace]
+	return since, ok
+}
+
+// The names of the watched namespaces, sorted
+func (w *namespaceWatchers) namespaces() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	names := make([]string, 0, len(w.watched))
+	for name := range w.watched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getObjectNamespace(obj interface{}) string {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return object.GetNamespace()
+}
+
+// Only keeps the objects of the watched namespaces. Without a dynamic
+// namespace selection, all objects are kept.
+func filterWatchedObjects(ctx context.Context, objects []interface{}) []interface{} {
+	watchers := getNamespaceWatchersFromContext(ctx)
+	if watchers == nil {
+		return objects
+	}
+	filtered := make([]interface{}, 0, len(objects))
+	for _, obj := range objects {
+		if watchers.isWatched(getObjectNamespace(obj)) {
+			filtered = append(filtered, obj)
+		}
+	}
+	return filtered
+}
+
+// Only passes on the notifications about the objects of the watched
+// namespaces. When a namespace starts being watched, replay is called, or
+// its objects in the informer cache are passed to the handler as added
+// objects if replay is nil. Without a dynamic namespace selection, or for
+// the informers of a single namespace, the handler is returned as is.
+func filterWatchedNamespaces(ctx context.Context, informer cache.SharedIndexInformer, namespace string, handler cache.ResourceEventHandler, replay func(ctx context.Context, namespace string)) cache.ResourceEventHandler {
+	watchers := getNamespaceWatchersFromContext(ctx)
+	if watchers == nil || namespace != v1.NamespaceAll {
+		return handler
+	}
+
+	watchers.subscribe(ctx, func(ctx context.Context, namespace string) {
+		if replay != nil {
+			replay(ctx, namespace)
+			return
+		}
+		objects, err := informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Msgf("Cannot list the objects of namespace %q: %s", namespace, err)
+			return
+		}
+		for _, obj := range objects {
+			handler.OnAdd(obj)
+		}
+	}, nil)
+
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			return watchers.isWatched(getObjectNamespace(obj))
+		},
+		Handler: handler,
+	}
+}
+
+// The callbacks run next to the informer handlers, which use the hub of the
+// context as well
+func withClonedHub(ctx context.Context) context.Context {
+	if hub := sentry.GetHubFromContext(ctx); hub != nil {
+		return sentry.SetHubOnContext(ctx, hub.Clone())
+	}
+	return ctx
+}
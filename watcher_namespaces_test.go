@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// test that the namespaces are watched while they match the selection, and
+// that the informer handlers only see the objects of watched namespaces
+func TestNamespaceWatchers(t *testing.T) {
+
+	t.Setenv("SENTRY_K8S_WATCH_NAMESPACES", "")
+	t.Setenv("SENTRY_K8S_WATCH_NAMESPACES_SELECTOR", "sentry=enabled")
+	t.Setenv("SENTRY_K8S_EXCLUDE_NAMESPACES", "kube-*")
+	selection, err := getNamespaceSelection()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if selection.isStatic() {
+		t.Fatalf("selection with a selector and exclusions is static")
+	}
+
+	watchers := newNamespaceWatchers(selection)
+	ctx := setNamespaceWatchersOnContext(context.Background(), watchers)
+
+	started := []string{}
+	stopped := map[string]bool{}
+	watchers.subscribe(ctx, func(ctx context.Context, namespace string) {
+		started = append(started, namespace)
+	}, func(ctx context.Context, namespace string, unselected bool) {
+		stopped[namespace] = unselected
+	})
+
+	// Pods that exist before their namespace is watched are replayed
+	informer := cache.NewSharedIndexInformer(nil, &corev1.Pod{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	newPod := func(namespace string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: namespace}}
+	}
+	for _, namespace := range []string{"payments", "sandbox"} {
+		if err := informer.GetStore().Add(newPod(namespace)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := []string{}
+	handler := filterWatchedNamespaces(ctx, informer, corev1.NamespaceAll, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			seen = append(seen, obj.(*corev1.Pod).Namespace)
+		},
+	}, nil)
+
+	newNamespace := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	enabled := map[string]string{"sentry": "enabled"}
+
+	watchers.sync(ctx, newNamespace("payments", enabled))
+	watchers.sync(ctx, newNamespace("kube-system", enabled))
+	watchers.sync(ctx, newNamespace("sandbox", nil))
+
+	if namespaces := watchers.namespaces(); !reflect.DeepEqual(namespaces, []string{"payments"}) {
+		t.Fatalf("watching namespaces %v, wanted %v", namespaces, []string{"payments"})
+	}
+	if !reflect.DeepEqual(seen, []string{"payments"}) {
+		t.Errorf("replayed pods of namespaces %v, wanted %v", seen, []string{"payments"})
+	}
+
+	handler.OnAdd(newPod("payments"))
+	handler.OnAdd(newPod("sandbox"))
+	if !reflect.DeepEqual(seen, []string{"payments", "payments"}) {
+		t.Errorf("handled pods of namespaces %v, wanted %v", seen, []string{"payments", "payments"})
+	}
+
+	// Updates of a matching namespace don't start watching it again
+	watchers.sync(ctx, newNamespace("payments", map[string]string{"sentry": "enabled", "team": "payments"}))
+	watchers.sync(ctx, newNamespace("sandbox", enabled))
+	if !reflect.DeepEqual(started, []string{"payments", "sandbox"}) {
+		t.Errorf("started watching %v, wanted %v", started, []string{"payments", "sandbox"})
+	}
+
+	// Relabelled
+	watchers.sync(ctx, newNamespace("payments", nil))
+	if watchers.isWatched("payments") {
+		t.Errorf("relabelled namespace is still watched")
+	}
+
+	// Deleted
+	watchers.stop(ctx, "sandbox", true)
+	if watchers.isWatched("sandbox") {
+		t.Errorf("deleted namespace is still watched")
+	}
+
+	if !reflect.DeepEqual(stopped, map[string]bool{"payments": true, "sandbox": true}) {
+		t.Errorf("stopped watching %v", stopped)
+	}
+	if namespaces := watchers.namespaces(); len(namespaces) != 0 {
+		t.Errorf("watching namespaces %v, wanted none", namespaces)
+	}
+}
+
+// test that the plain list of namespaces keeps the static selection
+func TestGetNamespaceSelection(t *testing.T) {
+
+	t.Setenv("SENTRY_K8S_WATCH_NAMESPACES_SELECTOR", "")
+	t.Setenv("SENTRY_K8S_EXCLUDE_NAMESPACES", "")
+
+	t.Setenv("SENTRY_K8S_WATCH_NAMESPACES", "default, payments")
+	selection, err := getNamespaceSelection()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !selection.isStatic() || selection.watchesAllNamespaces() || !reflect.DeepEqual(selection.names, []string{"default", "payments"}) {
+		t.Errorf("wrong selection for a list of namespaces: %+v", selection)
+	}
+
+	t.Setenv("SENTRY_K8S_WATCH_NAMESPACES", "team-*")
+	selection, err = getNamespaceSelection()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if selection.isStatic() || !selection.watchesAllNamespaces() || !selection.matches(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}) {
+		t.Errorf("wrong selection for a namespace glob: %+v", selection)
+	}
+
+	t.Setenv("SENTRY_K8S_WATCH_NAMESPACES", "not valid")
+	if _, err := getNamespaceSelection(); err == nil {
+		t.Errorf("no error for an invalid namespace")
+	}
+}
+
+// test that the watchers of a namespace stop in the reverse order of their
+// subscription, so the informers of a shard stop after their handlers saved
+// their state
+func TestNamespaceWatchersStopOrder(t *testing.T) {
+
+	shard := newShardAssignment(0, []int{0})
+	watchers := newNamespaceWatchers(&namespaceSelection{all: true, shard: shard})
+	ctx := context.Background()
+
+	stopped := []string{}
+	for _, name := range []string{"informers", "events"} {
+		name := name
+		watchers.subscribe(ctx, nil, func(ctx context.Context, namespace string, unselected bool) {
+			stopped = append(stopped, name)
+		})
+	}
+	watchers.sync(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments"}})
+	watchers.stop(ctx, "payments", true)
+
+	if !reflect.DeepEqual(stopped, []string{"events", "informers"}) {
+		t.Errorf("stopped in the order %v, wanted %v", stopped, []string{"events", "informers"})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	v1 "k8s.io/api/core/v1"
+)
+
+const nodesWatcherName = "nodes"
+
+// The maximum number of pods listed in a node report
+const nodePodsLimit = 100
+
+// Node conditions that are watched
+var watchedNodeConditions = []v1.NodeConditionType{
+	v1.NodeReady,
+	v1.NodeMemoryPressure,
+	v1.NodeDiskPressure,
+	v1.NodePIDPressure,
+	v1.NodeNetworkUnavailable,
+}
+
+// Pressure conditions are only warnings, the node still works
+func getNodeConditionLevel(conditionType v1.NodeConditionType) sentry.Level {
+	switch conditionType {
+	case v1.NodeReady, v1.NodeNetworkUnavailable:
+		return sentry.LevelError
+	default:
+		return sentry.LevelWarning
+	}
+}
+
+func getNodeCondition(node *v1.Node, conditionType v1.NodeConditionType) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// "Ready" is the only condition that is healthy when it's "True"
+func isNodeConditionBad(condition *v1.NodeCondition) bool {
+	if condition == nil {
+		return false
+	}
+	if condition.Type == v1.NodeReady {
+		return condition.Status != v1.ConditionTrue
+	}
+	return condition.Status == v1.ConditionTrue
+}
+
+func getNodeConditionMessage(node *v1.Node, condition *v1.NodeCondition, recovered bool) string {
+	if condition.Type == v1.NodeReady {
+		if recovered {
+			return fmt.Sprintf("Node %s is Ready again", node.Name)
+		}
+		if condition.Status == v1.ConditionUnknown {
+			return fmt.Sprintf("Node %s is in Unknown state", node.Name)
+		}
+		return fmt.Sprintf("Node %s is NotReady", node.Name)
+	}
+	if recovered {
+		return fmt.Sprintf("Node %s: %s is resolved", node.Name, condition.Type)
+	}
+	return fmt.Sprintf("Node %s: %s", node.Name, condition.Type)
+}
+
+// Describes the pods scheduled on the node, in all namespaces. Only the first
+// pods are listed, the count is the number of all pods.
+func describePodsOnNode(ctx context.Context, nodeName string) ([]string, int, error) {
+	podList, err := getPodsOnNode(ctx, nodeName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pods := make([]string, 0, len(podList))
+	for _, pod := range podList {
+		pods = append(pods, fmt.Sprintf("%s/%s (%s)", pod.Namespace, pod.Name, pod.Status.Phase))
+	}
+	sort.Strings(pods)
+	if len(pods) > nodePodsLimit {
+		pods = append(pods[:nodePodsLimit], fmt.Sprintf("... and %d more", len(pods)-nodePodsLimit))
+	}
+	return pods, len(podList), nil
+}
+
+func buildSentryEventFromNodeCondition(ctx context.Context, node *v1.Node, condition *v1.NodeCondition, previous *v1.NodeCondition, scope *sentry.Scope) *sentry.Event {
+	logger := zerolog.Ctx(ctx)
+
+	recovered := !isNodeConditionBad(condition)
+
+	setTagIfNotEmpty(scope, "node_condition", string(condition.Type))
+	setTagIfNotEmpty(scope, "condition_status", string(condition.Status))
+	setTagIfNotEmpty(scope, "reason", condition.Reason)
+	setTagIfNotEmpty(scope, "kind", "Node")
+
+	conditionContext := sentry.Context{
+		"Status":               string(condition.Status),
+		"Reason":               condition.Reason,
+		"Message":              condition.Message,
+		"Last transition time": condition.LastTransitionTime.String(),
+	}
+	if previous != nil {
+		conditionContext["Previous status"] = string(previous.Status)
+		if recovered && !previous.LastTransitionTime.IsZero() && !condition.LastTransitionTime.IsZero() {
+			duration := condition.LastTransitionTime.Sub(previous.LastTransitionTime.Time)
+			conditionContext["Duration"] = duration.Round(time.Second).String()
+		}
+	}
+	scope.SetContext("Condition", conditionContext)
+
+	if pods, count, err := describePodsOnNode(ctx, node.Name); err == nil {
+		scope.SetContext("Pods on Node", sentry.Context{
+			"Count": count,
+			"Pods":  pods,
+		})
+	} else {
+		logger.Warn().Msgf("Cannot list pods on node %q: %v", node.Name, err)
+	}
+
+	level := getNodeConditionLevel(condition.Type)
+	fingerprintPrefix := "node-condition"
+	if recovered {
+		level = sentry.LevelInfo
+		fingerprintPrefix = "node-condition-recovered"
+	}
+
+	sentryEvent := &sentry.Event{
+		Message: getNodeConditionMessage(node, condition, recovered),
+		Level:   level,
+		// The node enhancer adds the node name
+		Fingerprint: []string{fingerprintPrefix, string(condition.Type)},
+	}
+	objectRef := &v1.ObjectReference{
+		Kind:       "Node",
+		APIVersion: "v1",
+		Name:       node.Name,
+		UID:        node.UID,
+	}
+	runEnhancers(ctx, objectRef, node, scope, sentryEvent)
+	return sentryEvent
+}
+
+// Reports the transitions of the watched conditions between the two versions
+// of the node: to the bad state as errors/warnings, and back as info events
+func handleNodeUpdate(ctx context.Context, oldNode *v1.Node, newNode *v1.Node) {
+	if !inFlightEvents.start() {
+		return
+	}
+	defer inFlightEvents.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	logger := zerolog.Ctx(ctx)
+
+	if !isLeader() {
+		return
+	}
+
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		logger.Error().Msgf("Cannot get Sentry hub from context")
+		return
+	}
+
+	for _, conditionType := range watchedNodeConditions {
+		previous := getNodeCondition(oldNode, conditionType)
+		current := getNodeCondition(newNode, conditionType)
+		if current == nil {
+			continue
+		}
+
+		wasBad := isNodeConditionBad(previous)
+		isBad := isNodeConditionBad(current)
+		if wasBad == isBad {
+			continue
+		}
+
+		logger.Debug().Msgf("Node %q: condition %s changed to %s", newNode.Name, conditionType, current.Status)
+		hub.WithScope(func(scope *sentry.Scope) {
+			setWatcherTag(scope, nodesWatcherName)
+			sentryEvent := buildSentryEventFromNodeCondition(ctx, newNode, current, previous, scope)
+			if sentryEvent != nil {
+				captureRoutedEvent(ctx, hub, scope, nil, sentryEvent)
+			}
+		})
+	}
+}
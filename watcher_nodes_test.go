@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newNodeWithReadyCondition(status corev1.ConditionStatus, resourceVersion string, transitionTime time.Time) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "TestHandleNodeUpdateNode",
+			ResourceVersion: resourceVersion,
+		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{
+					Type:               corev1.NodeReady,
+					Status:             status,
+					LastTransitionTime: metav1.NewTime(transitionTime),
+				},
+				{
+					Type:   corev1.NodeMemoryPressure,
+					Status: corev1.ConditionFalse,
+				},
+			},
+		},
+	}
+}
+
+// test that a node going NotReady is reported as an error together with
+// its pods, and that the recovery is reported as a follow-up info event
+func TestHandleNodeUpdate(t *testing.T) {
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	readyNode := newNodeWithReadyCondition(corev1.ConditionTrue, "1", now.Add(-time.Hour))
+	notReadyNode := newNodeWithReadyCondition(corev1.ConditionFalse, "2", now.Add(-5*time.Minute))
+	recoveredNode := newNodeWithReadyCondition(corev1.ConditionTrue, "3", now)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "TestHandleNodeUpdatePod",
+			Namespace: "TestHandleNodeUpdateNamespace",
+		},
+		Spec: corev1.PodSpec{NodeName: readyNode.Name},
+	}
+
+	ctx := setClientsetOnContext(context.Background(), fake.NewSimpleClientset(readyNode, pod))
+	ctx = sentry.SetHubOnContext(ctx, sentry.NewHub(client, sentry.NewScope()))
+
+	// Nothing changed
+	handleNodeUpdate(ctx, readyNode, readyNode)
+	if len(transport.Events()) != 0 {
+		t.Fatalf("received %d events for an unchanged node", len(transport.Events()))
+	}
+
+	handleNodeUpdate(ctx, readyNode, notReadyNode)
+	handleNodeUpdate(ctx, notReadyNode, recoveredNode)
+
+	events := transport.Events()
+	if len(events) != 2 {
+		t.Fatalf("received %d events, expected %d events", len(events), 2)
+	}
+
+	notReadyEvent := events[0]
+	if notReadyEvent.Level != sentry.LevelError || notReadyEvent.Message != "Node TestHandleNodeUpdateNode is NotReady" {
+		t.Errorf("received event %q with level %s", notReadyEvent.Message, notReadyEvent.Level)
+	}
+	if notReadyEvent.Tags["node_condition"] != string(corev1.NodeReady) {
+		t.Errorf("received node_condition tag %q, wanted %q", notReadyEvent.Tags["node_condition"], corev1.NodeReady)
+	}
+	podsContext, ok := notReadyEvent.Contexts["Pods on Node"]
+	if !ok || podsContext["Count"] != 1 {
+		t.Errorf("received pods context %v, wanted 1 pod", podsContext)
+	}
+
+	recoveredEvent := events[1]
+	if recoveredEvent.Level != sentry.LevelInfo || recoveredEvent.Message != "Node TestHandleNodeUpdateNode is Ready again" {
+		t.Errorf("received event %q with level %s", recoveredEvent.Message, recoveredEvent.Level)
+	}
+	if recoveredEvent.Contexts["Condition"]["Duration"] != "5m0s" {
+		t.Errorf("received duration %v, wanted %q", recoveredEvent.Contexts["Condition"]["Duration"], "5m0s")
+	}
+}
+
+// test that the pods of a node are looked up in the cache, and that the count
+// includes the pods that are not listed
+func TestDescribePodsOnNode(t *testing.T) {
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{podNodeNameIndex: indexPodByNodeName})
+	for i := 0; i < nodePodsLimit+5; i++ {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%03d", i), Namespace: "TestDescribePodsOnNodeNamespace"},
+			Spec:       corev1.PodSpec{NodeName: "TestDescribePodsOnNodeNode"},
+		}
+		if err := indexer.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "TestDescribePodsOnNodeNamespace"},
+		Spec:       corev1.PodSpec{NodeName: "TestDescribePodsOnNodeOtherNode"},
+	}
+	if err := indexer.Add(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// No clientset, the API is not used
+	ctx := setListersOnContext(context.Background(), &objectListers{podsByNode: indexer})
+	pods, count, err := describePodsOnNode(ctx, "TestDescribePodsOnNodeNode")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != nodePodsLimit+5 {
+		t.Errorf("received count %d, wanted %d", count, nodePodsLimit+5)
+	}
+	if len(pods) != nodePodsLimit+1 || pods[nodePodsLimit] != "... and 5 more" {
+		t.Errorf("received %d pods, the last one is %q", len(pods), pods[len(pods)-1])
+	}
+}
@@ -3,26 +3,24 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
-	"time"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
-	toolsWatch "k8s.io/client-go/tools/watch"
 )
 
 const podsWatcherName = "pods"
 
-func handlePodTerminationEvent(ctx context.Context, containerStatus *v1.ContainerStatus, pod *v1.Pod, scope *sentry.Scope) *sentry.Event {
+// FIXME: there's no proper controller we can extract here, so inventing a new one
+const podControllerComponent = "x-pod-controller"
+
+// The logs are nil if the pod did not opt in, or they are not available
+func handlePodTerminationEvent(ctx context.Context, containerStatus *v1.ContainerStatus, termination *containerTermination, pod *v1.Pod, logs *containerLogs, scope *sentry.Scope) *sentry.Event {
 	logger := zerolog.Ctx(ctx)
 
-	state := containerStatus.State.Terminated
+	state := termination.state
 
 	logger.Trace().Msgf("Container state: %#v", state)
 	if state.ExitCode == 0 {
@@ -30,21 +28,100 @@ func handlePodTerminationEvent(ctx context.Context, containerStatus *v1.Containe
 		return nil
 	}
 
-	setTagIfNotEmpty(scope, "reason", state.Reason)
-	setTagIfNotEmpty(scope, "kind", pod.Kind)
-	setTagIfNotEmpty(scope, "object_uid", string(pod.UID))
-	setTagIfNotEmpty(scope, "namespace", pod.Namespace)
-	setTagIfNotEmpty(scope, "pod_name", pod.Name)
-	setTagIfNotEmpty(scope, "container_name", containerStatus.Name)
+	setPodContainerTags(scope, containerStatus, pod, state.Reason)
+	setTagIfNotEmpty(scope, "restart_count", fmt.Sprint(containerStatus.RestartCount))
 
-	// FIXME: there's no proper controller we can extract here, so inventing a new one
-	setTagIfNotEmpty(scope, "event_source_component", "x-pod-controller")
+	terminationContext := sentry.Context{
+		"Exit code":   state.ExitCode,
+		"Restarted":   termination.restarted,
+		"Started at":  state.StartedAt.String(),
+		"Finished at": state.FinishedAt.String(),
+	}
+	if termination.missedRestarts > 0 {
+		terminationContext["Missed restarts"] = termination.missedRestarts
+	}
+	scope.SetContext("Termination", terminationContext)
 
-	if containerStatusJson, err := prettyJson(containerStatus); err == nil {
-		scope.SetContext("Container", sentry.Context{
-			"Status": containerStatusJson,
-		})
+	// The termination message is the most reliable source of a stack trace,
+	// the logs might contain something unrelated
+	message := state.Message
+	exceptions := extractExceptions(state.Message)
+	if len(exceptions) == 0 && logs != nil {
+		exceptions = extractExceptions(strings.Join(logs.lines, "\n"))
+	}
+	if message == "" || len(exceptions) > 0 {
+		message = fmt.Sprintf(
+			"%s: container %q",
+			state.Reason,
+			containerStatus.Name,
+		)
+	}
+	if len(exceptions) > 0 {
+		logger.Debug().Msgf("Found %d exception(s) in the container output", len(exceptions))
+	}
+
+	sentryEvent := buildSentryEventFromPodTerminationEvent(ctx, pod, state, message, exceptions, scope)
+
+	// Log breadcrumbs go after the ones added by the enhancers
+	addContainerLogsToScope(scope, pod, logs)
+
+	return sentryEvent
+}
+
+func reportPodTermination(ctx context.Context, hub *sentry.Hub, containerStatus *v1.ContainerStatus, termination *containerTermination, pod *v1.Pod, logs *containerLogs) {
+	hub.WithScope(func(scope *sentry.Scope) {
+		setWatcherTag(scope, podsWatcherName)
+		sentryEvent := handlePodTerminationEvent(ctx, containerStatus, termination, pod, logs, scope)
+		if sentryEvent != nil {
+			captureRoutedEvent(ctx, hub, scope, newRoutingTargetForObject(pod), sentryEvent)
+		}
+	})
+}
+
+// Fetches the logs first, so the informer handler doesn't wait for them
+func reportPodTerminationWithLogs(ctx context.Context, hub *sentry.Hub, containerStatus v1.ContainerStatus, termination containerTermination, pod *v1.Pod) {
+	defer inFlightEvents.done()
+
+	// The logs of the terminated container are only available as "previous"
+	// logs once the container is restarted
+	fetchCtx, cancel := context.WithTimeout(ctx, podLogsFetchTimeout)
+	logs := fetchContainerLogs(fetchCtx, pod, containerStatus.Name, termination.restarted)
+	cancel()
+
+	configLock.RLock()
+	defer configLock.RUnlock()
+	reportPodTermination(ctx, hub, &containerStatus, &termination, pod, logs)
+}
+
+func buildSentryEventFromPodTerminationEvent(ctx context.Context, pod *v1.Pod, state *v1.ContainerStateTerminated, message string, exceptions []sentry.Exception, scope *sentry.Scope) *sentry.Event {
+	level := getSeverityLevel(&severityInput{
+		reason:    state.Reason,
+		component: podControllerComponent,
+		kind:      "Pod",
+		exitCode:  &state.ExitCode,
+		message:   state.Message,
+	})
+	sentryEvent := &sentry.Event{Message: message, Level: level, Exception: exceptions}
+	objectRef := &v1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Name:       pod.Name,
+		Namespace:  pod.Namespace,
+		UID:        pod.UID,
 	}
+	runEnhancers(ctx, objectRef, pod, scope, sentryEvent)
+	return sentryEvent
+}
+
+func handlePodWaitingEvent(ctx context.Context, containerStatus *v1.ContainerStatus, pod *v1.Pod, scope *sentry.Scope) *sentry.Event {
+	logger := zerolog.Ctx(ctx)
+
+	state := containerStatus.State.Waiting
+
+	logger.Trace().Msgf("Container state: %#v", state)
+
+	setPodContainerTags(scope, containerStatus, pod, state.Reason)
+	setTagIfNotEmpty(scope, "container_state", "waiting")
 
 	message := state.Message
 	if message == "" {
@@ -55,22 +132,76 @@ func handlePodTerminationEvent(ctx context.Context, containerStatus *v1.Containe
 		)
 	}
 
-	sentryEvent := buildSentryEventFromPodTerminationEvent(ctx, pod, message, scope)
+	sentryEvent := buildSentryEventFromPodWaitingEvent(ctx, pod, containerStatus, message, scope)
 	return sentryEvent
 }
 
-func buildSentryEventFromPodTerminationEvent(ctx context.Context, pod *v1.Pod, message string, scope *sentry.Scope) *sentry.Event {
-	sentryEvent := &sentry.Event{Message: message, Level: sentry.LevelError}
+func buildSentryEventFromPodWaitingEvent(ctx context.Context, pod *v1.Pod, containerStatus *v1.ContainerStatus, message string, scope *sentry.Scope) *sentry.Event {
+	level := getSeverityLevel(&severityInput{
+		reason:    containerStatus.State.Waiting.Reason,
+		component: podControllerComponent,
+		kind:      "Pod",
+		message:   containerStatus.State.Waiting.Message,
+	})
+	sentryEvent := &sentry.Event{Message: message, Level: level}
+	// Waiting messages contain image names, back-off durations, etc., so
+	// group them by the reason instead. The pod enhancer adds the owner.
+	sentryEvent.Fingerprint = []string{
+		"container-waiting",
+		getWaitingReasonKey(containerStatus.State.Waiting.Reason),
+		containerStatus.Name,
+	}
 	objectRef := &v1.ObjectReference{
-		Kind:      "Pod",
-		Name:      pod.Name,
-		Namespace: pod.Namespace,
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Name:       pod.Name,
+		Namespace:  pod.Namespace,
+		UID:        pod.UID,
 	}
 	runEnhancers(ctx, objectRef, pod, scope, sentryEvent)
 	return sentryEvent
 }
 
+func setPodContainerTags(scope *sentry.Scope, containerStatus *v1.ContainerStatus, pod *v1.Pod, reason string) {
+	setTagIfNotEmpty(scope, "reason", reason)
+	setTagIfNotEmpty(scope, "kind", pod.Kind)
+	setTagIfNotEmpty(scope, "object_uid", string(pod.UID))
+	setTagIfNotEmpty(scope, "namespace", pod.Namespace)
+	setTagIfNotEmpty(scope, "pod_name", pod.Name)
+	setTagIfNotEmpty(scope, "container_name", containerStatus.Name)
+
+	setTagIfNotEmpty(scope, "event_source_component", podControllerComponent)
+
+	if containerStatusJson, err := prettyJson(containerStatus); err == nil {
+		scope.SetContext("Container", sentry.Context{
+			"Status": containerStatusJson,
+		})
+	}
+}
+
+// true -> the container state should not be reported
+func isContainerStateFiltered(ctx context.Context, overrides *annotationOverrides, pod *v1.Pod, containerStatus *v1.ContainerStatus, reason string, message string, exitCode int32) bool {
+	logger := zerolog.Ctx(ctx)
+
+	if overrides.isIgnored(reason) {
+		logger.Debug().Msgf("Skipping a container state ignored by annotations, reason: %q", reason)
+		return true
+	}
+	if isFilteredByRules(ctx, newFilterInputFromContainer(pod, containerStatus, reason, message, exitCode)) {
+		logger.Debug().Msgf("Skipping a container state dropped by a filter rule, reason: %q", reason)
+		return true
+	}
+	return false
+}
+
 func handlePodWatchEvent(ctx context.Context, event *watch.Event) {
+	if !inFlightEvents.start() {
+		return
+	}
+	defer inFlightEvents.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+
 	logger := zerolog.Ctx(ctx)
 
 	eventObjectRaw := event.Object
@@ -80,7 +211,7 @@ func handlePodWatchEvent(ctx context.Context, event *watch.Event) {
 	// 	return
 	// }
 
-	if event.Type != watch.Modified {
+	if event.Type != watch.Added && event.Type != watch.Modified && event.Type != watch.Deleted {
 		logger.Debug().Msgf("Skipping a pod watch event of type %s", event.Type)
 		return
 	}
@@ -92,6 +223,18 @@ func handlePodWatchEvent(ctx context.Context, event *watch.Event) {
 		return
 	}
 
+	if event.Type == watch.Deleted {
+		containerTracker.forgetPod(podObject)
+		return
+	}
+
+	// Followers don't track the container states: after taking over, the
+	// leader sees the current states for the first time, and only reports
+	// the terminations that happened since the previous leader stopped
+	if !isLeader() {
+		return
+	}
+
 	logger.Trace().Msgf("Pod Object received: %#v", podObject)
 
 	ctx, logger = getLoggerWithTag(ctx, "namespace", podObject.GetNamespace())
@@ -107,110 +250,51 @@ func handlePodWatchEvent(ctx context.Context, event *watch.Event) {
 		return
 	}
 
-	containerStatuses := podObject.Status.ContainerStatuses
+	podRef := &v1.ObjectReference{Kind: "Pod", Name: podObject.Name, Namespace: podObject.Namespace}
+	overrides := getAnnotationOverrides(ctx, podRef, podObject)
+	if overrides.ignore {
+		logger.Debug().Msgf("Pod is ignored by annotations")
+		return
+	}
+
+	// Init containers crash-loop and fail to pull images, too. Container
+	// names are unique across both lists.
+	containerStatuses := append(
+		append([]v1.ContainerStatus{}, podObject.Status.InitContainerStatuses...),
+		podObject.Status.ContainerStatuses...,
+	)
 	logger.Trace().Msgf("Container statuses: %#v\n", containerStatuses)
 	for _, status := range containerStatuses {
 		state := status.State
-		if state.Terminated == nil {
-			// Ignore non-Terminated statuses
-			continue
-		}
-
-		hub.WithScope(func(scope *sentry.Scope) {
-			setWatcherTag(scope, podsWatcherName)
-			sentryEvent := handlePodTerminationEvent(ctx, &status, podObject, scope)
-			if sentryEvent != nil {
-				hub.CaptureEvent(sentryEvent)
-			}
-		})
-	}
-}
 
-// TODO: dedupe with events
-func watchPodsInNamespace(ctx context.Context, namespace string) (err error) {
-	logger := zerolog.Ctx(ctx)
-
-	clientset, err := getClientsetFromContext(ctx)
-	if err != nil {
-		return err
-	}
-
-	watchFunc := func(options metav1.ListOptions) (watch.Interface, error) {
-		opts := metav1.ListOptions{
-			Watch: true,
+		// Pods that are already waiting when we see them for the first time
+		// were most probably reported before
+		newWaitingReason := containerTracker.observeWaitingReason(podObject, &status)
+		if event.Type == watch.Modified && state.Waiting != nil && newWaitingReason && isReportedWaitingReason(state.Waiting) &&
+			!isContainerStateFiltered(ctx, overrides, podObject, &status, state.Waiting.Reason, state.Waiting.Message, 0) {
+			hub.WithScope(func(scope *sentry.Scope) {
+				setWatcherTag(scope, podsWatcherName)
+				sentryEvent := handlePodWaitingEvent(ctx, &status, podObject, scope)
+				if sentryEvent != nil {
+					captureRoutedEvent(ctx, hub, scope, newRoutingTargetForObject(podObject), sentryEvent)
+				}
+			})
 		}
-		return clientset.CoreV1().Pods(namespace).Watch(ctx, opts)
-	}
-	logger.Debug().Msg("Getting the pod watcher")
-	retryWatcher, err := toolsWatch.NewRetryWatcher("1", &cache.ListWatch{WatchFunc: watchFunc})
-	if err != nil {
-		return err
-	}
-
-	watchCh := retryWatcher.ResultChan()
-	defer retryWatcher.Stop()
 
-	logger.Debug().Msg("Reading from the event channel (pods)")
-	for event := range watchCh {
-		handlePodWatchEvent(ctx, &event)
-	}
-
-	return nil
-}
-
-// TODO: dedupe with events
-func watchPodsInNamespaceForever(ctx context.Context, config *rest.Config, namespace string) error {
-	localHub := sentry.CurrentHub().Clone()
-	ctx = sentry.SetHubOnContext(ctx, localHub)
-
-	where := fmt.Sprintf("in namespace '%s'", namespace)
-	namespaceTag := namespace
-	if namespace == v1.NamespaceAll {
-		where = "in all namespaces"
-		namespaceTag = "__all__"
-	}
-
-	// Attach the "namespace" tag to logger
-	ctx, logger := getLoggerWithTags(
-		ctx,
-		map[string]string{
-			"namespace": namespaceTag,
-			"watcher":   podsWatcherName,
-		},
-	)
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return err
-	}
-
-	ctx = setClientsetOnContext(ctx, clientset)
-
-	// create the informers to integrate with sentry crons
-	if isTruthy(os.Getenv("SENTRY_K8S_MONITOR_CRONJOBS")) {
-		cronsInformerData := make(map[string]CronsMonitorData)
-		ctx := context.WithValue(ctx, CronsInformerDataKey{}, &cronsInformerData)
-		logger.Info().Msgf("Enabling CronJob monitoring")
-
-		go startCronsInformers(ctx, namespace)
-
-	} else {
-		logger.Info().Msgf("CronJob monitoring is disabled")
-	}
-
-	for {
-		if err := watchPodsInNamespace(ctx, namespace); err != nil {
-			logger.Error().Msgf("Error while watching pods %s: %s", where, err)
+		// Crash-looping containers spend most of their time waiting, so
+		// look at the last termination state, too
+		terminations := containerTracker.observeTerminations(podObject, &status)
+		for _, termination := range terminations {
+			if isContainerStateFiltered(ctx, overrides, podObject, &status, termination.state.Reason, termination.state.Message, termination.state.ExitCode) {
+				continue
+			}
+			// Without the logs once the shutdown started
+			if overrides.attachLogs && inFlightEvents.start() {
+				// The scope stack of the hub is not shared between goroutines
+				go reportPodTerminationWithLogs(ctx, hub.Clone(), status, termination, podObject)
+				continue
+			}
+			reportPodTermination(ctx, hub, &status, &termination, podObject, nil)
 		}
-		// Note: some events might be lost when we're sleeping here
-		time.Sleep(time.Second * 1)
-	}
-}
-
-func startPodWatchers(ctx context.Context, config *rest.Config, namespaces []string) {
-	for _, namespace := range namespaces {
-
-		go watchPodsInNamespaceForever(ctx, config, namespace)
-
 	}
 }
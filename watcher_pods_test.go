@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	corev1 "k8s.io/api/core/v1"
@@ -78,8 +80,9 @@ func TestHandlePodWatchEvent(t *testing.T) {
 		t.Errorf("received %d events, expected %d event", len(events), expectedNumEvents)
 	}
 
-	// the Sentry event message should match that of the container status
-	expectedMsg := "Fake Message: TestHandlePodWatchEvent"
+	// the Sentry event message should match that of the container status,
+	// prefixed with the pod name by the pod enhancer
+	expectedMsg := "TestHandlePodWatchEventPod: Fake Message: TestHandlePodWatchEvent"
 	if events[0].Message != expectedMsg {
 		t.Errorf("received %s, wanted %s", events[0].Message, expectedMsg)
 	}
@@ -99,3 +102,317 @@ func TestHandlePodWatchEvent(t *testing.T) {
 		}
 	}
 }
+
+// test the function handlePodWatchEvent
+// by giving it the same pod stuck in a waiting state twice
+// and checking that only a single Sentry event is captured
+func TestHandlePodWatchEventWaiting(t *testing.T) {
+
+	preparePodWaitingReasons()
+
+	// Create empty context
+	ctx := context.Background()
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attach the hub with a new scope to the empty context
+	hub := sentry.NewHub(client, sentry.NewScope())
+	ctx = sentry.SetHubOnContext(ctx, hub)
+
+	mockEvent := watch.Event{
+		Type: watch.Modified,
+		Object: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "TestHandlePodWatchEventWaitingPod",
+				Namespace: "TestHandlePodWatchEventWaitingNameSpace",
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name: "fake_DNS_Label",
+						State: corev1.ContainerState{
+							Waiting: &corev1.ContainerStateWaiting{
+								Reason:  "ImagePullBackOff",
+								Message: "Back-off pulling image \"fake-image:latest\"",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// The second update does not change the state of the container
+	handlePodWatchEvent(ctx, &mockEvent)
+	handlePodWatchEvent(ctx, &mockEvent)
+
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("received %d events, expected %d event", len(events), 1)
+	}
+
+	expectedMsg := "TestHandlePodWatchEventWaitingPod: Back-off pulling image \"fake-image:latest\""
+	if events[0].Message != expectedMsg {
+		t.Errorf("received %s, wanted %s", events[0].Message, expectedMsg)
+	}
+
+	expectedTags := map[string]string{"container_name": "fake_DNS_Label",
+		"container_state": "waiting",
+		"namespace":       "TestHandlePodWatchEventWaitingNameSpace",
+		"pod_name":        "TestHandlePodWatchEventWaitingPod",
+		"reason":          "ImagePullBackOff",
+		"watcher_name":    "pods"}
+	for key, val := range expectedTags {
+		if events[0].Tags[key] != val {
+			t.Errorf("For Sentry tag with key [%s], received \"%s\", wanted \"%s\"", key, events[0].Tags[key], val)
+		}
+	}
+
+	expectedFingerprint := []string{"container-waiting", "ImagePullBackOff", "fake_DNS_Label", "TestHandlePodWatchEventWaitingPod"}
+	if !reflect.DeepEqual(events[0].Fingerprint, expectedFingerprint) {
+		t.Errorf("received fingerprint %v, wanted %v", events[0].Fingerprint, expectedFingerprint)
+	}
+}
+
+// test the function handlePodWatchEvent
+// by feeding it a sequence of updates of a crash-looping container
+// and checking that every termination is reported exactly once
+func TestHandlePodWatchEventRestarts(t *testing.T) {
+
+	// Create empty context
+	ctx := context.Background()
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attach the hub with a new scope to the empty context
+	hub := sentry.NewHub(client, sentry.NewScope())
+	ctx = sentry.SetHubOnContext(ctx, hub)
+
+	firstCrash := &corev1.ContainerStateTerminated{
+		ExitCode:   1,
+		Reason:     "Error",
+		Message:    "Fake Message: first crash",
+		FinishedAt: metav1.NewTime(time.Date(2023, time.November, 15, 1, 0, 0, 0, time.UTC)),
+	}
+	lastCrash := &corev1.ContainerStateTerminated{
+		ExitCode:   1,
+		Reason:     "Error",
+		Message:    "Fake Message: last crash",
+		FinishedAt: metav1.NewTime(time.Date(2023, time.November, 15, 1, 10, 0, 0, time.UTC)),
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+
+	newPodUpdate := func(state corev1.ContainerState, lastState corev1.ContainerState, restartCount int32) *watch.Event {
+		return &watch.Event{
+			Type: watch.Modified,
+			Object: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "TestHandlePodWatchEventRestartsPod",
+					Namespace: "TestHandlePodWatchEventRestartsNameSpace",
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{
+						{
+							Name:                 "fake_DNS_Label",
+							State:                state,
+							LastTerminationState: lastState,
+							RestartCount:         restartCount,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// The container crashes
+	handlePodWatchEvent(ctx, newPodUpdate(corev1.ContainerState{Terminated: firstCrash}, corev1.ContainerState{}, 0))
+	// ...is restarted: the same termination is now the last termination state
+	handlePodWatchEvent(ctx, newPodUpdate(running, corev1.ContainerState{Terminated: firstCrash}, 1))
+	handlePodWatchEvent(ctx, newPodUpdate(running, corev1.ContainerState{Terminated: firstCrash}, 1))
+	// ...and crashes twice more, but the agent only sees the result
+	handlePodWatchEvent(ctx, newPodUpdate(running, corev1.ContainerState{Terminated: lastCrash}, 3))
+
+	events := transport.Events()
+	if len(events) != 2 {
+		t.Fatalf("received %d events, expected %d events", len(events), 2)
+	}
+
+	expectedMsgs := []string{"TestHandlePodWatchEventRestartsPod: Fake Message: first crash", "TestHandlePodWatchEventRestartsPod: Fake Message: last crash"}
+	for i, expectedMsg := range expectedMsgs {
+		if events[i].Message != expectedMsg {
+			t.Errorf("received %s, wanted %s", events[i].Message, expectedMsg)
+		}
+	}
+
+	if events[1].Tags["restart_count"] != "3" {
+		t.Errorf("received restart_count %q, wanted %q", events[1].Tags["restart_count"], "3")
+	}
+	if events[1].Contexts["Termination"]["Missed restarts"] != int32(1) {
+		t.Errorf("received missed restarts %v, wanted %v", events[1].Contexts["Termination"]["Missed restarts"], 1)
+	}
+}
+
+// test the function handlePodWatchEvent
+// by feeding it containers that keep flipping between waiting reasons
+// and checking that every reason is reported once until the container runs
+func TestHandlePodWatchEventWaitingFlaps(t *testing.T) {
+
+	preparePodWaitingReasons()
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := sentry.SetHubOnContext(context.Background(), sentry.NewHub(client, sentry.NewScope()))
+
+	waiting := func(reason string) corev1.ContainerState {
+		return corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}
+	}
+	runningSince := func(startedAt time.Time) corev1.ContainerState {
+		return corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(startedAt)}}
+	}
+	newPodUpdate := func(initState corev1.ContainerState, appState corev1.ContainerState) *watch.Event {
+		return &watch.Event{
+			Type: watch.Modified,
+			Object: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "TestHandlePodWatchEventWaitingFlapsPod",
+					Namespace: "TestHandlePodWatchEventWaitingFlapsNameSpace",
+				},
+				Status: corev1.PodStatus{
+					InitContainerStatuses: []corev1.ContainerStatus{
+						{Name: "init", State: initState, Ready: initState.Running != nil},
+					},
+					ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "app", State: appState, Ready: appState.Running != nil},
+					},
+				},
+			},
+		}
+	}
+
+	// The init container retries pulling its image
+	handlePodWatchEvent(ctx, newPodUpdate(waiting("ErrImagePull"), waiting("PodInitializing")))
+	handlePodWatchEvent(ctx, newPodUpdate(waiting("ImagePullBackOff"), waiting("PodInitializing")))
+	handlePodWatchEvent(ctx, newPodUpdate(waiting("ErrImagePull"), waiting("PodInitializing")))
+
+	// The app container crash-loops
+	completed := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}
+	handlePodWatchEvent(ctx, newPodUpdate(completed, waiting("CrashLoopBackOff")))
+	handlePodWatchEvent(ctx, newPodUpdate(completed, runningSince(time.Now())))
+	handlePodWatchEvent(ctx, newPodUpdate(completed, waiting("CrashLoopBackOff")))
+
+	// ...then runs for a while, and crash-loops again
+	handlePodWatchEvent(ctx, newPodUpdate(completed, runningSince(time.Now().Add(-time.Hour))))
+	handlePodWatchEvent(ctx, newPodUpdate(completed, waiting("CrashLoopBackOff")))
+
+	events := transport.Events()
+	expectedReasons := []string{"ErrImagePull", "CrashLoopBackOff", "CrashLoopBackOff"}
+	if len(events) != len(expectedReasons) {
+		t.Fatalf("received %d events, expected %d events", len(events), len(expectedReasons))
+	}
+	for i, expectedReason := range expectedReasons {
+		if events[i].Tags["reason"] != expectedReason {
+			t.Errorf("event %d has reason %q, wanted %q", i, events[i].Tags["reason"], expectedReason)
+		}
+	}
+	if events[0].Tags["container_name"] != "init" {
+		t.Errorf("received container_name %q, wanted %q", events[0].Tags["container_name"], "init")
+	}
+}
+
+// test that followers don't track the containers, and that the new leader
+// only reports the terminations that happened since the previous leader
+// stopped
+func TestHandlePodWatchEventTakeover(t *testing.T) {
+
+	// Define an SDK transport that only captures events but not send them
+	transport := &TransportMock{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Transport: transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration {
+			return []sentry.Integration{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := sentry.SetHubOnContext(context.Background(), sentry.NewHub(client, sentry.NewScope()))
+
+	agentLeaderElector = newLeaderElector(&leaderElectionConfig{identity: "TestHandlePodWatchEventTakeover"}, nil)
+	defer func() { agentLeaderElector = nil }()
+	defer func(since time.Time) { containerTracker.since = since }(containerTracker.since)
+
+	since := time.Now().Add(-time.Minute)
+	crashedAt := func(finishedAt time.Time, message string) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			ExitCode:   1,
+			Reason:     "Error",
+			Message:    message,
+			FinishedAt: metav1.NewTime(finishedAt),
+		}}
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	podUpdate := &watch.Event{
+		Type: watch.Modified,
+		Object: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "TestHandlePodWatchEventTakeoverPod",
+				Namespace: "TestHandlePodWatchEventTakeoverNameSpace",
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "old", State: running, LastTerminationState: crashedAt(since.Add(-time.Minute), "old crash"), RestartCount: 1},
+					{Name: "new", State: running, LastTerminationState: crashedAt(since.Add(time.Second), "new crash"), RestartCount: 1},
+				},
+			},
+		},
+	}
+
+	// Seen as a follower
+	handlePodWatchEvent(ctx, podUpdate)
+	if len(transport.Events()) != 0 {
+		t.Fatalf("follower reported %d events", len(transport.Events()))
+	}
+
+	// Taking over, the pods are replayed
+	agentLeaderElector.leading.Store(true)
+	containerTracker.restart("TestHandlePodWatchEventTakeoverNameSpace", since)
+	handlePodWatchEvent(ctx, &watch.Event{Type: watch.Added, Object: podUpdate.Object})
+	handlePodWatchEvent(ctx, podUpdate)
+
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("received %d events, expected %d event", len(events), 1)
+	}
+	if events[0].Tags["container_name"] != "new" {
+		t.Errorf("received container_name %q, wanted %q", events[0].Tags["container_name"], "new")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const rolloutsWatcherName = "rollouts"
+
+// Sentry requires an environment for deploys
+const defaultDeployEnvironment = "production"
+
+// A rollout that started, but is not complete yet
+type pendingRollout struct {
+	release string
+	started time.Time
+}
+
+// Remembers the last seen revision of every workload, so only new
+// revisions create releases and deploys
+type rolloutTracker struct {
+	mu sync.Mutex
+	// workload key -> revision
+	revisions map[string]string
+	pending   map[string]*pendingRollout
+}
+
+var workloadRollouts = newRolloutTracker()
+
+func newRolloutTracker() *rolloutTracker {
+	return &rolloutTracker{
+		revisions: map[string]string{},
+		pending:   map[string]*pendingRollout{},
+	}
+}
+
+// Returns true if the workload was seen before with a different revision
+func (t *rolloutTracker) observeRevision(key string, revision string, release string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lastRevision, seen := t.revisions[key]
+	t.revisions[key] = revision
+	if !seen || lastRevision == revision {
+		return false
+	}
+	t.pending[key] = &pendingRollout{release: release, started: time.Now()}
+	return true
+}
+
+// Returns the pending rollout if the workload has one, and forgets it
+func (t *rolloutTracker) completeRollout(key string) *pendingRollout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rollout := t.pending[key]
+	delete(t.pending, key)
+	return rollout
+}
+
+func (t *rolloutTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.revisions, key)
+	delete(t.pending, key)
+}
+
+// The environment mapping rules apply to deploys, too
+func getDeployEnvironment(ctx context.Context, state *workloadState) string {
+	objects := &metadataSourceObjects{
+		namespaceName: state.objectMeta.Namespace,
+		object:        &state.objectMeta,
+		podSpec:       &state.podTemplate.Spec,
+	}
+	if environment := sanitizeEnvironmentName(getFirstMetadataValue(ctx, environmentSources, objects)); environment != "" {
+		return environment
+	}
+	if hub := sentry.GetHubFromContext(ctx); hub != nil && hub.Client() != nil {
+		if environment := hub.Client().Options().Environment; environment != "" {
+			return environment
+		}
+	}
+	return defaultDeployEnvironment
+}
+
+func handleRolloutWatchEvent(ctx context.Context, event *watch.Event) {
+	if !inFlightEvents.start() {
+		return
+	}
+	defer inFlightEvents.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	logger := zerolog.Ctx(ctx)
+
+	var kind string
+	var state *workloadState
+	switch workload := event.Object.(type) {
+	case *appsv1.Deployment:
+		kind, state = "Deployment", getDeploymentState(workload)
+	case *appsv1.StatefulSet:
+		kind, state = "StatefulSet", getStatefulSetState(workload)
+	case *appsv1.DaemonSet:
+		kind, state = "DaemonSet", getDaemonSetState(workload)
+	default:
+		logger.Warn().Msgf("Skipping an event of kind '%v' because it cannot be casted", event.Object.GetObjectKind())
+		return
+	}
+
+	key := getWorkloadKey(state.objectMeta.Namespace, kind, state.objectMeta.Name)
+	ctx, logger = getLoggerWithTag(ctx, "object", key)
+
+	if event.Type == watch.Deleted {
+		workloadReleases.forget(key)
+		workloadRollouts.forget(key)
+		return
+	}
+	if event.Type != watch.Added && event.Type != watch.Modified {
+		logger.Debug().Msgf("Skipping a rollout watch event of type %s", event.Type)
+		return
+	}
+
+	data := newReleaseTemplateData(kind, state)
+	release, err := renderReleaseName(data)
+	if err != nil {
+		logger.Warn().Msgf("Cannot render the release name: %v", err)
+		return
+	}
+	if release == "" {
+		logger.Debug().Msgf("No release name for the workload, skipping")
+		return
+	}
+	workloadReleases.set(key, release, data)
+
+	// Existing workloads are only recorded, so restarts of the agent don't
+	// create deploys
+	apiClient := getSentryAPIClientFromContext(ctx)
+	if !isLeader() {
+		// Followers only track the rollouts
+		apiClient = nil
+	}
+	if workloadRollouts.observeRevision(key, state.revision, release) {
+		logger.Info().Msgf("New revision %q, release %q", state.revision, release)
+		if apiClient != nil {
+			if err := apiClient.createRelease(ctx, release); err != nil {
+				logger.Warn().Msgf("Cannot create release %q: %v", release, err)
+			}
+		}
+	}
+
+	if state.rolloutStatus != rolloutStatusComplete {
+		return
+	}
+	rollout := workloadRollouts.completeRollout(key)
+	if rollout == nil || apiClient == nil {
+		return
+	}
+	logger.Info().Msgf("Rollout of release %q is complete", rollout.release)
+	err = apiClient.createDeploy(ctx, rollout.release, getDeployEnvironment(ctx, state), key, rollout.started, time.Now())
+	if err != nil {
+		logger.Warn().Msgf("Cannot create a deploy of release %q: %v", rollout.release, err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"k8s.io/client-go/tools/cache"
+)
+
+// A watcher that keeps failing for this long is reported as unhealthy
+const watcherUnhealthyAfter = 5 * time.Minute
+
+// Errors that are further apart don't count as continuous failures. The
+// informers retry with a backoff of at most 30 seconds.
+const watcherErrorGap = time.Minute
+
+// The state of a single watcher (informer) as shown by the status server
+type watcherStatus struct {
+	name      string
+	namespace string
+	startedAt time.Time
+	hasSynced []cache.InformerSynced
+
+	mu            sync.Mutex
+	lastEventTime time.Time
+	errorCount    int64
+	lastError     string
+	lastErrorTime time.Time
+	// Zero if the last error was followed by an event
+	failingSince time.Time
+}
+
+type watcherStatusSnapshot struct {
+	Name          string     `json:"name"`
+	Namespace     string     `json:"namespace,omitempty"`
+	Synced        bool       `json:"synced"`
+	Healthy       bool       `json:"healthy"`
+	StartedAt     time.Time  `json:"startedAt"`
+	LastEventTime *time.Time `json:"lastEventTime,omitempty"`
+	ErrorCount    int64      `json:"errorCount"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+func (s *watcherStatus) recordEvent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastEventTime = time.Now()
+	s.failingSince = time.Time{}
+}
+
+func (s *watcherStatus) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.failingSince.IsZero() || now.Sub(s.lastErrorTime) > watcherErrorGap {
+		s.failingSince = now
+	}
+	s.errorCount++
+	s.lastError = err.Error()
+	s.lastErrorTime = now
+}
+
+func (s *watcherStatus) isSynced() bool {
+	for _, hasSynced := range s.hasSynced {
+		if !hasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Must be called with the lock held
+func (s *watcherStatus) isHealthy(now time.Time) bool {
+	if s.failingSince.IsZero() || now.Sub(s.lastErrorTime) > watcherErrorGap {
+		return true
+	}
+	return now.Sub(s.failingSince) < watcherUnhealthyAfter
+}
+
+func (s *watcherStatus) snapshot(now time.Time) watcherStatusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := watcherStatusSnapshot{
+		Name:       s.name,
+		Namespace:  s.namespace,
+		Synced:     s.isSynced(),
+		Healthy:    s.isHealthy(now),
+		StartedAt:  s.startedAt,
+		ErrorCount: s.errorCount,
+		LastError:  s.lastError,
+	}
+	if !s.lastEventTime.IsZero() {
+		lastEventTime := s.lastEventTime
+		snapshot.LastEventTime = &lastEventTime
+	}
+	if !s.lastErrorTime.IsZero() {
+		lastErrorTime := s.lastErrorTime
+		snapshot.LastErrorTime = &lastErrorTime
+	}
+	return snapshot
+}
+
+// Records every notification of the informer before passing it on
+func (s *watcherStatus) wrapHandler(handler cache.ResourceEventHandlerFuncs) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.recordEvent()
+			if handler.AddFunc != nil {
+				handler.AddFunc(obj)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			s.recordEvent()
+			if handler.UpdateFunc != nil {
+				handler.UpdateFunc(oldObj, newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			s.recordEvent()
+			if handler.DeleteFunc != nil {
+				handler.DeleteFunc(obj)
+			}
+		},
+	}
+}
+
+type watcherRegistry struct {
+	mu       sync.Mutex
+	watchers map[*watcherStatus]struct{}
+}
+
+var watcherStatuses = &watcherRegistry{watchers: map[*watcherStatus]struct{}{}}
+
+// Registers the watcher until the context is cancelled. Has to be called
+// before the informers are started, so their watch errors are recorded.
+func registerWatcher(ctx context.Context, name string, namespace string, informers ...cache.SharedIndexInformer) *watcherStatus {
+	status := &watcherStatus{
+		name:      name,
+		namespace: namespace,
+		startedAt: time.Now(),
+	}
+	for _, informer := range informers {
+		status.hasSynced = append(status.hasSynced, informer.HasSynced)
+		// The informer retries on its own, keep the default logging
+		err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			status.recordError(err)
+			cache.DefaultWatchErrorHandler(r, err)
+		})
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Msgf("Cannot track the watch errors of the %s watcher: %v", name, err)
+		}
+	}
+
+	watcherStatuses.mu.Lock()
+	watcherStatuses.watchers[status] = struct{}{}
+	watcherStatuses.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		watcherStatuses.mu.Lock()
+		delete(watcherStatuses.watchers, status)
+		watcherStatuses.mu.Unlock()
+	}()
+	return status
+}
+
+// Sorted by name and namespace
+func (r *watcherRegistry) snapshot() []watcherStatusSnapshot {
+	r.mu.Lock()
+	statuses := make([]*watcherStatus, 0, len(r.watchers))
+	for status := range r.watchers {
+		statuses = append(statuses, status)
+	}
+	r.mu.Unlock()
+
+	now := time.Now()
+	snapshots := make([]watcherStatusSnapshot, 0, len(statuses))
+	for _, status := range statuses {
+		snapshots = append(snapshots, status.snapshot(now))
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Name != snapshots[j].Name {
+			return snapshots[i].Name < snapshots[j].Name
+		}
+		return snapshots[i].Namespace < snapshots[j].Namespace
+	})
+	return snapshots
+}